@@ -2,9 +2,9 @@ package handlers
 
 import (
 	"bytes"
-	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
@@ -22,12 +22,28 @@ import (
 	securerandom "github.com/theckman/go-securerandom"
 
 	"github.com/gorilla/sessions"
+	"github.com/vouch/vouch-proxy/pkg/activity"
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/azure"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
 	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/device"
 	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/introspection"
+	"github.com/vouch/vouch-proxy/pkg/issuers"
 	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/keycloak"
+	"github.com/vouch/vouch-proxy/pkg/ldap"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
 	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/ratelimit"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+	"github.com/vouch/vouch-proxy/pkg/requestlog"
+	"github.com/vouch/vouch-proxy/pkg/saml"
+	"github.com/vouch/vouch-proxy/pkg/servicetoken"
+	"github.com/vouch/vouch-proxy/pkg/sessionstore"
 	"github.com/vouch/vouch-proxy/pkg/structs"
+	"github.com/vouch/vouch-proxy/pkg/tracing"
 	"golang.org/x/oauth2"
 )
 
@@ -38,6 +54,23 @@ type Index struct {
 	Testing  bool
 }
 
+// LoginForm variables passed to login.tmpl
+type LoginForm struct {
+	Msg      string
+	State    string
+	Username string
+}
+
+// DeviceForm variables passed to device.tmpl
+type DeviceForm struct {
+	Msg      string
+	State    string
+	UserCode string
+	Username string
+	Confirm  bool
+	Entry    bool
+}
+
 // AuthError sets the values to return to nginx
 type AuthError struct {
 	Error string
@@ -50,18 +83,43 @@ const (
 
 var (
 	// Templates
-	indexTemplate = template.Must(template.ParseFiles(filepath.Join(cfg.RootDir, "templates/index.tmpl")))
+	indexTemplate  = template.Must(template.ParseFiles(filepath.Join(cfg.RootDir, "templates/index.tmpl")))
+	loginTemplate  = template.Must(template.ParseFiles(filepath.Join(cfg.RootDir, "templates/login.tmpl")))
+	deviceTemplate = template.Must(template.ParseFiles(filepath.Join(cfg.RootDir, "templates/device.tmpl")))
 
 	// http://www.gorillatoolkit.org/pkg/sessions
-	sessstore = sessions.NewCookieStore([]byte(cfg.Cfg.Session.Key))
+	cookieStore = sessions.NewCookieStore([]byte(cfg.Cfg.Session.Key))
+	// the login state between /login and /auth, in redis with `vouch.session.store: redis`
+	sessstore loginStore = cookieStore
+
+	// the db, see SetStore
+	db model.Store
 
 	log     = cfg.Cfg.Logger
 	fastlog = cfg.Cfg.FastLogger
 )
 
+// SetStore sets the db the handlers keep the users and sites in
+func SetStore(s model.Store) {
+	db = s
+}
+
+// loginStore is satisfied by both the gorilla CookieStore and redis.LoginStore
+type loginStore interface {
+	sessions.Store
+	MaxAge(int)
+}
+
 func init() {
-	sessstore.Options.HttpOnly = cfg.Cfg.Cookie.HTTPOnly
-	sessstore.Options.Secure = cfg.Cfg.Cookie.Secure
+	cookieStore.Options.HttpOnly = cfg.Cfg.Cookie.HTTPOnly
+	cookieStore.Options.Secure = cfg.Cfg.Cookie.Secure
+	if cfg.GenOAuth != nil && cfg.GenOAuth.Provider == cfg.Providers.SAML && cfg.Cfg.Cookie.Secure {
+		// the IdP POSTs the SAMLResponse to /auth from its own site, the session has to come along with it
+		cookieStore.Options.SameSite = http.SameSiteNoneMode
+	}
+	if cfg.Cfg.Session.Store == "redis" {
+		sessstore = redis.NewLoginStore(cookieStore.Options)
+	}
 }
 
 func loginURL(r *http.Request, state string) string {
@@ -122,21 +180,60 @@ func FindJWT(r *http.Request) string {
 	return ""
 }
 
+// bearerToken the token from the `Authorization: Bearer` header
+func bearerToken(r *http.Request) string {
+	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(s) == 2 && strings.EqualFold(s[0], "Bearer") {
+		return s[1]
+	}
+	return ""
+}
+
+// idpToken is an access token issued by the IdP
+type idpToken interface {
+	User() structs.User
+	VouchClaims() jwtmanager.VouchClaims
+}
+
+// idpClaims verifies an access token issued by one of the trusted issuers or else asks the IdP about it,
+// and then holds its user to the same rules as a login at /auth
+func idpClaims(r *http.Request, token string) (jwtmanager.VouchClaims, error) {
+	var t idpToken
+	err := issuers.ErrUntrusted
+	if issuers.Enabled() {
+		t, err = issuers.Verify(token)
+	}
+	if err == issuers.ErrUntrusted && introspection.Enabled() {
+		t, err = introspection.Introspect(r, token)
+	}
+	if err != nil {
+		return jwtmanager.VouchClaims{}, err
+	}
+	if ok, err := VerifyUser(r, t.User()); !ok {
+		return jwtmanager.VouchClaims{}, err
+	}
+	return t.VouchClaims(), nil
+}
+
 // ClaimsFromJWT parse the jwt and return the claims
-func ClaimsFromJWT(jwt string) (jwtmanager.VouchClaims, error) {
+// a server side session id is swapped for the session's jwt first
+func ClaimsFromJWT(r *http.Request, jwt string) (jwtmanager.VouchClaims, error) {
+	log := requestlog.Logger(r)
 	var claims jwtmanager.VouchClaims
 
-	jwtParsed, err := jwtmanager.ParseTokenString(jwt)
-	if err != nil {
-		// it didn't parse, which means its bad, start over
-		log.Error("jwtParsed returned error, clearing cookie")
-		return claims, err
+	if sessionstore.IsSessionID(jwt) {
+		token, err := sessionstore.Token(jwt)
+		if err != nil {
+			return claims, err
+		}
+		jwt = token
 	}
 
-	claims, err = jwtmanager.PTokenClaims(jwtParsed)
+	// verified once, then taken from the cache until the token expires
+	claims, err := jwtmanager.ParseClaims(jwt)
 	if err != nil {
-		// claims = jwtmanager.PTokenClaims(jwtParsed)
-		// if claims == &jwtmanager.VouchClaims{} {
+		// it didn't parse, which means its bad, start over
+		log.Debug("jwtParsed returned error, clearing cookie")
 		return claims, err
 	}
 	log.Debugf("JWT Claims: %+v", claims)
@@ -146,13 +243,24 @@ func ClaimsFromJWT(jwt string) (jwtmanager.VouchClaims, error) {
 // ValidateRequestHandler /validate
 // TODO this should use the handler interface
 func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
+	// the request's loggers, which carry the request ID, see pkg/requestlog
+	log := requestlog.Logger(r)
+	fastlog := log.Desugar()
 	fastlog.Debug("/validate")
 
+	// counted and logged once the response is made, whichever way it went
+	outcome := metrics.ValidateOK
+	defer func() {
+		metrics.Validate(outcome)
+		requestlog.SetDecision(r, outcome)
+	}()
+
 	// TODO: collapse all of the `if !cfg.Cfg.PublicAccess` calls
 	// perhaps using an `ok=false` pattern
 	jwt := FindJWT(r)
 	// if jwt != "" {
 	if jwt == "" {
+		outcome = metrics.ValidateNoJWT
 		// If the module is configured to allow public access with no authentication, return 200 now
 		if cfg.Cfg.PublicAccess {
 			w.Header().Add(cfg.Cfg.Headers.User, "")
@@ -164,8 +272,39 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims, err := ClaimsFromJWT(jwt)
+	// a client which keeps trying bearer tokens that don't work is turned away, before the IdP is asked about them
+	bearer := jwt == bearerToken(r)
+	if bearer && ratelimit.BearerLimited(w, r) {
+		outcome = metrics.ValidateRateLimited
+		return
+	}
+
+	if servicetoken.IsServiceToken(jwt) {
+		outcome = validateServiceToken(w, r, jwt)
+		if bearer && outcome != metrics.ValidateOK {
+			ratelimit.BearerFailed(r)
+		}
+		return
+	}
+
+	claims, err := ClaimsFromJWT(r, jwt)
+	if err != nil && (issuers.Enabled() || introspection.Enabled()) && bearer {
+		// not one of ours, perhaps the IdP issued it
+		claims, err = idpClaims(r, jwt)
+		// ran out of tries while the IdP was being asked about the client's other tokens
+		if err == introspection.ErrLimited && ratelimit.BearerLimited(w, r) {
+			outcome = metrics.ValidateRateLimited
+			return
+		}
+	}
 	if err != nil {
+		if bearer {
+			ratelimit.BearerFailed(r)
+		}
+		outcome = metrics.ValidateInvalid
+		if jwtmanager.IsExpired(err) {
+			outcome = metrics.ValidateExpired
+		}
 		// no email in jwt
 		if !cfg.Cfg.PublicAccess {
 			error401(w, r, AuthError{err.Error(), jwt})
@@ -176,6 +315,7 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if claims.Username == "" {
+		outcome = metrics.ValidateInvalid
 		// no email in jwt
 		if !cfg.Cfg.PublicAccess {
 			error401(w, r, AuthError{"no Username found in jwt", jwt})
@@ -184,11 +324,21 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	log = requestlog.SetUsername(r, claims.Username)
+	fastlog = log.Desugar()
 	fastlog.Info("jwt cookie",
 		zap.String("username", claims.Username))
 
 	if !cfg.Cfg.AllowAllUsers {
-		if !jwtmanager.SiteInClaims(r.Host, &claims) {
+		if !jwtmanager.HostInClaims(jwt, r.Host, &claims) {
+			outcome = metrics.ValidateWrongHost
+			if audit.Enabled() {
+				e := audit.NewEvent(r, audit.AccessDenied)
+				e.Username = claims.Username
+				e.Host = r.Host
+				e.Reason = "site not in the jwt"
+				audit.Log(e)
+			}
 			if !cfg.Cfg.PublicAccess {
 				error401(w, r, AuthError{
 					fmt.Sprintf("http header 'Host: %s' not authorized for configured `vouch.domains` (is Host being sent properly?)", r.Host),
@@ -199,6 +349,23 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	// the roles may have changed in `vouch.allowRoles` since the jwt was issued
+	if err := keycloak.Allowed(claims.CustomClaims); err != nil {
+		outcome = metrics.ValidateForbidden
+		if audit.Enabled() {
+			e := audit.NewEvent(r, audit.AccessDenied)
+			e.Username = claims.Username
+			e.Host = r.Host
+			e.Reason = err.Error()
+			audit.Log(e)
+		}
+		if !cfg.Cfg.PublicAccess {
+			error401(w, r, AuthError{err.Error(), jwt})
+		} else {
+			w.Header().Add(cfg.Cfg.Headers.User, "")
+		}
+		return
+	}
 	if len(cfg.Cfg.Headers.Claims) > 0 {
 		log.Debug("Found claims in config, finding specific keys...")
 		// Run through all the claims found
@@ -260,33 +427,27 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO
 	// parse the jwt and see if the claim is valid for the domain
 
-	// update user last access in a go routine
-	// user := structs.User{}
-	// err = model.User([]byte(email), &user)
-	// if err != nil {
-	// 	// no email in jwt, or no email in db
-	// 	error401(w, r, err.Error())
-	// 	return
-	// }
-	// if user.Email == "" {
-	// 	error401(w, r, "no email found in db")
-	// 	return
-	// }
-
-	// put the site
-	go func() {
-		s := structs.Site{Domain: r.Host}
-		log.Debugf("site struct: %v", s)
-		if err = model.PutSite(s); err != nil {
-			log.Error(err)
-		}
-	}()
+	// count the request, the user's last access and the site are written to the db in batches
+	activity.Record(claims.Username, r.Host)
 }
 
 // LogoutHandler /logout
 // currently performs a 302 redirect to Google
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestlog.Logger(r)
 	log.Debug("/logout")
+	if audit.Enabled() {
+		e := audit.NewEvent(r, audit.Logout)
+		if claims, err := ClaimsFromJWT(r, FindJWT(r)); err == nil {
+			e.Username = claims.Username
+		}
+		audit.Log(e)
+	}
+	if id, err := cookie.Cookie(r); err == nil && sessionstore.IsSessionID(id) {
+		if err = sessionstore.Revoke(id); err != nil {
+			log.Error(err)
+		}
+	}
 	cookie.ClearCookie(w, r)
 
 	log.Debug("saving session")
@@ -308,6 +469,115 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// DeviceHandler /device
+// where the user approves the device authorization of a CLI, see pkg/device
+func DeviceHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestlog.Logger(r)
+	log.Debug("/device")
+
+	jwt, err := cookie.Cookie(r)
+	claims := jwtmanager.VouchClaims{}
+	if err == nil {
+		claims, err = ClaimsFromJWT(r, jwt)
+	}
+	if err != nil || claims.Username == "" {
+		// log in and come back here
+		redirect302(w, r, "/login?url="+url.QueryEscape(r.URL.RequestURI()))
+		return
+	}
+	log = requestlog.SetUsername(r, claims.Username)
+
+	session, err := sessstore.Get(r, cfg.Cfg.Session.Name)
+	if err != nil {
+		log.Warnf("couldn't find existing encrypted secure cookie with name %s: %s (probably fine)", cfg.Cfg.Session.Name, err)
+	}
+
+	if r.Method == http.MethodPost {
+		// the form must have come from the page rendered below
+		if state := r.PostFormValue("state"); state == "" || session.Values["deviceState"] != state {
+			log.Errorf("/device Invalid session state: stored %s, returned %s", session.Values["deviceState"], state)
+			renderDeviceForm(w, &DeviceForm{Msg: "invalid session state, please start again", Entry: true})
+			return
+		}
+		// the form can be submitted once
+		delete(session.Values, "deviceState")
+		if err = session.Save(r, w); err != nil {
+			log.Error(err)
+		}
+		userCode := r.PostFormValue("user_code")
+		if r.PostFormValue("action") != "approve" {
+			if err = device.Deny(userCode); err != nil {
+				log.Error(err)
+			}
+			renderDeviceForm(w, &DeviceForm{Msg: "the device was denied access"})
+			return
+		}
+		// the device is issued a token of its own carrying the same claims as the user's
+		tokenstring := jwtmanager.CreateUserTokenString(
+			userFromClaims(r, claims),
+			structs.CustomClaims{Claims: claims.CustomClaims},
+			structs.PTokens{PAccessToken: claims.PAccessToken, PIdToken: claims.PIdToken})
+		if tokenstring == "" {
+			http.Error(w, "the token could not be issued", http.StatusInternalServerError)
+			return
+		}
+		if err = device.Approve(userCode, claims.Username, tokenstring); err != nil {
+			renderDeviceForm(w, &DeviceForm{Msg: err.Error(), Entry: true})
+			return
+		}
+		renderDeviceForm(w, &DeviceForm{Msg: "the device is logged in as " + claims.Username + ", you may return to it now"})
+		return
+	}
+
+	userCode := r.URL.Query().Get("user_code")
+	if userCode == "" {
+		renderDeviceForm(w, &DeviceForm{Msg: "enter the code shown by your device", Entry: true})
+		return
+	}
+	dc, err := device.Pending(userCode)
+	if err != nil {
+		renderDeviceForm(w, &DeviceForm{Msg: err.Error(), UserCode: userCode, Entry: true})
+		return
+	}
+
+	state, err := generateStateNonce()
+	if err != nil {
+		log.Error(err)
+	}
+	session.Values["deviceState"] = state
+	if err = session.Save(r, w); err != nil {
+		log.Error(err)
+	}
+	renderDeviceForm(w, &DeviceForm{
+		State:    state,
+		UserCode: device.FormatUserCode(dc.UserCode),
+		Username: claims.Username,
+		Confirm:  true,
+	})
+}
+
+// userFromClaims the user the claims were issued to, as it was kept in the db when they logged in,
+// with the email and name of the claims where the IdP sent them
+func userFromClaims(r *http.Request, claims jwtmanager.VouchClaims) structs.User {
+	user := structs.User{Username: claims.Username}
+	if err := db.User([]byte(claims.Username), &user); err != nil && err != model.ErrNotFound {
+		requestlog.Logger(r).Error(err)
+	}
+	if email, ok := claims.CustomClaims["email"].(string); ok && email != "" {
+		user.Email = email
+	}
+	if name, ok := claims.CustomClaims["name"].(string); ok && name != "" {
+		user.Name = name
+	}
+	return user
+}
+
+func renderDeviceForm(w http.ResponseWriter, form *DeviceForm) {
+	if err := deviceTemplate.Execute(w, form); err != nil {
+		log.Error(err)
+	}
+}
+
 // HealthcheckHandler /healthcheck
 // just returns 200 '{ "ok": true }'
 func HealthcheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -319,6 +589,31 @@ func HealthcheckHandler(w http.ResponseWriter, r *http.Request) {
 
 var regExJustAlphaNum, _ = regexp.Compile("[^a-zA-Z0-9]+")
 
+// AuditHandler /audit
+// the audit log, for the users listed in `vouch.audit.admins`
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	AdminHandler(audit.QueryHandler)(w, r)
+}
+
+// AdminHandler lets only the logged in users of `vouch.audit.admins` through to h, such as
+// servicetoken.RevokeHandler and sessionstore.RevokeHandler
+func AdminHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := ClaimsFromJWT(r, FindJWT(r))
+		if err != nil {
+			error401(w, r, AuthError{Error: err.Error()})
+			return
+		}
+		log := requestlog.SetUsername(r, claims.Username)
+		if !audit.IsAdmin(claims.Username) {
+			log.Warnf("%s is not allowed to %s", claims.Username, r.URL.Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
 func generateStateNonce() (string, error) {
 	state, err := securerandom.URLBase64InBytes(base64Bytes)
 	if err != nil {
@@ -328,9 +623,49 @@ func generateStateNonce() (string, error) {
 	return state, nil
 }
 
+// validateServiceToken the machine client equivalent of the JWT checks in ValidateRequestHandler
+// returns the outcome for the metrics
+func validateServiceToken(w http.ResponseWriter, r *http.Request, token string) string {
+	st, err := servicetoken.Validate(token, r.Host)
+	if err != nil {
+		requestlog.Logger(r).Infof("service token %s refused for %s: %s", st.Name, r.Host, err)
+		if !cfg.Cfg.PublicAccess {
+			error401(w, r, AuthError{Error: err.Error()})
+		} else {
+			w.Header().Add(cfg.Cfg.Headers.User, "")
+		}
+		switch err {
+		case servicetoken.ErrExpired:
+			return metrics.ValidateExpired
+		case servicetoken.ErrScope:
+			return metrics.ValidateForbidden
+		}
+		return metrics.ValidateInvalid
+	}
+	log := requestlog.SetUsername(r, st.Name)
+	log.Desugar().Info("service token",
+		zap.String("name", st.Name))
+
+	w.Header().Add(cfg.Cfg.Headers.User, st.Name)
+	w.Header().Add(cfg.Cfg.Headers.Success, "true")
+	if cfg.Cfg.Testing {
+		renderIndex(w, "service token authorized "+st.Name)
+	} else {
+		ok200(w, r)
+	}
+
+	go func() {
+		if err := servicetoken.Touch(st); err != nil {
+			log.Error(err)
+		}
+	}()
+	return metrics.ValidateOK
+}
+
 // LoginHandler /login
 // currently performs a 302 redirect to Google
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestlog.Logger(r)
 	log.Debug("/login")
 	// no matter how you ended up here, make sure the cookie gets cleared out
 	cookie.ClearCookie(w, r)
@@ -349,6 +684,18 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	session.Values["state"] = state
 	log.Debugf("session state set to %s", session.Values["state"])
 
+	var samlURL string
+	if cfg.GenOAuth.Provider == cfg.Providers.SAML {
+		// the ID of the AuthnRequest is kept in the session so that /auth only accepts the response to this request
+		var requestID string
+		if samlURL, requestID, err = saml.LoginURL(state); err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		session.Values["samlRequestID"] = requestID
+	}
+
 	// increment the failure counter for this domain
 
 	// requestedURL comes from nginx in the query string via a 302 redirect
@@ -361,6 +708,10 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	e := audit.NewEvent(r, audit.LoginStarted)
+	e.Host = audit.HostOf(requestedURL)
+	audit.Log(e)
+
 	// set session variable for eventual 302 redirecton to original request
 	session.Values["requestedURL"] = requestedURL
 	log.Debugf("session requestedURL set to %s", session.Values["requestedURL"])
@@ -382,9 +733,15 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if failcount > 2 {
 		var vouchError = r.URL.Query().Get("error")
 		renderIndex(w, "/login too many redirects for "+requestedURL+" - "+vouchError)
+	} else if cfg.GenOAuth.Provider == cfg.Providers.LDAP {
+		// there's no one to bounce to, the form POSTs straight to /auth
+		renderLoginForm(w, &LoginForm{State: state})
 	} else {
 		// bounce to oauth provider for login
-		var lURL = loginURL(r, state)
+		var lURL = samlURL
+		if lURL == "" {
+			lURL = loginURL(r, state)
+		}
 		log.Debugf("redirecting to oauthURL %s", lURL)
 		redirect302(w, r, lURL)
 	}
@@ -396,9 +753,16 @@ func renderIndex(w http.ResponseWriter, msg string) {
 	}
 }
 
+func renderLoginForm(w http.ResponseWriter, form *LoginForm) {
+	if err := loginTemplate.Execute(w, form); err != nil {
+		log.Error(err)
+	}
+}
+
 // VerifyUser validates that the domains match for the user
 // func VerifyUser(u structs.User) (ok bool, err error) {
-func VerifyUser(u interface{}) (ok bool, err error) {
+func VerifyUser(r *http.Request, u interface{}) (ok bool, err error) {
+	log := requestlog.Logger(r)
 	// (w http.ResponseWriter, req http.Request)
 	// is Hd google specific? probably yes
 	// TODO rewrite / abstract this validation
@@ -439,6 +803,7 @@ func VerifyUser(u interface{}) (ok bool, err error) {
 // - create user
 // - issue jwt in the form of a cookie
 func CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestlog.Logger(r)
 	log.Debug("/auth")
 	// Handle the exchange code to initiate a transport.
 
@@ -451,8 +816,34 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 
 	// is the nonce "state" valid?
 	queryState := r.URL.Query().Get("state")
+	if cfg.GenOAuth.Provider == cfg.Providers.SAML {
+		// the SAML IdP POSTs the state back as the RelayState
+		queryState = r.PostFormValue("RelayState")
+	} else if cfg.GenOAuth.Provider == cfg.Providers.LDAP {
+		queryState = r.PostFormValue("state")
+	}
+	requestedURL, _ := session.Values["requestedURL"].(string)
+	denied := func(username, reason string) {
+		e := audit.NewEvent(r, audit.LoginDenied)
+		e.Username = username
+		e.Host = audit.HostOf(requestedURL)
+		e.Reason = reason
+		audit.Log(e)
+		metrics.Login(metrics.LoginDenied)
+		requestlog.SetDecision(r, metrics.LoginDenied)
+		ratelimit.LoginFailed(r, username)
+		if username != "" {
+			// the IdP isn't asked about this browser's next try while the user is locked out, see below
+			session.Values["deniedUser"] = username
+			if err := session.Save(r, w); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
 	if session.Values["state"] != queryState {
 		log.Errorf("/auth Invalid session state: stored %s, returned %s", session.Values["state"], queryState)
+		denied("", "invalid session state")
 		renderIndex(w, "/auth Invalid session state.")
 		return
 	}
@@ -461,6 +852,7 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	if errorState != "" {
 		errorDescription := r.URL.Query().Get("error_description")
 		log.Warn("/auth Error state: ", errorState, ", Error description: ", errorDescription)
+		denied("", errorState+": "+errorDescription)
 		w.WriteHeader(http.StatusForbidden)
 		renderIndex(w, "FORBIDDEN: "+errorDescription)
 		return
@@ -470,18 +862,55 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	customClaims := structs.CustomClaims{}
 	ptokens := structs.PTokens{}
 
-	if err := getUserInfo(r, &user, &customClaims, &ptokens); err != nil {
+	if cfg.GenOAuth.Provider == cfg.Providers.SAML {
+		requestID, _ := session.Values["samlRequestID"].(string)
+		err = saml.ParseResponse(r, []string{requestID}, &user, &customClaims)
+	} else if cfg.GenOAuth.Provider == cfg.Providers.LDAP {
+		username := r.PostFormValue("username")
+		// locked out after too many wrong passwords
+		if ratelimit.UserLocked(w, r, username) {
+			return
+		}
+		err = ldap.Authenticate(username, r.PostFormValue("password"), &user, &customClaims)
+		if err == ldap.ErrInvalidCredentials {
+			denied(username, err.Error())
+			// same state, let them try again
+			w.WriteHeader(http.StatusUnauthorized)
+			renderLoginForm(w, &LoginForm{Msg: "invalid username or password", State: queryState, Username: username})
+			return
+		}
+	} else {
+		// the username is only known once the IdP has been asked, which a locked out user who was denied here before
+		// doesn't get to do
+		if deniedUser, _ := session.Values["deniedUser"].(string); ratelimit.UserLocked(w, r, deniedUser) {
+			return
+		}
+		err = getUserInfo(r, &user, &customClaims, &ptokens)
+	}
+	if err != nil {
 		log.Error(err)
+		denied(user.Username, err.Error())
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	log = requestlog.SetUsername(r, user.Username)
+	if ratelimit.UserLocked(w, r, user.Username) {
+		return
+	}
 	log.Debugf("/auth Claims from userinfo: %+v", customClaims)
 	//getProviderJWT(r, &user)
 	log.Debug("/auth CallbackHandler")
 	log.Debugf("/auth %+v", user)
 
-	if ok, err := VerifyUser(user); !ok {
+	if ok, err := VerifyUser(r, user); !ok {
 		log.Error(err)
+		denied(user.Username, err.Error())
+		renderIndex(w, fmt.Sprintf("/auth User is not authorized. %s Please try again.", err))
+		return
+	}
+	if err := keycloak.Allowed(customClaims.Claims); err != nil {
+		log.Info(err)
+		denied(user.Username, err.Error())
 		renderIndex(w, fmt.Sprintf("/auth User is not authorized. %s Please try again.", err))
 		return
 	}
@@ -489,20 +918,46 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	// SUCCESS!! they are authorized
 
 	// store the user in the database
-	if err = model.PutUser(user); err != nil {
+	_, span := tracing.StartSpan(r.Context(), "model.PutUser")
+	err = db.PutUser(user)
+	tracing.End(span, err)
+	if err != nil {
 		log.Error(err)
 	}
 
 	// issue the jwt
 	tokenstring := jwtmanager.CreateUserTokenString(user, customClaims, ptokens)
+	if tokenstring == "" {
+		http.Error(w, "the token could not be issued", http.StatusInternalServerError)
+		return
+	}
+	if sessionstore.Enabled() {
+		// keep the jwt server side, the cookie only gets the session id
+		_, span := tracing.StartSpan(r.Context(), "sessionstore.Create")
+		id, err := sessionstore.Create(user.Username, tokenstring)
+		tracing.End(span, err)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tokenstring = id
+	}
 	cookie.SetCookie(w, r, tokenstring)
 
+	e := audit.NewEvent(r, audit.LoginSucceeded)
+	e.Username = user.Username
+	e.Host = audit.HostOf(requestedURL)
+	audit.Log(e)
+	metrics.Login(metrics.LoginSucceeded)
+	requestlog.SetDecision(r, metrics.LoginSucceeded)
+
 	// get the originally requested URL so we can send them on their way
-	requestedURL := session.Values["requestedURL"].(string)
 	if requestedURL != "" {
 		// clear out the session value
 		session.Values["requestedURL"] = ""
 		session.Values[requestedURL] = 0
+		delete(session.Values, "deniedUser")
 		if err = session.Save(r, w); err != nil {
 			log.Error(err)
 		}
@@ -516,7 +971,10 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 
 // TODO: put all getUserInfo logic into its own pkg
 
-func getUserInfo(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens) error {
+func getUserInfo(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens) (rerr error) {
+	log := requestlog.Logger(r)
+	ctx, span := tracing.StartSpan(r.Context(), "getUserInfo")
+	defer func() { tracing.End(span, rerr) }()
 
 	// indieauth sends the "me" setting in json back to the callback, so just pluck it from the callback
 	if cfg.GenOAuth.Provider == cfg.Providers.IndieAuth {
@@ -524,18 +982,26 @@ func getUserInfo(r *http.Request, user *structs.User, customClaims *structs.Cust
 	} else if cfg.GenOAuth.Provider == cfg.Providers.ADFS {
 		return getUserInfoFromADFS(r, user, customClaims, ptokens)
 	}
-	providerToken, err := cfg.OAuthClient.Exchange(context.TODO(), r.URL.Query().Get("code"))
+	// the requests to the IdP are timed, see pkg/metrics
+	ctx = metrics.IdPContext(ctx)
+	exchangeCtx, exchangeSpan := tracing.StartSpan(ctx, "oauth2.Exchange")
+	providerToken, err := cfg.OAuthClient.Exchange(exchangeCtx, r.URL.Query().Get("code"))
+	tracing.End(exchangeSpan, err)
 	if err != nil {
 		return err
 	}
+
+	// the "third leg", fetching the userinfo
+	ctx, userinfoSpan := tracing.StartSpan(ctx, "userinfo")
+	defer func() { tracing.End(userinfoSpan, rerr) }()
 	if cfg.GenOAuth.Provider == cfg.Providers.HomeAssistant {
 		ptokens.PAccessToken = providerToken.Extra("access_token").(string)
 		return getUserInfoFromHomeAssistant(r, user, customClaims)
 	}
 	ptokens.PAccessToken = providerToken.AccessToken
 	if cfg.GenOAuth.Provider == cfg.Providers.OpenStax {
-		client := cfg.OAuthClient.Client(context.TODO(), providerToken)
-		return getUserInfoFromOpenStax(client, user, customClaims, providerToken)
+		client := cfg.OAuthClient.Client(ctx, providerToken)
+		return getUserInfoFromOpenStax(r, client, user, customClaims, providerToken)
 	}
 
 	if (providerToken.Extra("id_token") != nil) {
@@ -549,19 +1015,22 @@ func getUserInfo(r *http.Request, user *structs.User, customClaims *structs.Cust
 	log.Debugf("ptokens: %+v", ptokens)
 
 	// make the "third leg" request back to provider to exchange the token for the userinfo
-	client := cfg.OAuthClient.Client(context.TODO(), providerToken)
+	client := cfg.OAuthClient.Client(ctx, providerToken)
 	if cfg.GenOAuth.Provider == cfg.Providers.Google {
-		return getUserInfoFromGoogle(client, user, customClaims)
+		return getUserInfoFromGoogle(r, client, user, customClaims)
 	} else if cfg.GenOAuth.Provider == cfg.Providers.GitHub {
-		return getUserInfoFromGitHub(client, user, customClaims, providerToken)
+		return getUserInfoFromGitHub(r, client, user, customClaims, providerToken)
 	} else if cfg.GenOAuth.Provider == cfg.Providers.OIDC {
-		return getUserInfoFromOpenID(client, user, customClaims, providerToken)
+		return getUserInfoFromOpenID(r, client, user, customClaims, providerToken)
+	} else if cfg.GenOAuth.Provider == cfg.Providers.Azure {
+		return getUserInfoFromAzure(r, client, user, customClaims, ptokens)
 	}
 	log.Error("we don't know how to look up the user info")
 	return nil
 }
 
-func getUserInfoFromOpenID(client *http.Client, user *structs.User, customClaims *structs.CustomClaims, ptoken *oauth2.Token) (rerr error) {
+func getUserInfoFromOpenID(r *http.Request, client *http.Client, user *structs.User, customClaims *structs.CustomClaims, ptoken *oauth2.Token) (rerr error) {
+	log := requestlog.Logger(r)
 	userinfo, err := client.Get(cfg.GenOAuth.UserInfoURL)
 	if err != nil {
 		return err
@@ -573,7 +1042,7 @@ func getUserInfoFromOpenID(client *http.Client, user *structs.User, customClaims
 	}()
 	data, _ := ioutil.ReadAll(userinfo.Body)
 	log.Infof("OpenID userinfo body: %s", string(data))
-	if err = mapClaims(data, customClaims); err != nil {
+	if err = mapClaims(r, data, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -582,10 +1051,38 @@ func getUserInfoFromOpenID(client *http.Client, user *structs.User, customClaims
 		return err
 	}
 	user.PrepareUserData()
+	if cfg.GenOAuth.KeycloakRoles {
+		return mapKeycloakRoles(r, data, ptoken, customClaims)
+	}
 	return nil
 }
 
-func getUserInfoFromOpenStax(client *http.Client, user *structs.User, customClaims *structs.CustomClaims, ptoken *oauth2.Token) (rerr error) {
+// mapKeycloakRoles flattens `realm_access.roles` and `resource_access.<client>.roles` found in the userinfo
+// and in the access token into a single `roles` claim
+func mapKeycloakRoles(r *http.Request, userinfo []byte, ptoken *oauth2.Token, customClaims *structs.CustomClaims) error {
+	log := requestlog.Logger(r)
+	var uiClaims, atClaims map[string]interface{}
+	if err := json.Unmarshal(userinfo, &uiClaims); err != nil {
+		return err
+	}
+	// Keycloak only adds the roles to the userinfo if the mapper is configured to, but they're always in the access token
+	if at, err := jwtPayload(ptoken.AccessToken); err == nil {
+		if err = json.Unmarshal(at, &atClaims); err != nil {
+			log.Debugf("access token claims could not be parsed: %s", err)
+		}
+	} else {
+		log.Debugf("access token is not a jwt: %s", err)
+	}
+	if customClaims.Claims == nil {
+		customClaims.Claims = make(map[string]interface{})
+	}
+	customClaims.Claims[keycloak.Claim] = keycloak.Roles(cfg.GenOAuth.KeycloakClient, uiClaims, atClaims)
+	log.Debugf("keycloak roles claim: %+v", customClaims.Claims[keycloak.Claim])
+	return nil
+}
+
+func getUserInfoFromOpenStax(r *http.Request, client *http.Client, user *structs.User, customClaims *structs.CustomClaims, ptoken *oauth2.Token) (rerr error) {
+	log := requestlog.Logger(r)
 	userinfo, err := client.Get(cfg.GenOAuth.UserInfoURL)
 	if err != nil {
 		return err
@@ -597,7 +1094,7 @@ func getUserInfoFromOpenStax(client *http.Client, user *structs.User, customClai
 	}()
 	data, _ := ioutil.ReadAll(userinfo.Body)
 	log.Infof("OpenStax userinfo body: %s", string(data))
-	if err = mapClaims(data, customClaims); err != nil {
+	if err = mapClaims(r, data, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -616,7 +1113,8 @@ func getUserInfoFromOpenStax(client *http.Client, user *structs.User, customClai
 	return nil
 }
 
-func getUserInfoFromGoogle(client *http.Client, user *structs.User, customClaims *structs.CustomClaims) (rerr error) {
+func getUserInfoFromGoogle(r *http.Request, client *http.Client, user *structs.User, customClaims *structs.CustomClaims) (rerr error) {
+	log := requestlog.Logger(r)
 	userinfo, err := client.Get(cfg.GenOAuth.UserInfoURL)
 	if err != nil {
 		return err
@@ -628,7 +1126,7 @@ func getUserInfoFromGoogle(client *http.Client, user *structs.User, customClaims
 	}()
 	data, _ := ioutil.ReadAll(userinfo.Body)
 	log.Infof("google userinfo body: %s", string(data))
-	if err = mapClaims(data, customClaims); err != nil {
+	if err = mapClaims(r, data, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -643,8 +1141,8 @@ func getUserInfoFromGoogle(client *http.Client, user *structs.User, customClaims
 
 // github
 // https://developer.github.com/apps/building-integrations/setting-up-and-registering-oauth-apps/about-authorization-options-for-oauth-apps/
-func getUserInfoFromGitHub(client *http.Client, user *structs.User, customClaims *structs.CustomClaims, ptoken *oauth2.Token) (rerr error) {
-
+func getUserInfoFromGitHub(r *http.Request, client *http.Client, user *structs.User, customClaims *structs.CustomClaims, ptoken *oauth2.Token) (rerr error) {
+	log := requestlog.Logger(r)
 	log.Errorf("ptoken.AccessToken: %s", ptoken.AccessToken)
 	userinfo, err := client.Get(cfg.GenOAuth.UserInfoURL + ptoken.AccessToken)
 	if err != nil {
@@ -658,7 +1156,7 @@ func getUserInfoFromGitHub(client *http.Client, user *structs.User, customClaims
 	}()
 	data, _ := ioutil.ReadAll(userinfo.Body)
 	log.Infof("github userinfo body: %s", string(data))
-	if err = mapClaims(data, customClaims); err != nil {
+	if err = mapClaims(r, data, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -685,7 +1183,7 @@ func getUserInfoFromGitHub(client *http.Client, user *structs.User, customClaims
 }
 
 func getUserInfoFromIndieAuth(r *http.Request, user *structs.User, customClaims *structs.CustomClaims) (rerr error) {
-
+	log := requestlog.Logger(r)
 	code := r.URL.Query().Get("code")
 	log.Errorf("ptoken.AccessToken: %s", code)
 	var b bytes.Buffer
@@ -726,7 +1224,7 @@ func getUserInfoFromIndieAuth(r *http.Request, user *structs.User, customClaims
 	// v := url.Values{}
 	// userinfo, err := client.PostForm(cfg.GenOAuth.UserInfoURL, v)
 
-	client := &http.Client{}
+	client := metrics.IdPClient()
 	userinfo, err := client.Do(req)
 
 	if err != nil {
@@ -741,7 +1239,7 @@ func getUserInfoFromIndieAuth(r *http.Request, user *structs.User, customClaims
 
 	data, _ := ioutil.ReadAll(userinfo.Body)
 	log.Infof("indieauth userinfo body: %s", string(data))
-	if err = mapClaims(data, customClaims); err != nil {
+	if err = mapClaims(r, data, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -772,6 +1270,7 @@ type adfsTokenRes struct {
 
 // More info: https://docs.microsoft.com/en-us/windows-server/identity/ad-fs/overview/ad-fs-scenarios-for-developers#supported-scenarios
 func getUserInfoFromADFS(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens) (rerr error) {
+	log := requestlog.Logger(r)
 	code := r.URL.Query().Get("code")
 	log.Debugf("code: %s", code)
 
@@ -792,7 +1291,7 @@ func getUserInfoFromADFS(r *http.Request, user *structs.User, customClaims *stru
 	req.Header.Add("Content-Length", strconv.Itoa(len(formData.Encode())))
 	req.Header.Set("Accept", "application/json")
 
-	client := &http.Client{}
+	client := metrics.IdPClient()
 	userinfo, err := client.Do(req)
 
 	if err != nil {
@@ -834,7 +1333,7 @@ func getUserInfoFromADFS(r *http.Request, user *structs.User, customClaims *stru
 	// data contains an access token, refresh token, and id token
 	// Please note that in order for custom claims to work you MUST set allatclaims in ADFS to be passed
 	// https://oktotechnologies.ca/2018/08/26/adfs-openidconnect-configuration/
-	if err = mapClaims([]byte(idToken), customClaims); err != nil {
+	if err = mapClaims(r, []byte(idToken), customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -854,10 +1353,87 @@ func getUserInfoFromADFS(r *http.Request, user *structs.User, customClaims *stru
 	return nil
 }
 
+// Azure AD / Entra ID
+// the user and their groups come from the id_token, if the user is in too many groups for them to fit
+// in the token (the "overage" case) the groups are fetched from the Graph API instead
+// https://docs.microsoft.com/en-us/azure/active-directory/develop/id-tokens#groups-overage-claim
+func getUserInfoFromAzure(r *http.Request, client *http.Client, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens) error {
+	log := requestlog.Logger(r)
+	idToken, err := jwtPayload(ptokens.PIdToken)
+	if err != nil {
+		return fmt.Errorf("azure: id_token missing or invalid, is the `openid` scope set? %s", err)
+	}
+	log.Debugf("idToken: %+v", string(idToken))
+
+	if err = mapClaims(r, idToken, customClaims); err != nil {
+		log.Error(err)
+		return err
+	}
+	azUser := structs.AzureUser{}
+	if err = json.Unmarshal(idToken, &azUser); err != nil {
+		log.Error(err)
+		return err
+	}
+	azUser.PrepareUserData()
+	user.Username = azUser.Username
+	user.Email = azUser.Email
+	user.Name = azUser.Name
+	log.Debugf("User Obj: %+v", user)
+
+	var wantGroups = false
+	for _, c := range cfg.Cfg.Headers.Claims {
+		if c == "groups" {
+			wantGroups = true
+		}
+	}
+	if !wantGroups {
+		return nil
+	}
+
+	var claims map[string]interface{}
+	if err = json.Unmarshal(idToken, &claims); err != nil {
+		return err
+	}
+	overage := azure.HasGroupOverage(claims)
+	if !overage && !cfg.GenOAuth.GroupNames {
+		// the groups in the id_token have already been placed in the customClaims
+		return nil
+	}
+
+	groups, err := azure.GroupsFromGraph(client, cfg.GenOAuth.GraphURL)
+	if err != nil {
+		if overage {
+			return fmt.Errorf("azure: user is in too many groups for the id_token and they could not be fetched from the Graph API: %s", err)
+		}
+		log.Errorf("azure: could not look up group names, passing group ids: %s", err)
+		return nil
+	}
+	ids := []string{}
+	if !overage {
+		if tokenGroups, ok := claims["groups"].([]interface{}); ok {
+			for _, g := range tokenGroups {
+				ids = append(ids, fmt.Sprint(g))
+			}
+		}
+	}
+	customClaims.Claims["groups"] = azure.GroupClaim(ids, groups, cfg.GenOAuth.GroupNames)
+	log.Debugf("azure groups claim: %+v", customClaims.Claims["groups"])
+	return nil
+}
+
+// jwtPayload returns the decoded (but unverified!) claims section of the jwt
+func jwtPayload(token string) ([]byte, error) {
+	s := strings.Split(token, ".")
+	if len(s) < 2 {
+		return nil, errors.New("jws: invalid token received")
+	}
+	return base64.RawURLEncoding.DecodeString(s[1])
+}
+
 // the standard error
 // this is captured by nginx, which converts the 401 into 302 to the login page
 func error401(w http.ResponseWriter, r *http.Request, ae AuthError) {
-	log.Error(ae.Error)
+	requestlog.Logger(r).Error(ae.Error)
 	cookie.ClearCookie(w, r)
 	// w.Header().Set("X-Vouch-Error", ae.Error)
 	http.Error(w, ae.Error, http.StatusUnauthorized)
@@ -885,7 +1461,8 @@ func ok200(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func mapClaims(claims []byte, customClaims *structs.CustomClaims) error {
+func mapClaims(r *http.Request, claims []byte, customClaims *structs.CustomClaims) error {
+	log := requestlog.Logger(r)
 	// Create a struct that contains the claims that we want to store from the config.
 	var f interface{}
 	err := json.Unmarshal(claims, &f)
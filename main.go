@@ -4,18 +4,37 @@ package main
 // github.com/vouch/vouch-proxy
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 
 	"github.com/vouch/vouch-proxy/handlers"
+	"github.com/vouch/vouch-proxy/pkg/activity"
+	"github.com/vouch/vouch-proxy/pkg/audit"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/device"
+	"github.com/vouch/vouch-proxy/pkg/extauthz"
+	"github.com/vouch/vouch-proxy/pkg/forwardauth"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/ratelimit"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+	"github.com/vouch/vouch-proxy/pkg/requestlog"
+	"github.com/vouch/vouch-proxy/pkg/saml"
+	"github.com/vouch/vouch-proxy/pkg/servicetoken"
+	"github.com/vouch/vouch-proxy/pkg/sessionstore"
 	"github.com/vouch/vouch-proxy/pkg/timelog"
+	"github.com/vouch/vouch-proxy/pkg/tracing"
 	tran "github.com/vouch/vouch-proxy/pkg/transciever"
 )
 
@@ -44,6 +63,47 @@ func (fw *fwdToZapWriter) Write(p []byte) (n int, err error) {
 }
 
 func main() {
+	if redis.Enabled() {
+		if err := redis.Connect(); err != nil {
+			logger.Fatal(err)
+		}
+		defer redis.Close()
+	}
+
+	db, err := model.Open()
+	if err != nil {
+		if cfg.ServiceTokenCmd.Requested() || cfg.SessionCmd.Requested() {
+			logger.Fatalf("%s, revoke from the running %s at %s or %s instead", err, cfg.Branding.CcName, servicetoken.RevokePath, sessionstore.RevokePath)
+		}
+		logger.Fatal(err)
+	}
+	defer db.Close()
+	handlers.SetStore(db)
+	servicetoken.SetStore(db)
+	sessionstore.SetStore(db)
+	device.SetStore(db)
+	audit.SetStore(db)
+	activity.SetStore(db)
+
+	if cfg.ServiceTokenCmd.Requested() {
+		if err := servicetoken.RunCmd(os.Stdout); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if cfg.SessionCmd.Requested() {
+		if err := sessionstore.RunCmd(os.Stdout); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if cfg.ActivityCmd.Requested() {
+		if err := activity.RunCmd(os.Stdout); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
 	var listen = cfg.Cfg.Listen + ":" + strconv.Itoa(cfg.Cfg.Port)
 	logger.Infow("starting "+cfg.Branding.CcName,
 		// "semver":    semver,
@@ -55,24 +115,100 @@ func main() {
 		"listen", listen,
 		"oauth.provider", cfg.GenOAuth.Provider)
 
+	if err := jwtmanager.ConfigureSigning(); err != nil {
+		logger.Fatal(err)
+	}
+	if cfg.Cfg.JWT.Rotate > 0 {
+		go jwtmanager.WatchKeyFile(time.Minute)
+	}
+
 	muxR := mux.NewRouter()
+	// an X-Request-Id and a logger for each request
+	muxR.Use(requestlog.Handler)
 
 	authH := http.HandlerFunc(handlers.ValidateRequestHandler)
 	muxR.HandleFunc("/validate", timelog.TimeLog(authH))
 	muxR.HandleFunc("/_external-auth-{id}", timelog.TimeLog(authH))
+	// /validate for Traefik and Caddy, which don't redirect to /login by themselves
+	muxR.HandleFunc(forwardauth.Path, timelog.TimeLog(forwardauth.Handler(authH)))
 
 	loginH := http.HandlerFunc(handlers.LoginHandler)
-	muxR.HandleFunc("/login", timelog.TimeLog(loginH))
+	muxR.HandleFunc("/login", timelog.TimeLog(ratelimit.LimitLogin(loginH)))
 
 	logoutH := http.HandlerFunc(handlers.LogoutHandler)
 	muxR.HandleFunc("/logout", timelog.TimeLog(logoutH))
 
 	callH := http.HandlerFunc(handlers.CallbackHandler)
-	muxR.HandleFunc("/auth", timelog.TimeLog(callH))
+	muxR.HandleFunc("/auth", timelog.TimeLog(ratelimit.LimitLogin(callH)))
+
+	deviceH := http.HandlerFunc(handlers.DeviceHandler)
+	muxR.HandleFunc(device.VerifyPath, timelog.TimeLog(deviceH))
+	deviceCodeH := http.HandlerFunc(device.CodeHandler)
+	muxR.HandleFunc(device.CodePath, timelog.TimeLog(ratelimit.LimitLogin(deviceCodeH)))
+	deviceTokenH := http.HandlerFunc(device.TokenHandler)
+	muxR.HandleFunc(device.TokenPath, timelog.TimeLog(ratelimit.LimitLogin(deviceTokenH)))
+
+	jwksH := http.HandlerFunc(jwtmanager.JWKSHandler)
+	muxR.HandleFunc(jwtmanager.JWKSPath, timelog.TimeLog(jwksH))
+
+	if ratelimit.Enabled() {
+		ratelimit.Configure()
+	}
+
+	if tracing.Enabled() {
+		if err := tracing.Start(); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	if err := audit.Start(); err != nil {
+		logger.Fatal(err)
+	}
+	if cfg.Cfg.Audit.Enabled {
+		auditH := http.HandlerFunc(handlers.AuditHandler)
+		muxR.HandleFunc(audit.Path, timelog.TimeLog(auditH))
+	}
+	// revocation while running, the command line can't open a bolt db which is in use
+	muxR.HandleFunc(servicetoken.RevokePath, timelog.TimeLog(handlers.AdminHandler(servicetoken.RevokeHandler)))
+	if sessionstore.Enabled() {
+		muxR.HandleFunc(sessionstore.RevokePath, timelog.TimeLog(handlers.AdminHandler(sessionstore.RevokeHandler)))
+	}
 
 	healthH := http.HandlerFunc(handlers.HealthcheckHandler)
 	muxR.HandleFunc("/healthcheck", timelog.TimeLog(healthH))
 
+	if metrics.Enabled() {
+		if cfg.Cfg.Metrics.Listen == "" {
+			muxR.Handle(cfg.Cfg.Metrics.Path, metrics.Handler())
+		} else {
+			// keep the metrics off of the listener which faces the public
+			metricsMux := http.NewServeMux()
+			metricsMux.Handle(cfg.Cfg.Metrics.Path, metrics.Handler())
+			go func() {
+				logger.Infof("serving metrics on %s%s", cfg.Cfg.Metrics.Listen, cfg.Cfg.Metrics.Path)
+				if err := http.ListenAndServe(cfg.Cfg.Metrics.Listen, metricsMux); err != nil {
+					logger.Fatal(err)
+				}
+			}()
+		}
+	}
+
+	if extauthz.Enabled() {
+		// the same checks as /forward-auth, logged and counted as requests to /ext_authz
+		extauthzH := requestlog.Handler(http.HandlerFunc(timelog.TimeLog(forwardauth.Handler(authH))))
+		if err := extauthz.Start(extauthzH); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	if cfg.GenOAuth.Provider == cfg.Providers.SAML {
+		if err := saml.Configure(); err != nil {
+			logger.Fatal(err)
+		}
+		samlMetadataH := http.HandlerFunc(saml.MetadataHandler)
+		muxR.HandleFunc(saml.MetadataPath, timelog.TimeLog(samlMetadataH))
+	}
+
 	// setup static
 	sPath, err := filepath.Abs(cfg.RootDir + staticDir)
 	if logger.Desugar().Core().Enabled(zap.DebugLevel) {
@@ -86,7 +222,7 @@ func main() {
 
 	if cfg.Cfg.WebApp {
 		logger.Info("enabling websocket")
-		tran.ExplicitInit()
+		tran.ExplicitInit(db)
 		muxR.Handle("/ws", tran.WS)
 	}
 
@@ -103,6 +239,37 @@ func main() {
 		ErrorLog:     log.New(&fwdToZapWriter{fastlog}, "", 0),
 	}
 
-	log.Fatal(srv.ListenAndServe())
+	activity.Start(cfg.Cfg.Activity.FlushInterval)
+	device.Start()
+	if sessionstore.Enabled() {
+		sessionstore.Start()
+	}
+
+	// shut down on SIGINT or SIGTERM, writing the activity counted since the last flush
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		logger.Info("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Error(err)
+		}
+		close(stopped)
+	}()
 
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	extauthz.Stop()
+	device.Stop()
+	sessionstore.Stop()
+	if err := activity.Stop(); err != nil {
+		logger.Error(err)
+	}
+	audit.Stop()
+	tracing.Stop()
 }
@@ -0,0 +1,167 @@
+package activity
+
+// Activity tracks who uses which site
+//
+// /validate only counts the request in memory, every `vouch.activity.flushInterval` the counts are added to the
+// db in a single write, and once more when vouch-proxy shuts down. At a few thousand requests a second the db then
+// still sees one write a minute instead of one per request
+//
+//   ./vouch-proxy -activity-list
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+type key struct {
+	username string
+	site     string
+}
+
+var (
+	mu      sync.Mutex
+	pending = make(map[key]*structs.Activity)
+
+	// the db, see SetStore
+	db   model.Store
+	stop chan struct{}
+	done chan struct{}
+
+	log = cfg.Cfg.Logger
+)
+
+// Record counts a request of username to site
+func Record(username, site string) {
+	now := time.Now().Unix()
+	k := key{username, site}
+	mu.Lock()
+	a, ok := pending[k]
+	if !ok {
+		a = &structs.Activity{Username: username, Site: site, FirstSeen: now}
+		pending[k] = a
+	}
+	a.Requests++
+	a.LastSeen = now
+	mu.Unlock()
+}
+
+// SetStore sets the db the counts are added to
+func SetStore(s model.Store) {
+	db = s
+}
+
+// Start flushing the counts to the db every interval
+func Start(interval time.Duration) {
+	stop = make(chan struct{})
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := Flush(); err != nil {
+					log.Error(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop flushing and write what has been counted since the last flush
+func Stop() error {
+	if stop != nil {
+		close(stop)
+		<-done
+		stop = nil
+	}
+	return Flush()
+}
+
+// Flush writes the counts to the db and keeps the sites in the db up to date
+func Flush() error {
+	mu.Lock()
+	batch := pending
+	pending = make(map[key]*structs.Activity)
+	mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	activity := make([]structs.Activity, 0, len(batch))
+	sites := make(map[string]bool)
+	for _, a := range batch {
+		activity = append(activity, *a)
+		sites[a.Site] = true
+	}
+	if err := db.AddActivity(activity); err != nil {
+		// counted again with the next flush rather than lost
+		requeue(batch)
+		return err
+	}
+	for site := range sites {
+		if err := db.PutSite(structs.Site{Domain: site}); err != nil {
+			log.Error(err)
+		}
+	}
+	log.Debugf("flushed the activity of %d users and sites", len(activity))
+	return nil
+}
+
+// requeue adds the counts of a batch which couldn't be written back to the ones counted since
+func requeue(batch map[key]*structs.Activity) {
+	mu.Lock()
+	defer mu.Unlock()
+	for k, b := range batch {
+		a, ok := pending[k]
+		if !ok {
+			pending[k] = b
+			continue
+		}
+		a.Requests += b.Requests
+		if b.FirstSeen < a.FirstSeen {
+			a.FirstSeen = b.FirstSeen
+		}
+		if b.LastSeen > a.LastSeen {
+			a.LastSeen = b.LastSeen
+		}
+	}
+}
+
+// RunCmd runs the -activity-* command given on the command line
+func RunCmd(w io.Writer) error {
+	if !cfg.ActivityCmd.List {
+		return nil
+	}
+	activity := []structs.Activity{}
+	if err := db.AllActivity(&activity); err != nil {
+		return err
+	}
+	sort.Slice(activity, func(i, j int) bool {
+		if activity[i].Username != activity[j].Username {
+			return activity[i].Username < activity[j].Username
+		}
+		return activity[i].Site < activity[j].Site
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tSITE\tREQUESTS\tFIRST SEEN\tLAST SEEN")
+	for _, a := range activity {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", a.Username, a.Site, a.Requests, date(a.FirstSeen), date(a.LastSeen))
+	}
+	return tw.Flush()
+}
+
+func date(unix int64) string {
+	return time.Unix(unix, 0).Format(time.RFC3339)
+}
@@ -0,0 +1,108 @@
+package activity
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func TestRecordFlush(t *testing.T) {
+	s := model.NewMemoryStore()
+	SetStore(s)
+
+	for i := 0; i < 3; i++ {
+		Record("alice", "app.example.com")
+	}
+	Record("bob", "app.example.com")
+	Record("alice", "wiki.example.com")
+
+	// nothing is written until the flush
+	all := []structs.Activity{}
+	assert.NoError(t, s.AllActivity(&all))
+	assert.Empty(t, all)
+
+	assert.NoError(t, Flush())
+	Record("alice", "app.example.com")
+	assert.NoError(t, Flush())
+
+	assert.NoError(t, s.AllActivity(&all))
+	counts := map[string]int64{}
+	for _, a := range all {
+		counts[a.Username+" "+a.Site] = a.Requests
+	}
+	assert.Equal(t, map[string]int64{
+		"alice app.example.com":  4,
+		"bob app.example.com":    1,
+		"alice wiki.example.com": 1,
+	}, counts)
+
+	// the sites are kept
+	sites := []structs.Site{}
+	assert.NoError(t, s.AllSites(&sites))
+	assert.Len(t, sites, 2)
+
+	cfg.ActivityCmd.List = true
+	defer func() { cfg.ActivityCmd.List = false }()
+	out := &bytes.Buffer{}
+	assert.NoError(t, RunCmd(out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if assert.Len(t, lines, 4) {
+		assert.Contains(t, lines[1], "alice")
+		assert.Contains(t, lines[1], "app.example.com")
+		assert.Contains(t, lines[3], "bob")
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	s := model.NewMemoryStore()
+	SetStore(s)
+	Start(time.Hour)
+	Record("carol", "app.example.com")
+
+	// Stop writes what hasn't been flushed yet
+	assert.NoError(t, Stop())
+	all := []structs.Activity{}
+	assert.NoError(t, s.AllActivity(&all))
+	if assert.Len(t, all, 1) {
+		assert.Equal(t, int64(1), all[0].Requests)
+	}
+}
+
+// down is a db which can't be written to
+type down struct {
+	model.Store
+}
+
+func (down) AddActivity(activity []structs.Activity) error {
+	return errors.New("db is down")
+}
+
+func TestFlushFails(t *testing.T) {
+	s := model.NewMemoryStore()
+	SetStore(down{s})
+	Record("alice", "app.example.com")
+	Record("alice", "app.example.com")
+	assert.Error(t, Flush())
+
+	// counted along with what comes after once the db is back
+	Record("alice", "app.example.com")
+	SetStore(s)
+	assert.NoError(t, Flush())
+	all := []structs.Activity{}
+	assert.NoError(t, s.AllActivity(&all))
+	if assert.Len(t, all, 1) {
+		assert.Equal(t, int64(3), all[0].Requests)
+	}
+}
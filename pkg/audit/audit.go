@@ -0,0 +1,229 @@
+package audit
+
+// Audit log of authentication events
+//
+// with `vouch.audit.enabled` logins, denied logins, logouts, revoked tokens and admin changes are kept in the db
+// for `vouch.audit.retention`. The users listed in `vouch.audit.admins` can query them
+//
+//   curl -b VouchCookie=... 'https://vouch.yourdomain.com/audit?user=alice@yourdomain.com&type=login_denied&since=2020-06-01T00:00:00Z'
+//
+// the events are also sent to the sinks configured in `vouch.audit.webhook`, `vouch.audit.syslog` and `vouch.audit.file`,
+// each from a goroutine of its own so that a slow sink doesn't hold up the requests. The db is written to the same way
+// once Start has been called, but its events are never dropped
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/clientip"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// the types of events
+const (
+	LoginStarted   = "login_started"
+	LoginSucceeded = "login"
+	LoginDenied    = "login_denied"
+	AccessDenied   = "access_denied" // a logged in user who may not reach the site
+	Logout         = "logout"
+	TokenRevoked   = "token_revoked"
+	AdminChange    = "admin_change"
+	RateLimited    = "rate_limited" // a client or user which ran out of tries
+)
+
+const (
+	// Path of the admin endpoint
+	Path = "/audit"
+
+	defaultLimit = 100
+	maxLimit     = 1000
+	purgeEvery   = time.Hour
+)
+
+var (
+	// the db, see SetStore
+	db   model.Store
+	stop chan struct{}
+
+	log = cfg.Cfg.Logger
+)
+
+// Enabled reports whether the events are kept in the db (`vouch.audit.enabled`) or sent to a sink
+func Enabled() bool {
+	return cfg.Cfg.Audit.Enabled || hasSinks()
+}
+
+// NewEvent of type typ for the request r
+func NewEvent(r *http.Request, typ string) structs.AuditEvent {
+	e := structs.AuditEvent{Type: typ}
+	if cfg.GenOAuth != nil {
+		e.Provider = cfg.GenOAuth.Provider
+	}
+	if r != nil {
+		e.ClientIP = clientip.Of(r)
+		e.RemoteAddr = r.RemoteAddr
+		// the chain of proxies in front of vouch-proxy, as claimed
+		e.ForwardedFor = strings.Join(r.Header.Values("X-Forwarded-For"), ", ")
+	}
+	return e
+}
+
+// HostOf the url requested by the user, for the Host of an event
+func HostOf(requestedURL string) string {
+	u, err := url.Parse(requestedURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// Log queues e for the audit log in the db and for the sinks
+// before Start, as for the commands run from the command line, e is written to the db right away
+func Log(e structs.AuditEvent) {
+	if !Enabled() {
+		return
+	}
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+	if cfg.Cfg.Audit.Enabled && !dbStarted() {
+		if err := db.PutAuditEvent(e); err != nil {
+			log.Errorf("couldn't write the %s event of %s to the db: %s", e.Type, e.Username, err)
+		}
+	}
+	dispatch(e)
+}
+
+// SetStore sets the db the events are kept in
+func SetStore(s model.Store) {
+	db = s
+}
+
+// Start the sinks, the db among them with `vouch.audit.enabled`, and purging the events older than
+// `vouch.audit.retention` from the db
+func Start() error {
+	ss, err := configuredSinks()
+	if err != nil {
+		return err
+	}
+	if cfg.Cfg.Audit.Enabled {
+		ss = append([]sink{dbSink{db}}, ss...)
+	}
+	startSinks(ss)
+	if !cfg.Cfg.Audit.Enabled || cfg.Cfg.Audit.Retention <= 0 {
+		return nil
+	}
+	stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(purgeEvery)
+		defer ticker.Stop()
+		for {
+			if err := Purge(time.Now()); err != nil {
+				log.Error(err)
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop purging, and write and send the events still queued for the db and the sinks
+func Stop() {
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+	stopSinks()
+}
+
+// Purge deletes the events which are older than the retention at now
+func Purge(now time.Time) error {
+	if cfg.Cfg.Audit.Retention <= 0 {
+		return nil
+	}
+	return db.PurgeAuditEvents(now.Add(-cfg.Cfg.Audit.Retention).Unix())
+}
+
+// IsAdmin reports whether username may query the audit log
+func IsAdmin(username string) bool {
+	for _, admin := range cfg.Cfg.Audit.Admins {
+		if username != "" && admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseQuery reads the user, type, since, until and limit parameters of the query string
+// since and until are RFC 3339 times or unix timestamps
+func ParseQuery(v url.Values) (model.AuditQuery, error) {
+	q := model.AuditQuery{
+		Username: v.Get("user"),
+		Type:     v.Get("type"),
+		Limit:    defaultLimit,
+	}
+	var err error
+	if q.Since, err = parseTime(v.Get("since")); err != nil {
+		return q, fmt.Errorf("since: %s", err)
+	}
+	if q.Until, err = parseTime(v.Get("until")); err != nil {
+		return q, fmt.Errorf("until: %s", err)
+	}
+	if l := v.Get("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("limit must be a positive number")
+		}
+		if q.Limit > maxLimit {
+			q.Limit = maxLimit
+		}
+	}
+	return q, nil
+}
+
+func parseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return unix, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+type response struct {
+	Events []structs.AuditEvent `json:"events"`
+}
+
+// QueryHandler responds with the events selected by the query string, the caller has to check IsAdmin first
+func QueryHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := ParseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := response{Events: []structs.AuditEvent{}}
+	if err := db.AuditEvents(q, &res.Events); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error(err)
+	}
+}
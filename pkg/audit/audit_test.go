@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+// setUp an audit log in the db, Stop writes the events queued for it
+func setUp(t *testing.T) model.Store {
+	cfg.Cfg.Audit.Enabled = true
+	s := model.NewMemoryStore()
+	SetStore(s)
+	assert.NoError(t, Start())
+	t.Cleanup(func() {
+		cfg.Cfg.Audit.Enabled = false
+		Stop()
+	})
+	return s
+}
+
+func TestLog(t *testing.T) {
+	s := setUp(t)
+
+	r := httptest.NewRequest("GET", "/login?url=https://app.example.com/", nil)
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	e := NewEvent(r, LoginStarted)
+	e.Host = HostOf(r.URL.Query().Get("url"))
+	Log(e)
+	Stop()
+
+	events := []structs.AuditEvent{}
+	assert.NoError(t, s.AuditEvents(model.AuditQuery{}, &events))
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, LoginStarted, events[0].Type)
+		// httptest's peer isn't a trusted proxy
+		assert.Equal(t, "192.0.2.1", events[0].ClientIP)
+		assert.Equal(t, "192.0.2.1:1234", events[0].RemoteAddr)
+		assert.Equal(t, "203.0.113.7", events[0].ForwardedFor)
+		assert.Equal(t, "app.example.com", events[0].Host)
+		assert.Equal(t, cfg.GenOAuth.Provider, events[0].Provider)
+		assert.NotZero(t, events[0].Time)
+	}
+
+	// nothing is kept unless enabled
+	cfg.Cfg.Audit.Enabled = false
+	assert.NoError(t, Start())
+	Log(NewEvent(r, Logout))
+	Stop()
+	events = events[:0]
+	assert.NoError(t, s.AuditEvents(model.AuditQuery{}, &events))
+	assert.Len(t, events, 1)
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := ParseQuery(url.Values{
+		"user":  {"alice"},
+		"type":  {LoginDenied},
+		"since": {"2020-06-01T00:00:00Z"},
+		"until": {"1600000000"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, model.AuditQuery{Username: "alice", Type: LoginDenied, Since: 1590969600, Until: 1600000000, Limit: defaultLimit}, q)
+
+	q, err = ParseQuery(url.Values{"limit": {"5000"}})
+	assert.NoError(t, err)
+	assert.Equal(t, maxLimit, q.Limit)
+
+	_, err = ParseQuery(url.Values{"since": {"yesterday"}})
+	assert.Error(t, err)
+	_, err = ParseQuery(url.Values{"limit": {"-1"}})
+	assert.Error(t, err)
+}
+
+func TestQueryHandler(t *testing.T) {
+	setUp(t)
+
+	Log(structs.AuditEvent{Type: LoginSucceeded, Username: "alice", Time: 100})
+	Log(structs.AuditEvent{Type: LoginDenied, Username: "bob", Reason: "not in domains", Time: 200})
+	Stop()
+
+	w := httptest.NewRecorder()
+	QueryHandler(w, httptest.NewRequest("GET", Path+"?user=bob", nil))
+	assert.Equal(t, 200, w.Code)
+	res := response{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	if assert.Len(t, res.Events, 1) {
+		assert.Equal(t, "not in domains", res.Events[0].Reason)
+	}
+
+	w = httptest.NewRecorder()
+	QueryHandler(w, httptest.NewRequest("GET", Path+"?since=nope", nil))
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestPurge(t *testing.T) {
+	s := setUp(t)
+	defer func(r time.Duration) { cfg.Cfg.Audit.Retention = r }(cfg.Cfg.Audit.Retention)
+	cfg.Cfg.Audit.Retention = time.Hour
+
+	now := time.Now()
+	Log(structs.AuditEvent{Type: LoginSucceeded, Time: now.Add(-2 * time.Hour).Unix()})
+	Log(structs.AuditEvent{Type: Logout, Time: now.Unix()})
+	Stop()
+	assert.NoError(t, Purge(now))
+
+	events := []structs.AuditEvent{}
+	assert.NoError(t, s.AuditEvents(model.AuditQuery{}, &events))
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, Logout, events[0].Type)
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	defer func() { cfg.Cfg.Audit.Admins = nil }()
+	cfg.Cfg.Audit.Admins = []string{"alice@example.com"}
+	assert.True(t, IsAdmin("alice@example.com"))
+	assert.False(t, IsAdmin("bob@example.com"))
+	assert.False(t, IsAdmin(""))
+}
+
+// the db waits for room rather than dropping events
+func TestDBQueueBlocks(t *testing.T) {
+	q := newQueue(dbSink{model.NewMemoryStore()})
+	for i := 0; i < 2*queueSize; i++ {
+		q.enqueue(structs.AuditEvent{Type: LoginSucceeded, Username: "alice", Time: int64(i + 1)})
+	}
+	q.stop()
+	events := []structs.AuditEvent{}
+	assert.NoError(t, q.s.(dbSink).s.AuditEvents(model.AuditQuery{Limit: 3 * queueSize}, &events))
+	assert.Len(t, events, 2*queueSize)
+}
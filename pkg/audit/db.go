@@ -0,0 +1,25 @@
+package audit
+
+import (
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// dbSink keeps the events in the db for /audit, off of the request like the other sinks
+// so that /validate doesn't wait for the db to deny access
+type dbSink struct {
+	s model.Store
+}
+
+func (dbSink) name() string {
+	return "log in the db"
+}
+
+func (d dbSink) send(e structs.AuditEvent) error {
+	return d.s.PutAuditEvent(e)
+}
+
+// close leaves the db open, main closes it
+func (dbSink) close() error {
+	return nil
+}
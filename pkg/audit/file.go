@@ -0,0 +1,89 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// fileSink appends a line of JSON per event
+// once the file would grow past maxSize it's renamed to path.1, path.1 to path.2 .. keeping maxBackups of them
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func newFile(path string, maxSize int64, maxBackups int) (*fileSink, error) {
+	s := &fileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) name() string {
+	return "file " + s.path
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open the audit file: %s", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = fi.Size()
+	return nil
+}
+
+func (s *fileSink) send(e structs.AuditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			if err := os.Rename(s.backup(i), s.backup(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(s.path, s.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) close() error {
+	return s.f.Close()
+}
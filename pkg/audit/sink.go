@@ -0,0 +1,153 @@
+package audit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// a sink delivers the events to a SIEM or some other system outside of vouch-proxy
+// send is only ever called from the sink's own goroutine
+type sink interface {
+	name() string
+	send(e structs.AuditEvent) error
+	close() error
+}
+
+const (
+	// the events waiting to be sent to each network sink, more are dropped rather than holding up the request
+	// the db is the durable record, a request waits for room in its queue instead
+	queueSize = 1000
+	// how long Stop waits for the queued events to be sent
+	drainTimeout = 5 * time.Second
+)
+
+var (
+	sinksMu sync.RWMutex
+	sinks   []*queue
+)
+
+// queue hands the events over to the sink's goroutine
+type queue struct {
+	s      sink
+	events chan structs.AuditEvent
+	done   chan struct{}
+	// durable the events are never dropped, see dbSink
+	durable bool
+}
+
+func newQueue(s sink) *queue {
+	_, durable := s.(dbSink)
+	q := &queue{
+		s:       s,
+		events:  make(chan structs.AuditEvent, queueSize),
+		done:    make(chan struct{}),
+		durable: durable,
+	}
+	go func() {
+		defer close(q.done)
+		for e := range q.events {
+			if err := q.s.send(e); err != nil {
+				log.Errorf("couldn't send the %s event of %s to the audit %s: %s", e.Type, e.Username, q.s.name(), err)
+			}
+		}
+	}()
+	return q
+}
+
+func (q *queue) enqueue(e structs.AuditEvent) {
+	if q.durable {
+		q.events <- e
+		return
+	}
+	select {
+	case q.events <- e:
+	default:
+		log.Warnf("the audit %s is falling behind, dropping the %s event of %s", q.s.name(), e.Type, e.Username)
+	}
+}
+
+// stop waits for the queued events to be sent and closes the sink
+func (q *queue) stop() {
+	close(q.events)
+	select {
+	case <-q.done:
+	case <-time.After(drainTimeout):
+		log.Warnf("gave up sending the remaining events to the audit %s", q.s.name())
+	}
+	if err := q.s.close(); err != nil {
+		log.Error(err)
+	}
+}
+
+// configuredSinks from `vouch.audit.webhook`, `vouch.audit.syslog` and `vouch.audit.file`
+func configuredSinks() ([]sink, error) {
+	c := cfg.Cfg.Audit
+	ss := []sink{}
+	if c.Webhook.URL != "" {
+		ss = append(ss, newWebhook(c.Webhook.URL, c.Webhook.Secret, c.Webhook.Retries, c.Webhook.Timeout))
+	}
+	if c.Syslog.Addr != "" {
+		s, err := newSyslog(c.Syslog.Network, c.Syslog.Addr, c.Syslog.Facility, c.Syslog.AppName)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+	if c.File.Path != "" {
+		s, err := newFile(c.File.Path, int64(c.File.MaxSize)*1024*1024, c.File.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
+func startSinks(ss []sink) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	for _, s := range ss {
+		log.Infof("sending audit events to the %s", s.name())
+		sinks = append(sinks, newQueue(s))
+	}
+}
+
+func stopSinks() {
+	sinksMu.Lock()
+	qs := sinks
+	sinks = nil
+	sinksMu.Unlock()
+	for _, q := range qs {
+		q.stop()
+	}
+}
+
+// dbStarted reports whether the events are written to the db by its queue, which Start sets up
+func dbStarted() bool {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+	for _, q := range sinks {
+		if q.durable {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSinks() bool {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+	return len(sinks) > 0
+}
+
+// dispatch e to every sink without waiting for it to be sent
+func dispatch(e structs.AuditEvent) {
+	sinksMu.RLock()
+	defer sinksMu.RUnlock()
+	for _, q := range sinks {
+		q.enqueue(e)
+	}
+}
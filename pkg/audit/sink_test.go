@@ -0,0 +1,225 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+var testEvent = structs.AuditEvent{
+	ID:       1,
+	Time:     1600000000,
+	Type:     LoginDenied,
+	Username: "alice",
+	Provider: "oidc",
+	ClientIP: "203.0.113.7",
+	Host:     "app.example.com",
+	Reason:   `not in "team]"`,
+}
+
+func TestWebhook(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	var calls int32
+	got := make(chan structs.AuditEvent, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first time around
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, Sign([]byte("s3cr3t"), body), r.Header.Get("X-Vouch-Signature"))
+		e := structs.AuditEvent{}
+		assert.NoError(t, json.Unmarshal(body, &e))
+		got <- e
+	}))
+	defer ts.Close()
+
+	w := newWebhook(ts.URL, "s3cr3t", 3, time.Second)
+	assert.NoError(t, w.send(testEvent))
+	assert.Equal(t, testEvent, <-got)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	var calls int32
+	status := http.StatusInternalServerError
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	w := newWebhook(ts.URL, "s3cr3t", 2, time.Second)
+	assert.Error(t, w.send(testEvent))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// a 4xx isn't retried
+	status = http.StatusUnauthorized
+	atomic.StoreInt32(&calls, 0)
+	assert.Error(t, w.send(testEvent))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '{}' | openssl dgst -sha256 -hmac key
+	assert.Equal(t, "sha256=a777724d943eb48dc69bca8a4a6d57a04db3f9ec7e1de4e581e860265bdf3032", Sign([]byte("key"), []byte("{}")))
+}
+
+func TestSyslogFormat(t *testing.T) {
+	s, err := newSyslog("udp", "127.0.0.1:514", "authpriv", "vouch-proxy")
+	assert.NoError(t, err)
+	s.hostname = "vouch1"
+	msg, err := s.format(testEvent)
+	assert.NoError(t, err)
+	// authpriv (10) * 8 + warning (4)
+	assert.True(t, strings.HasPrefix(string(msg), "<84>1 2020-09-13T12:26:40Z vouch1 vouch-proxy "), string(msg))
+	assert.Contains(t, string(msg), ` login_denied [vouch@32473 user="alice" provider="oidc" clientip="203.0.113.7" host="app.example.com" reason="not in \"team\]\""] {`)
+
+	_, err = newSyslog("udp", "127.0.0.1:514", "nope", "vouch-proxy")
+	assert.Error(t, err)
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer pc.Close()
+
+	s, err := newSyslog("udp", pc.LocalAddr().String(), "local0", "vouch-proxy")
+	assert.NoError(t, err)
+	defer s.close()
+	assert.NoError(t, s.send(testEvent))
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	assert.NoError(t, err)
+	// local0 (16) * 8 + warning (4)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "<132>1 "), string(buf[:n]))
+}
+
+func TestSyslogTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		// octet counting, the length and a space before each message
+		l, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(l))
+		if err != nil {
+			return
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err == nil {
+			lines <- string(buf)
+		}
+	}()
+
+	s, err := newSyslog("tcp", l.Addr().String(), "authpriv", "vouch-proxy")
+	assert.NoError(t, err)
+	defer s.close()
+	assert.NoError(t, s.send(testEvent))
+	select {
+	case line := <-lines:
+		assert.True(t, strings.HasPrefix(line, "<84>1 "), line)
+		assert.True(t, strings.HasSuffix(line, "}"), line)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message")
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	line, _ := json.Marshal(testEvent)
+	// room for two events per file
+	f, err := newFile(path, int64(2*(len(line)+1)), 2)
+	assert.NoError(t, err)
+	for i := 1; i <= 7; i++ {
+		e := testEvent
+		e.ID = i
+		assert.NoError(t, f.send(e))
+	}
+	assert.NoError(t, f.close())
+
+	ids := func(p string) []int {
+		b, err := ioutil.ReadFile(p)
+		assert.NoError(t, err)
+		ids := []int{}
+		for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			e := structs.AuditEvent{}
+			assert.NoError(t, json.Unmarshal([]byte(l), &e))
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []int{7}, ids(path))
+	assert.Equal(t, []int{5, 6}, ids(path+".1"))
+	assert.Equal(t, []int{3, 4}, ids(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// appends to what's there
+	f, err = newFile(path, 0, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, f.send(testEvent))
+	assert.NoError(t, f.close())
+	assert.Equal(t, []int{7, 1}, ids(path))
+}
+
+// slowSink takes its time, to show Log doesn't wait for it
+type slowSink struct {
+	got chan structs.AuditEvent
+}
+
+func (s slowSink) name() string { return "slow" }
+func (s slowSink) close() error { return nil }
+func (s slowSink) send(e structs.AuditEvent) error {
+	time.Sleep(100 * time.Millisecond)
+	s.got <- e
+	return nil
+}
+
+func TestLogSendsToSinks(t *testing.T) {
+	s := slowSink{got: make(chan structs.AuditEvent, 2)}
+	startSinks([]sink{s})
+	assert.True(t, Enabled())
+
+	start := time.Now()
+	Log(testEvent)
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+
+	// Stop sends what's queued
+	Stop()
+	assert.Equal(t, testEvent, <-s.got)
+	assert.False(t, Enabled())
+}
@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// the example private enterprise number of RFC 5612, for the SD-ID of the structured data
+const sdID = "vouch@32473"
+
+var facilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"authpriv": 10,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// the severities of RFC 5424
+const (
+	sevWarning = 4
+	sevNotice  = 5
+	sevInfo    = 6
+)
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogSink sends RFC 5424 messages over udp, or over tcp framed by octet counting (RFC 6587)
+// log/syslog only speaks the older BSD format
+type syslogSink struct {
+	network  string
+	addr     string
+	facility int
+	appName  string
+	hostname string
+	conn     net.Conn
+}
+
+func newSyslog(network, addr, facility, appName string) (*syslogSink, error) {
+	f, ok := facilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %s", facility)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &syslogSink{
+		network:  network,
+		addr:     addr,
+		facility: f,
+		appName:  appName,
+		hostname: hostname,
+	}, nil
+}
+
+func (s *syslogSink) name() string {
+	return "syslog " + s.network + "://" + s.addr
+}
+
+func severity(typ string) int {
+	switch typ {
+	case LoginDenied, AccessDenied, RateLimited:
+		return sevWarning
+	case TokenRevoked, AdminChange:
+		return sevNotice
+	}
+	return sevInfo
+}
+
+// format e as `<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [STRUCTURED-DATA] MSG` with the JSON of e as the MSG
+func (s *syslogSink) format(e structs.AuditEvent) ([]byte, error) {
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	var sd strings.Builder
+	sd.WriteString("[" + sdID)
+	for _, p := range [][2]string{
+		{"user", e.Username},
+		{"provider", e.Provider},
+		{"clientip", e.ClientIP},
+		{"remoteaddr", e.RemoteAddr},
+		{"forwardedfor", e.ForwardedFor},
+		{"host", e.Host},
+		{"reason", e.Reason},
+	} {
+		if p[1] != "" {
+			fmt.Fprintf(&sd, ` %s="%s"`, p[0], sdEscaper.Replace(p[1]))
+		}
+	}
+	sd.WriteString("]")
+
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		s.facility*8+severity(e.Type),
+		time.Unix(e.Time, 0).UTC().Format(time.RFC3339),
+		s.hostname, s.appName, os.Getpid(), e.Type, sd.String(), msg)), nil
+}
+
+func (s *syslogSink) send(e structs.AuditEvent) error {
+	msg, err := s.format(e)
+	if err != nil {
+		return err
+	}
+	if s.network == "tcp" {
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+	// the syslog server may have restarted since the last event, redial once
+	if err = s.write(msg); err != nil {
+		s.close()
+		err = s.write(msg)
+	}
+	return err
+}
+
+func (s *syslogSink) write(msg []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+func (s *syslogSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// the wait before the first retry, doubled for each retry after that
+var webhookBackoff = time.Second
+
+// webhook POSTs each event as JSON
+// the X-Vouch-Signature header holds `sha256=` and the hex HMAC-SHA256 of the body keyed with the secret
+type webhook struct {
+	url     string
+	secret  []byte
+	retries int
+	client  *http.Client
+}
+
+// permanentError isn't worth retrying
+type permanentError struct {
+	error
+}
+
+func newWebhook(url, secret string, retries int, timeout time.Duration) *webhook {
+	return &webhook{
+		url:     url,
+		secret:  []byte(secret),
+		retries: retries,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (w *webhook) name() string {
+	return "webhook " + w.url
+}
+
+// Sign returns the signature of body as sent in the X-Vouch-Signature header
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhook) send(e structs.AuditEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(permanentError); ok || attempt >= w.retries {
+			return err
+		}
+		log.Debugf("retrying the audit %s in %s: %s", w.name(), backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *webhook) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-"+cfg.Branding.CcName+"-Signature", Sign(w.secret, body))
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode < 300:
+		return nil
+	// the webhook won't take the event no matter how often it's sent
+	case res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests:
+		return permanentError{fmt.Errorf("%s responded %s", w.url, res.Status)}
+	}
+	return fmt.Errorf("%s responded %s", w.url, res.Status)
+}
+
+func (w *webhook) close() error {
+	return nil
+}
@@ -0,0 +1,122 @@
+package azure
+
+// Azure AD / Entra ID specific helpers
+// https://docs.microsoft.com/en-us/azure/active-directory/develop/id-tokens#groups-overage-claim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+const groupType = "#microsoft.graph.group"
+
+var log = cfg.Cfg.Logger
+
+// Group is a directory group as returned by the Graph transitiveMemberOf API
+type Group struct {
+	Type        string `json:"@odata.type"`
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+}
+
+type memberOfRes struct {
+	Value    []Group `json:"value"`
+	NextLink string  `json:"@odata.nextLink"`
+}
+
+// HasGroupOverage reports whether the id_token claims signal that the user is in too many groups
+// for them to be included in the token, in which case they must be fetched from the Graph API
+func HasGroupOverage(claims map[string]interface{}) bool {
+	if names, ok := claims["_claim_names"].(map[string]interface{}); ok {
+		if _, ok := names["groups"]; ok {
+			return true
+		}
+	}
+	// implicit flow sends hasgroups instead
+	if hasgroups, ok := claims["hasgroups"].(bool); ok && hasgroups {
+		return true
+	}
+	return false
+}
+
+// GroupsFromGraph walks the paged /me/transitiveMemberOf results and returns every group the user belongs to,
+// directly or through a group which is a member of another, as the groups claim of the token would have.
+// client must carry the user's access token for the Graph API.
+func GroupsFromGraph(client *http.Client, graphURL string) ([]Group, error) {
+	groups := []Group{}
+	base := strings.TrimSuffix(graphURL, "/")
+	next := base + "/me/transitiveMemberOf?$select=id,displayName"
+	for next != "" {
+		// the access token isn't handed to anyone but the Graph API
+		if !strings.HasPrefix(next, base+"/") {
+			return nil, fmt.Errorf("azure graph transitiveMemberOf returned a nextLink to elsewhere: %s", next)
+		}
+		page, err := getMemberOf(client, next)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range page.Value {
+			// transitiveMemberOf also returns directory roles and administrative units
+			if g.Type == "" || g.Type == groupType {
+				groups = append(groups, g)
+			}
+		}
+		next = page.NextLink
+	}
+	log.Debugf("azure groups from graph: %+v", groups)
+	return groups, nil
+}
+
+func getMemberOf(client *http.Client, u string) (res *memberOfRes, rerr error) {
+	log.Debugf("azure fetching %s", u)
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("azure graph transitiveMemberOf returned %d: %s", resp.StatusCode, string(data))
+	}
+	res = &memberOfRes{}
+	if err = json.Unmarshal(data, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GroupClaim builds the value of the `groups` claim.
+// If ids is empty all of the groups are used, otherwise only the groups listed in ids are.
+// If useNames is set the group object IDs are replaced by their display names where known.
+func GroupClaim(ids []string, groups []Group, useNames bool) []interface{} {
+	names := make(map[string]string, len(groups))
+	for _, g := range groups {
+		names[g.ID] = g.DisplayName
+	}
+	if len(ids) == 0 {
+		for _, g := range groups {
+			ids = append(ids, g.ID)
+		}
+	}
+	claim := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if name, ok := names[id]; ok && useNames && name != "" {
+			claim = append(claim, name)
+		} else {
+			claim = append(claim, id)
+		}
+	}
+	return claim
+}
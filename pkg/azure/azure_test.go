@@ -0,0 +1,80 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func TestHasGroupOverage(t *testing.T) {
+	var overage, plain, implicit map[string]interface{}
+	json.Unmarshal([]byte(`{"_claim_names": {"groups": "src1"}, "_claim_sources": {"src1": {"endpoint": "https://graph.windows.net/x/users/y/getMemberObjects"}}}`), &overage)
+	json.Unmarshal([]byte(`{"groups": ["a", "b"]}`), &plain)
+	json.Unmarshal([]byte(`{"hasgroups": true}`), &implicit)
+
+	assert.True(t, HasGroupOverage(overage))
+	assert.True(t, HasGroupOverage(implicit))
+	assert.False(t, HasGroupOverage(plain))
+}
+
+func TestGroupsFromGraph(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/me/transitiveMemberOf", r.URL.Path)
+		if r.URL.Query().Get("page") == "" {
+			fmt.Fprintf(w, `{"@odata.nextLink": "%s/me/transitiveMemberOf?page=2", "value": [
+				{"@odata.type": "#microsoft.graph.group", "id": "g1", "displayName": "Engineering"},
+				{"@odata.type": "#microsoft.graph.directoryRole", "id": "r1", "displayName": "Global Reader"}
+			]}`, srv.URL)
+			return
+		}
+		fmt.Fprint(w, `{"value": [{"@odata.type": "#microsoft.graph.group", "id": "g2", "displayName": "Ops"}]}`)
+	}))
+	defer srv.Close()
+
+	groups, err := GroupsFromGraph(srv.Client(), srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, []Group{
+		{groupType, "g1", "Engineering"},
+		{groupType, "g2", "Ops"},
+	}, groups)
+}
+
+func TestGroupsFromGraphNextLinkElsewhere(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"@odata.nextLink": "https://evil.example/me/transitiveMemberOf?page=2", "value": []}`)
+	}))
+	defer srv.Close()
+
+	_, err := GroupsFromGraph(srv.Client(), srv.URL)
+	assert.Error(t, err)
+}
+
+func TestGroupsFromGraphError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"code": "Authorization_RequestDenied"}}`, http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	_, err := GroupsFromGraph(srv.Client(), srv.URL)
+	assert.Error(t, err)
+}
+
+func TestGroupClaim(t *testing.T) {
+	groups := []Group{{groupType, "g1", "Engineering"}, {groupType, "g2", "Ops"}}
+
+	assert.Equal(t, []interface{}{"g1", "g2"}, GroupClaim(nil, groups, false))
+	assert.Equal(t, []interface{}{"Engineering", "Ops"}, GroupClaim(nil, groups, true))
+	// ids from the token which graph doesn't know about are kept as is
+	assert.Equal(t, []interface{}{"Ops", "g3"}, GroupClaim([]string{"g2", "g3"}, groups, true))
+}
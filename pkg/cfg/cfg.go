@@ -8,10 +8,12 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
@@ -34,12 +36,29 @@ type config struct {
 	Domains       []string `mapstructure:"domains"`
 	WhiteList     []string `mapstructure:"whitelist"`
 	AllowAllUsers bool     `mapstructure:"allowAllUsers"`
+	AllowRoles    []string `mapstructure:"allowRoles"`
 	PublicAccess  bool     `mapstructure:"publicAccess"`
 	JWT           struct {
 		MaxAge   int    `mapstructure:"maxAge"`
 		Issuer   string `mapstructure:"issuer"`
 		Secret   string `mapstructure:"secret"`
 		Compress bool   `mapstructure:"compress"`
+		// HS256 (default) signs with the Secret, RS256, ES256, EdDSA.. sign with the PrivateKey
+		SigningMethod string `mapstructure:"signingMethod"`
+		PrivateKey    string `mapstructure:"privateKey"`
+		KeyID         string `mapstructure:"kid"`
+		AcceptHS256   bool   `mapstructure:"acceptHS256"`
+		// a key ring to rotate through, the PrimaryKey signs and the other Keys are still accepted, see jwtkeys.go
+		Keys       []JWTKey      `mapstructure:"keys"`
+		PrimaryKey string        `mapstructure:"primaryKey"`
+		Rotate     time.Duration `mapstructure:"rotate"`
+		// encrypt the tokens (JWE) so that the provider tokens they carry can't be read from the cookie
+		Encrypt       bool   `mapstructure:"encrypt"`
+		EncryptionKey string `mapstructure:"encryptionKey"`
+		// IdPs whose JWT access tokens are accepted at /validate, see pkg/issuers
+		TrustedIssuers []TrustedIssuer `mapstructure:"trustedIssuers"`
+		// how many verified tokens /validate keeps, 0 verifies each token every time, see jwtmanager/cache.go
+		CacheSize int `mapstructure:"cacheSize"`
 	}
 	Cookie struct {
 		Name     string `mapstructure:"name"`
@@ -62,10 +81,96 @@ type config struct {
 	}
 	DB struct {
 		File string `mapstructure:"file"`
+		// bolt (the File), memory, redis, sqlite or postgres (the DSN)
+		Store string `mapstructure:"store"`
+		DSN   string `mapstructure:"dsn"`
+	}
+	Redis struct {
+		Addr     string `mapstructure:"addr"`
+		Password string `mapstructure:"password"`
+		DB       int    `mapstructure:"db"`
+		// every key starts with the Prefix, so that several Vouch Proxy deployments can share a redis
+		Prefix string `mapstructure:"prefix"`
+		TLS    bool   `mapstructure:"tls"`
+		CAFile string `mapstructure:"caFile"`
+	}
+	// logins, logouts, denials and admin changes are kept in the db and sent to the sinks, see pkg/audit
+	Audit struct {
+		Enabled bool `mapstructure:"enabled"`
+		// events older than the Retention are deleted, 0 keeps them forever
+		Retention time.Duration `mapstructure:"retention"`
+		// the users who may query /audit
+		Admins []string `mapstructure:"admins"`
+		// each event is POSTed to the URL, signed with the Secret
+		Webhook struct {
+			URL     string        `mapstructure:"url"`
+			Secret  string        `mapstructure:"secret"`
+			Retries int           `mapstructure:"retries"`
+			Timeout time.Duration `mapstructure:"timeout"`
+		}
+		// RFC 5424 syslog over udp or tcp
+		Syslog struct {
+			Addr     string `mapstructure:"addr"`
+			Network  string `mapstructure:"network"`
+			Facility string `mapstructure:"facility"`
+			AppName  string `mapstructure:"appName"`
+		}
+		// a line of JSON per event, rotated once the file reaches MaxSize megabytes
+		File struct {
+			Path       string `mapstructure:"path"`
+			MaxSize    int    `mapstructure:"maxSize"`
+			MaxBackups int    `mapstructure:"maxBackups"`
+		}
+	}
+	// Prometheus metrics, on a listener of their own when Listen is set, see pkg/metrics
+	Metrics struct {
+		Enabled bool   `mapstructure:"enabled"`
+		Listen  string `mapstructure:"listen"`
+		Path    string `mapstructure:"path"`
+	}
+	// OpenTelemetry spans exported over OTLP, see pkg/tracing
+	Tracing struct {
+		Enabled bool `mapstructure:"enabled"`
+		// host:port of the collector
+		Endpoint string `mapstructure:"endpoint"`
+		// grpc or http
+		Protocol string `mapstructure:"protocol"`
+		Insecure bool   `mapstructure:"insecure"`
+		// the share of the traces started by vouch-proxy which are kept
+		SampleRatio float64 `mapstructure:"sampleRatio"`
+	}
+	// token buckets which limit logins and failed bearer tokens, see pkg/ratelimit
+	RateLimit struct {
+		Enabled bool `mapstructure:"enabled"`
+		// requests to /login, /auth and the /device endpoints per client address
+		Login TokenBucket `mapstructure:"login"`
+		// failed logins per username, the user is locked out once they're used up
+		User TokenBucket `mapstructure:"user"`
+		// failed bearer tokens at /validate per client address
+		Bearer TokenBucket `mapstructure:"bearer"`
+		// the proxies, by CIDR or address, whose X-Forwarded-For is believed, see pkg/clientip
+		TrustedProxies []string `mapstructure:"trustedProxies"`
+	}
+	// /forward-auth for Traefik and Caddy, see pkg/forwardauth
+	ForwardAuth struct {
+		// where a browser which isn't logged in is sent, /login at the host of the callback_url by default
+		LoginURL string `mapstructure:"loginURL"`
+	}
+	// the Envoy ext_authz gRPC API, see pkg/extauthz
+	ExtAuthz struct {
+		Enabled bool   `mapstructure:"enabled"`
+		Listen  string `mapstructure:"listen"`
+	}
+	// per user and site request counts are kept in memory and written to the db every FlushInterval, see pkg/activity
+	Activity struct {
+		FlushInterval time.Duration `mapstructure:"flushInterval"`
 	}
 	Session struct {
 		Name string `mapstructure:"name"`
 		Key  string `mapstructure:"key"`
+		// keep the jwt server side, the cookie only holds a session id, see pkg/sessionstore
+		ServerSide bool   `mapstructure:"serverSide"`
+		Store      string `mapstructure:"store"`
 	}
 	TestURL  string   `mapstructure:"test_url"`
 	TestURLs []string `mapstructure:"test_urls"`
@@ -73,6 +178,20 @@ type config struct {
 	WebApp   bool     `mapstructure:"webapp"`
 }
 
+// TokenBucket holds up to Burst tokens and gains one Every so often
+type TokenBucket struct {
+	Every time.Duration `mapstructure:"every"`
+	Burst int           `mapstructure:"burst"`
+}
+
+// TrustedIssuer a third party which issues JWT access tokens, verified with the keys published at JWKSURL
+type TrustedIssuer struct {
+	Issuer        string `mapstructure:"issuer"`
+	JWKSURL       string `mapstructure:"jwksURL"`
+	Audience      string `mapstructure:"audience"`
+	UsernameClaim string `mapstructure:"usernameClaim"`
+}
+
 // oauth config items endoint for access
 type oauthConfig struct {
 	Provider        string   `mapstructure:"provider"`
@@ -85,6 +204,62 @@ type oauthConfig struct {
 	Scopes          []string `mapstructure:"scopes"`
 	UserInfoURL     string   `mapstructure:"user_info_url"`
 	PreferredDomain string   `mapstructre:"preferredDomain"`
+	// Azure AD / Entra ID
+	TenantID   string `mapstructure:"tenant_id"`
+	GraphURL   string `mapstructure:"graph_url"`
+	GroupNames bool   `mapstructure:"group_names"`
+	// Keycloak
+	KeycloakRoles  bool   `mapstructure:"keycloak_roles"`
+	KeycloakClient string `mapstructure:"keycloak_client"`
+	// SAML
+	SAMLIdPMetadataURL  string `mapstructure:"saml_idp_metadata_url"`
+	SAMLIdPMetadataFile string `mapstructure:"saml_idp_metadata_file"`
+	SAMLSPCert          string `mapstructure:"saml_sp_cert"`
+	SAMLSPKey           string `mapstructure:"saml_sp_key"`
+	// LDAP
+	LDAPURL      string `mapstructure:"ldap_url"`
+	LDAPStartTLS bool   `mapstructure:"ldap_starttls"`
+	// bind over plain ldap://, sending the passwords in the clear
+	LDAPInsecure bool   `mapstructure:"ldap_insecure"`
+	LDAPUserDN   string `mapstructure:"ldap_user_dn"`
+	LDAPCAFile   string `mapstructure:"ldap_ca_file"`
+	// RFC 7662 token introspection for bearer tokens which aren't Vouch Proxy JWTs
+	IntrospectionURL string `mapstructure:"introspection_url"`
+}
+
+// serviceTokenCmd holds the -servicetoken-* command line arguments
+type serviceTokenCmd struct {
+	Create  string
+	Scopes  string
+	Expires time.Duration
+	Revoke  string
+	List    bool
+}
+
+// Requested reports whether any service token command was given
+func (c serviceTokenCmd) Requested() bool {
+	return c.Create != "" || c.Revoke != "" || c.List
+}
+
+// sessionCmd holds the -sessions-* command line arguments
+type sessionCmd struct {
+	List   bool
+	Revoke string
+}
+
+// Requested reports whether any session command was given
+func (c sessionCmd) Requested() bool {
+	return c.List || c.Revoke != ""
+}
+
+// activityCmd holds the -activity-* command line arguments
+type activityCmd struct {
+	List bool
+}
+
+// Requested reports whether any activity command was given
+func (c activityCmd) Requested() bool {
+	return c.List
 }
 
 // OAuthProviders holds the stings for
@@ -96,6 +271,9 @@ type OAuthProviders struct {
 	OIDC          string
 	HomeAssistant string
 	OpenStax      string
+	Azure         string
+	SAML          string
+	LDAP          string
 }
 
 type branding struct {
@@ -133,19 +311,30 @@ var (
 		OIDC:          "oidc",
 		HomeAssistant: "homeassistant",
 		OpenStax:      "openstax",
+		Azure:         "azure",
+		SAML:          "saml",
+		LDAP:          "ldap",
 	}
 
 	// RequiredOptions must have these fields set for minimum viable config
 	RequiredOptions = []string{"oauth.provider", "oauth.client_id"}
 
+	// ServiceTokenCmd the service token command given on the command line, handled by main
+	ServiceTokenCmd serviceTokenCmd
+	// SessionCmd the server side session command given on the command line, handled by main
+	SessionCmd sessionCmd
+	// ActivityCmd the activity command given on the command line, handled by main
+	ActivityCmd activityCmd
+
 	// RootDir is where Vouch Proxy looks for ./config/config.yml, ./data, ./static and ./templates
 	RootDir string
 
-	secretFile    string
-	cmdLineConfig *string
-	logger        *zap.Logger
-	log           *zap.SugaredLogger
-	atom          zap.AtomicLevel
+	secretFile        string
+	encryptionKeyFile string
+	cmdLineConfig     *string
+	logger            *zap.Logger
+	log               *zap.SugaredLogger
+	atom              zap.AtomicLevel
 )
 
 const (
@@ -178,6 +367,15 @@ func init() {
 	port := flag.Int("port", -1, "port")
 	help := flag.Bool("help", false, "show usage")
 	cmdLineConfig = flag.String("config", "", "specify alternate .yml file as command line arg")
+	// service tokens for machine clients are managed from the command line, see pkg/servicetoken
+	flag.StringVar(&ServiceTokenCmd.Create, "servicetoken-create", "", "create a service token with the given name, print it and exit")
+	flag.StringVar(&ServiceTokenCmd.Scopes, "servicetoken-scopes", "", "comma separated list of hosts the new service token may reach")
+	flag.DurationVar(&ServiceTokenCmd.Expires, "servicetoken-expires", 0, "lifetime of the new service token such as 720h (default never expires)")
+	flag.StringVar(&ServiceTokenCmd.Revoke, "servicetoken-revoke", "", "revoke the service token with the given name and exit")
+	flag.BoolVar(&ServiceTokenCmd.List, "servicetoken-list", false, "list the service tokens and exit")
+	flag.BoolVar(&SessionCmd.List, "sessions-list", false, "list the server side sessions and exit")
+	flag.StringVar(&SessionCmd.Revoke, "sessions-revoke", "", "revoke all server side sessions of the given user and exit")
+	flag.BoolVar(&ActivityCmd.List, "activity-list", false, "list who has used which site and when, and exit")
 	flag.Parse()
 
 	// set RootDir from VOUCH_ROOT env var, or to the executable's directory
@@ -193,6 +391,7 @@ func init() {
 		log.Debugf("cfg.RootDir: %s", RootDir)
 	}
 	secretFile = filepath.Join(RootDir, "config/secret")
+	encryptionKeyFile = filepath.Join(RootDir, "config/encryption_key")
 
 	// bail if we're testing
 	if flag.Lookup("test.v") != nil {
@@ -354,15 +553,35 @@ func BasicTest() error {
 		GenOAuth.Provider != Providers.HomeAssistant &&
 		GenOAuth.Provider != Providers.ADFS &&
 		GenOAuth.Provider != Providers.OIDC &&
-		GenOAuth.Provider != Providers.OpenStax {
+		GenOAuth.Provider != Providers.OpenStax &&
+		GenOAuth.Provider != Providers.Azure &&
+		GenOAuth.Provider != Providers.SAML &&
+		GenOAuth.Provider != Providers.LDAP {
 		return errors.New("configuration error: Unkown oauth provider: " + GenOAuth.Provider)
 	}
 
 	for _, opt := range RequiredOptions {
+		if opt == "oauth.client_id" && GenOAuth.Provider == Providers.LDAP {
+			// there's no client when binding to a directory
+			continue
+		}
 		if !viper.IsSet(opt) {
 			return errors.New("configuration error: required configuration option " + opt + " is not set")
 		}
 	}
+	if err := checkJWTKeys(); err != nil {
+		return err
+	}
+	for _, ti := range Cfg.JWT.TrustedIssuers {
+		if ti.Issuer == "" || ti.JWKSURL == "" || ti.Audience == "" {
+			return errors.New("configuration error: each of " + Branding.LCName + ".jwt.trustedIssuers needs an issuer, jwksURL and audience")
+		}
+	}
+
+	if len(Cfg.AllowRoles) > 0 && !GenOAuth.KeycloakRoles {
+		return fmt.Errorf("configuration error: %s.allowRoles needs oauth.keycloak_roles: true for the users' roles", Branding.LCName)
+	}
+
 	// Domains is required _unless_ Cfg.AllowAllUsers is set
 	if !viper.IsSet(Branding.LCName+".allowAllUsers") && !viper.IsSet(Branding.LCName+".domains") {
 		return fmt.Errorf("configuration error: either one of %s or %s needs to be set (but not both)", Branding.LCName+".domains", Branding.LCName+".allowAllUsers")
@@ -370,9 +589,26 @@ func BasicTest() error {
 
 	// OAuthconfig Checks
 	switch {
+	case GenOAuth.Provider == Providers.LDAP && (GenOAuth.LDAPURL == "" || GenOAuth.LDAPUserDN == ""):
+		return errors.New("configuration error: oauth.ldap_url and oauth.ldap_user_dn must be set")
+	case GenOAuth.Provider == Providers.LDAP && !strings.Contains(GenOAuth.LDAPUserDN, "%s"):
+		return errors.New("configuration error: oauth.ldap_user_dn must contain %s where the username goes")
+	case GenOAuth.Provider == Providers.LDAP && strings.HasPrefix(strings.ToLower(GenOAuth.LDAPURL), "ldap://") &&
+		!GenOAuth.LDAPStartTLS && !GenOAuth.LDAPInsecure:
+		// the users' passwords would cross the network in the clear
+		return errors.New("configuration error: oauth.ldap_url is ldap:// without oauth.ldap_starttls, use ldaps:// or set oauth.ldap_starttls: true (or oauth.ldap_insecure: true to send the passwords in the clear)")
+	case GenOAuth.Provider == Providers.LDAP:
+		// none of the OAuth checks below apply
 	case GenOAuth.ClientID == "":
 		// everyone has a clientID
 		return errors.New("configuration error: oauth.client_id not found")
+	case GenOAuth.Provider == Providers.SAML && GenOAuth.SAMLIdPMetadataURL == "" && GenOAuth.SAMLIdPMetadataFile == "":
+		// SAML uses the client_id as the SP entityID and learns everything else about the IdP from its metadata
+		return errors.New("configuration error: one of oauth.saml_idp_metadata_url or oauth.saml_idp_metadata_file must be set")
+	case GenOAuth.Provider == Providers.SAML && (GenOAuth.SAMLSPCert == "" || GenOAuth.SAMLSPKey == ""):
+		return errors.New("configuration error: oauth.saml_sp_cert and oauth.saml_sp_key must be set")
+	case GenOAuth.Provider == Providers.SAML:
+		// none of the OAuth checks below apply
 	case GenOAuth.Provider != Providers.IndieAuth && GenOAuth.Provider != Providers.HomeAssistant && GenOAuth.Provider != Providers.ADFS && GenOAuth.Provider != Providers.OIDC && GenOAuth.ClientSecret == "":
 		// everyone except IndieAuth has a clientSecret
 		// ADFS and OIDC providers also do not require this, but can have it optionally set.
@@ -380,8 +616,8 @@ func BasicTest() error {
 	case GenOAuth.Provider != Providers.Google && GenOAuth.AuthURL == "":
 		// everyone except IndieAuth and Google has an authURL
 		return errors.New("configuration error: oauth.auth_url not found")
-	case GenOAuth.Provider != Providers.Google && GenOAuth.Provider != Providers.IndieAuth && GenOAuth.Provider != Providers.HomeAssistant && GenOAuth.Provider != Providers.ADFS && GenOAuth.UserInfoURL == "":
-		// everyone except IndieAuth, Google and ADFS has an userInfoURL
+	case GenOAuth.Provider != Providers.Google && GenOAuth.Provider != Providers.IndieAuth && GenOAuth.Provider != Providers.HomeAssistant && GenOAuth.Provider != Providers.ADFS && GenOAuth.Provider != Providers.Azure && GenOAuth.UserInfoURL == "":
+		// everyone except IndieAuth, Google, ADFS and Azure has an userInfoURL
 		return errors.New("configuration error: oauth.user_info_url not found")
 	}
 
@@ -402,13 +638,73 @@ func BasicTest() error {
 
 	// issue a warning if the secret is too small
 	log.Debugf("vouch.jwt.secret is %d characters long", len(Cfg.JWT.Secret))
-	if len(Cfg.JWT.Secret) < minBase64Length {
+	if len(Cfg.JWT.Keys) == 0 && len(Cfg.JWT.Secret) < minBase64Length {
 		log.Errorf("Your secret is too short! (%d characters long). Please consider deleting %s to automatically generate a secret of %d characters",
 			len(Cfg.JWT.Secret),
 			Branding.LCName+".jwt.secret",
 			minBase64Length)
 	}
 
+	if Cfg.JWT.Encrypt {
+		if Cfg.JWT.EncryptionKey == Cfg.JWT.Secret {
+			return fmt.Errorf("configuration error: %s.jwt.encryptionKey must not be the same as %s.jwt.secret", Branding.LCName, Branding.LCName)
+		}
+		if len(Cfg.JWT.EncryptionKey) < minBase64Length {
+			log.Errorf("Your jwt.encryptionKey is too short! (%d characters long). Please consider deleting %s to automatically generate a key of %d characters",
+				len(Cfg.JWT.EncryptionKey),
+				Branding.LCName+".jwt.encryptionKey",
+				minBase64Length)
+		}
+	}
+
+	switch Cfg.DB.Store {
+	case "bolt", "memory", "redis":
+	case "sqlite", "postgres":
+		if Cfg.DB.DSN == "" {
+			return fmt.Errorf("configuration error: %s.db.dsn must be set for %s.db.store %s", Branding.LCName, Branding.LCName, Cfg.DB.Store)
+		}
+	default:
+		return fmt.Errorf("configuration error: unknown %s.db.store %s", Branding.LCName, Cfg.DB.Store)
+	}
+	if Cfg.Audit.Syslog.Network != "udp" && Cfg.Audit.Syslog.Network != "tcp" {
+		return fmt.Errorf("configuration error: %s.audit.syslog.network must be udp or tcp", Branding.LCName)
+	}
+	if Cfg.Audit.Webhook.URL != "" && Cfg.Audit.Webhook.Secret == "" {
+		return fmt.Errorf("configuration error: %s.audit.webhook.secret must be set to sign the events sent to the webhook", Branding.LCName)
+	}
+	if Cfg.Tracing.Protocol != "grpc" && Cfg.Tracing.Protocol != "http" {
+		return fmt.Errorf("configuration error: %s.tracing.protocol must be grpc or http", Branding.LCName)
+	}
+	if Cfg.RateLimit.Enabled {
+		for name, b := range map[string]TokenBucket{"login": Cfg.RateLimit.Login, "user": Cfg.RateLimit.User, "bearer": Cfg.RateLimit.Bearer} {
+			if b.Every <= 0 || b.Burst <= 0 {
+				return fmt.Errorf("configuration error: %s.rateLimit.%s.every and burst must be more than 0", Branding.LCName, name)
+			}
+		}
+	}
+	for _, p := range Cfg.RateLimit.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			return fmt.Errorf("configuration error: %s.rateLimit.trustedProxies: %s is neither a CIDR nor an address", Branding.LCName, p)
+		}
+	}
+	if Cfg.ForwardAuth.LoginURL != "" {
+		if u, err := url.Parse(Cfg.ForwardAuth.LoginURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("configuration error: %s.forwardAuth.loginURL must be an absolute URL such as https://vouch.yourdomain.com/login", Branding.LCName)
+		}
+	}
+	if Cfg.Activity.FlushInterval <= 0 {
+		return fmt.Errorf("configuration error: %s.activity.flushInterval must be more than 0", Branding.LCName)
+	}
+	switch Cfg.Session.Store {
+	// bolt is what db used to be called
+	case "db", "bolt", "redis":
+	default:
+		return fmt.Errorf("configuration error: unknown %s.session.store %s", Branding.LCName, Cfg.Session.Store)
+	}
+	if (Cfg.DB.Store == "redis" || Cfg.Session.Store == "redis") && Cfg.Redis.Addr == "" {
+		return fmt.Errorf("configuration error: %s.redis.addr must be set to keep the db or the sessions in redis", Branding.LCName)
+	}
+
 	log.Debugf("vouch.session.key is %d characters long", len(Cfg.Session.Key))
 	if len(Cfg.Session.Key) < minBase64Length {
 		log.Errorf("Your session key is too short! (%d characters long). Please consider deleting %s to automatically generate a secret of %d characters",
@@ -477,7 +773,7 @@ func SetDefaults() {
 	}
 
 	// jwt defaults
-	if !viper.IsSet(Branding.LCName + ".jwt.secret") {
+	if !viper.IsSet(Branding.LCName+".jwt.secret") && !viper.IsSet(Branding.LCName+".jwt.keys") {
 		Cfg.JWT.Secret = getOrGenerateJWTSecret()
 	}
 	if !viper.IsSet(Branding.LCName + ".jwt.issuer") {
@@ -486,9 +782,25 @@ func SetDefaults() {
 	if !viper.IsSet(Branding.LCName + ".jwt.maxAge") {
 		Cfg.JWT.MaxAge = 240
 	}
+	if !viper.IsSet(Branding.LCName + ".jwt.cacheSize") {
+		Cfg.JWT.CacheSize = 10000
+	}
 	if !viper.IsSet(Branding.LCName + ".jwt.compress") {
 		Cfg.JWT.Compress = true
 	}
+	if !viper.IsSet(Branding.LCName + ".jwt.signingMethod") {
+		Cfg.JWT.SigningMethod = "HS256"
+	}
+	if !viper.IsSet(Branding.LCName + ".jwt.acceptHS256") {
+		// keep the tokens issued before switching to an asymmetric signingMethod valid
+		Cfg.JWT.AcceptHS256 = true
+	}
+	if Cfg.JWT.Encrypt && !viper.IsSet(Branding.LCName+".jwt.encryptionKey") {
+		Cfg.JWT.EncryptionKey = getOrGenerateJWTEncryptionKey()
+	}
+	if len(Cfg.JWT.Keys) > 0 && Cfg.JWT.PrimaryKey == "" {
+		Cfg.JWT.PrimaryKey = Cfg.JWT.Keys[0].ID
+	}
 
 	// cookie defaults
 	if !viper.IsSet(Branding.LCName + ".cookie.name") {
@@ -534,6 +846,73 @@ func SetDefaults() {
 	if !viper.IsSet(Branding.LCName + ".db.file") {
 		Cfg.DB.File = "data/" + Branding.LCName + "_bolt.db"
 	}
+	if !viper.IsSet(Branding.LCName + ".db.store") {
+		Cfg.DB.Store = "bolt"
+	}
+	if !viper.IsSet(Branding.LCName + ".audit.retention") {
+		Cfg.Audit.Retention = 90 * 24 * time.Hour
+	}
+	if !viper.IsSet(Branding.LCName + ".audit.webhook.retries") {
+		Cfg.Audit.Webhook.Retries = 3
+	}
+	if !viper.IsSet(Branding.LCName + ".audit.webhook.timeout") {
+		Cfg.Audit.Webhook.Timeout = 5 * time.Second
+	}
+	if !viper.IsSet(Branding.LCName + ".audit.syslog.network") {
+		Cfg.Audit.Syslog.Network = "udp"
+	}
+	if !viper.IsSet(Branding.LCName + ".audit.syslog.facility") {
+		Cfg.Audit.Syslog.Facility = "authpriv"
+	}
+	if !viper.IsSet(Branding.LCName + ".audit.syslog.appName") {
+		Cfg.Audit.Syslog.AppName = Branding.LCName + "-proxy"
+	}
+	if !viper.IsSet(Branding.LCName + ".audit.file.maxSize") {
+		Cfg.Audit.File.MaxSize = 100
+	}
+	if !viper.IsSet(Branding.LCName + ".audit.file.maxBackups") {
+		Cfg.Audit.File.MaxBackups = 5
+	}
+	if !viper.IsSet(Branding.LCName + ".metrics.path") {
+		Cfg.Metrics.Path = "/metrics"
+	}
+	if !viper.IsSet(Branding.LCName + ".tracing.endpoint") {
+		Cfg.Tracing.Endpoint = "localhost:4317"
+	}
+	if !viper.IsSet(Branding.LCName + ".tracing.protocol") {
+		Cfg.Tracing.Protocol = "grpc"
+	}
+	if !viper.IsSet(Branding.LCName + ".tracing.sampleRatio") {
+		Cfg.Tracing.SampleRatio = 1
+	}
+	if !viper.IsSet(Branding.LCName + ".rateLimit.login.every") {
+		Cfg.RateLimit.Login.Every = 3 * time.Second
+	}
+	if !viper.IsSet(Branding.LCName + ".rateLimit.login.burst") {
+		Cfg.RateLimit.Login.Burst = 20
+	}
+	if !viper.IsSet(Branding.LCName + ".rateLimit.user.every") {
+		Cfg.RateLimit.User.Every = 5 * time.Minute
+	}
+	if !viper.IsSet(Branding.LCName + ".rateLimit.user.burst") {
+		Cfg.RateLimit.User.Burst = 5
+	}
+	if !viper.IsSet(Branding.LCName + ".rateLimit.bearer.every") {
+		Cfg.RateLimit.Bearer.Every = time.Second
+	}
+	if !viper.IsSet(Branding.LCName + ".rateLimit.bearer.burst") {
+		Cfg.RateLimit.Bearer.Burst = 10
+	}
+	// plain gRPC, only reachable from the host unless it's widened to 0.0.0.0:9191 for the mesh
+	if !viper.IsSet(Branding.LCName + ".extAuthz.listen") {
+		Cfg.ExtAuthz.Listen = "127.0.0.1:9191"
+	}
+	if !viper.IsSet(Branding.LCName + ".activity.flushInterval") {
+		Cfg.Activity.FlushInterval = time.Minute
+	}
+	if !viper.IsSet(Branding.LCName + ".redis.prefix") {
+		Cfg.Redis.Prefix = Branding.LCName + ":"
+	}
 
 	// session
 	if !viper.IsSet(Branding.LCName + ".session.name") {
@@ -547,6 +926,9 @@ func SetDefaults() {
 		}
 		Cfg.Session.Key = rstr
 	}
+	if !viper.IsSet(Branding.LCName + ".session.store") {
+		Cfg.Session.Store = "db"
+	}
 
 	// testing convenience variable
 	if !viper.IsSet(Branding.LCName + ".testing") {
@@ -572,8 +954,23 @@ func SetDefaults() {
 		} else if GenOAuth.Provider == Providers.ADFS {
 			setDefaultsADFS()
 			configureOAuthClient()
+		} else if GenOAuth.Provider == Providers.Azure {
+			setDefaultsAzure()
+			configureOAuthClient()
+		} else if GenOAuth.Provider == Providers.SAML {
+			// there's no OAuthClient, see pkg/saml
+			log.Info("configuring SAML Service Provider")
+		} else if GenOAuth.Provider == Providers.LDAP {
+			// there's no OAuthClient, see pkg/ldap
+			log.Infof("configuring LDAP login against %s", GenOAuth.LDAPURL)
+			if GenOAuth.LDAPInsecure && !GenOAuth.LDAPStartTLS {
+				log.Warn("oauth.ldap_insecure is set, the passwords are sent to the directory in the clear")
+			}
 		} else {
 			// IndieAuth, OIDC, OpenStax
+			if GenOAuth.KeycloakRoles && GenOAuth.KeycloakClient == "" {
+				GenOAuth.KeycloakClient = GenOAuth.ClientID
+			}
 			configureOAuthClient()
 		}
 	}
@@ -604,6 +1001,29 @@ func setDefaultsADFS() {
 	OAuthopts = oauth2.SetAuthURLParam("resource", GenOAuth.RedirectURL) // Needed or all claims won't be included
 }
 
+func setDefaultsAzure() {
+	log.Info("configuring Azure AD OAuth")
+	// tenant can be a tenant id, a verified domain, `organizations` or `common`
+	tenant := GenOAuth.TenantID
+	if tenant == "" {
+		tenant = "organizations"
+	}
+	if GenOAuth.AuthURL == "" {
+		GenOAuth.AuthURL = "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0/authorize"
+	}
+	if GenOAuth.TokenURL == "" {
+		GenOAuth.TokenURL = "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0/token"
+	}
+	if GenOAuth.GraphURL == "" {
+		GenOAuth.GraphURL = "https://graph.microsoft.com/v1.0"
+	}
+	if len(GenOAuth.Scopes) == 0 {
+		// User.Read makes the access token usable against the Graph API
+		// reading group memberships for the overage case additionally requires GroupMember.Read.All
+		GenOAuth.Scopes = []string{"openid", "email", "profile", "User.Read"}
+	}
+}
+
 func setDefaultsGitHub() {
 	// log.Info("configuring GitHub OAuth")
 	if GenOAuth.AuthURL == "" {
@@ -636,15 +1056,39 @@ func configureOAuthClient() {
 	}
 }
 
+// getOrGenerateJWTSecret reads the secret from ./config/secret, generating it on first use
+// with jwt.rotate set the file holds a ring of generated keys instead, see RotateJWTKeys
 func getOrGenerateJWTSecret() string {
-	b, err := ioutil.ReadFile(secretFile)
+	if Cfg.JWT.Rotate > 0 {
+		if err := RotateJWTKeys(); err != nil {
+			log.Fatal(err)
+		}
+		// the secret from before rotation was turned on, for the tokens it signed without a kid
+		for _, k := range Cfg.JWT.Keys {
+			if k.ID == "" {
+				return k.Secret
+			}
+		}
+		return ""
+	}
+	return getOrGenerateSecret(secretFile, "jwt.secret")
+}
+
+// getOrGenerateJWTEncryptionKey reads the key tokens are encrypted with from ./config/encryption_key,
+// generating it on first use
+func getOrGenerateJWTEncryptionKey() string {
+	return getOrGenerateSecret(encryptionKeyFile, "jwt.encryptionKey")
+}
+
+func getOrGenerateSecret(file, name string) string {
+	b, err := ioutil.ReadFile(file)
 	if err == nil {
-		log.Info("jwt.secret read from " + secretFile)
+		log.Info(name + " read from " + file)
 	} else {
 		// then generate a new secret and store it in the file
 		log.Debug(err)
-		log.Info("jwt.secret not found in " + secretFile)
-		log.Warn("generating random jwt.secret and storing it in " + secretFile)
+		log.Info(name + " not found in " + file)
+		log.Warn("generating random " + name + " and storing it in " + file)
 
 		// make sure to create 256 bits for the secret
 		// see https://github.com/vouch/vouch-proxy/issues/54
@@ -653,7 +1097,7 @@ func getOrGenerateJWTSecret() string {
 			log.Fatal(err)
 		}
 		b = []byte(rstr)
-		err = ioutil.WriteFile(secretFile, b, 0600)
+		err = ioutil.WriteFile(file, b, 0600)
 		if err != nil {
 			log.Debug(err)
 		}
@@ -21,5 +21,40 @@ func TestConfigParsing(t *testing.T) {
 	assert.Equal(t, Cfg.Port, 9090)
 
 	assert.NotEmpty(t, Cfg.JWT.MaxAge)
+	// only reachable from the host unless widened
+	assert.Equal(t, "127.0.0.1:9191", Cfg.ExtAuthz.Listen)
 
 }
+
+func TestBasicTestLDAPInClear(t *testing.T) {
+	saved := *GenOAuth
+	defer func() { *GenOAuth = saved }()
+	GenOAuth.Provider = Providers.LDAP
+	GenOAuth.LDAPUserDN = "uid=%s,ou=people,dc=example,dc=com"
+
+	GenOAuth.LDAPURL = "ldap://ldap.example.com:389"
+	assert.Error(t, BasicTest())
+	GenOAuth.LDAPStartTLS = true
+	assert.NoError(t, BasicTest())
+
+	GenOAuth.LDAPStartTLS = false
+	GenOAuth.LDAPInsecure = true
+	assert.NoError(t, BasicTest())
+
+	GenOAuth.LDAPInsecure = false
+	GenOAuth.LDAPURL = "ldaps://ldap.example.com:636"
+	assert.NoError(t, BasicTest())
+}
+
+func TestBasicTestAllowRoles(t *testing.T) {
+	saved := *GenOAuth
+	defer func() {
+		*GenOAuth = saved
+		Cfg.AllowRoles = nil
+	}()
+	Cfg.AllowRoles = []string{"admin"}
+	GenOAuth.KeycloakRoles = false
+	assert.Error(t, BasicTest())
+	GenOAuth.KeycloakRoles = true
+	assert.NoError(t, BasicTest())
+}
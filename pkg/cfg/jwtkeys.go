@@ -0,0 +1,195 @@
+package cfg
+
+// the jwt key ring
+//
+// tokens carry the `kid` of the key which signed them. Only the primary key signs, the other keys are still
+// accepted, so a key is rotated by
+//   - adding the new key to vouch.jwt.keys on every instance
+//   - promoting it with vouch.jwt.primaryKey once they all know it
+//   - removing the old key once the tokens it signed have expired (jwt.maxAge)
+//
+// or, with vouch.jwt.rotate set, by letting Vouch Proxy generate the keys and keep them in ./config/secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	securerandom "github.com/theckman/go-securerandom"
+)
+
+// rotationLead how long a generated key waits before it signs, so that every instance sharing the key file
+// has read it by then
+const rotationLead = 5 * time.Minute
+
+// JWTKey one key of the ring, HS256 keys have a Secret, the asymmetric signing methods a PrivateKey
+type JWTKey struct {
+	ID            string `mapstructure:"kid" json:"kid"`
+	SigningMethod string `mapstructure:"signingMethod" json:"signingMethod,omitempty"`
+	Secret        string `mapstructure:"secret" json:"secret,omitempty"`
+	PrivateKey    string `mapstructure:"privateKey" json:"privateKey,omitempty"`
+	// CreatedOn is only kept for the keys in the rotating key file
+	CreatedOn int64 `mapstructure:"-" json:"createdOn,omitempty"`
+}
+
+// Method the key's signing method, HS256 for a secret and otherwise vouch.jwt.signingMethod
+func (k JWTKey) Method() string {
+	if k.SigningMethod != "" {
+		return k.SigningMethod
+	}
+	if k.PrivateKey == "" {
+		return "HS256"
+	}
+	return Cfg.JWT.SigningMethod
+}
+
+func checkSigningMethod(method, privateKey, setting string) error {
+	switch method {
+	case "HS256":
+	case "RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA":
+		if privateKey == "" {
+			return fmt.Errorf("configuration error: %s.privateKey must be set for signingMethod %s", setting, method)
+		}
+	default:
+		return fmt.Errorf("configuration error: unknown %s.signingMethod %s", setting, method)
+	}
+	return nil
+}
+
+func checkJWTKeys() error {
+	setting := Branding.LCName + ".jwt"
+	if !viper.IsSet(setting + ".keys") {
+		return checkSigningMethod(Cfg.JWT.SigningMethod, Cfg.JWT.PrivateKey, setting)
+	}
+	if Cfg.JWT.Rotate > 0 {
+		return fmt.Errorf("configuration error: set either %s.keys or %s.rotate (but not both)", setting, setting)
+	}
+
+	kids := make(map[string]bool)
+	for _, k := range Cfg.JWT.Keys {
+		if k.ID == "" || kids[k.ID] {
+			return fmt.Errorf("configuration error: each of %s.keys needs a kid of its own", setting)
+		}
+		kids[k.ID] = true
+		if err := checkSigningMethod(k.Method(), k.PrivateKey, setting+".keys."+k.ID); err != nil {
+			return err
+		}
+		if k.Method() == "HS256" && len(k.Secret) < minBase64Length {
+			log.Errorf("the secret of %s.keys.%s is too short! (%d characters long). Please use at least %d characters", setting, k.ID, len(k.Secret), minBase64Length)
+		}
+	}
+	if !kids[Cfg.JWT.PrimaryKey] {
+		return fmt.Errorf("configuration error: %s.primaryKey %s is not one of %s.keys", setting, Cfg.JWT.PrimaryKey, setting)
+	}
+	return nil
+}
+
+// RotateJWTKeys reads the rotating key file, generates the next key once the newest one is older than
+// vouch.jwt.rotate, retires the keys whose tokens have all expired and sets Cfg.JWT.Keys and Cfg.JWT.PrimaryKey
+func RotateJWTKeys() error {
+	return rotateJWTKeys(time.Now())
+}
+
+func rotateJWTKeys(now time.Time) error {
+	keys, err := readJWTKeyFile()
+	if err != nil {
+		return err
+	}
+	changed := false
+
+	// newest first
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedOn > keys[j].CreatedOn })
+	if len(keys) == 0 || now.Sub(time.Unix(keys[0].CreatedOn, 0)) >= Cfg.JWT.Rotate {
+		secret, err := securerandom.Base64OfBytes(base64Bytes)
+		if err != nil {
+			return err
+		}
+		k := JWTKey{
+			ID:            now.UTC().Format("20060102T150405Z"),
+			SigningMethod: "HS256",
+			Secret:        secret,
+			CreatedOn:     now.Unix(),
+		}
+		keys = append([]JWTKey{k}, keys...)
+		changed = true
+		log.Infof("generated jwt key %s in %s", k.ID, secretFile)
+	}
+
+	primary := primaryJWTKey(keys, now)
+	// a key stops signing once its successor takes over, the last tokens it signed expire jwt.maxAge later
+	maxAge := time.Duration(Cfg.JWT.MaxAge) * time.Minute
+	for i := primary + 1; i < len(keys); i++ {
+		takeover := time.Unix(keys[i-1].CreatedOn, 0).Add(rotationLead)
+		if now.Sub(takeover) > maxAge {
+			for _, k := range keys[i:] {
+				log.Infof("retired jwt key %s from %s", k.ID, secretFile)
+			}
+			keys = keys[:i]
+			changed = true
+			break
+		}
+	}
+
+	if changed {
+		if err := writeJWTKeyFile(keys); err != nil {
+			return err
+		}
+	}
+	Cfg.JWT.Keys = keys
+	Cfg.JWT.PrimaryKey = keys[primary].ID
+	return nil
+}
+
+// primaryJWTKey the newest key which every instance has had time to read, or the only one there is
+func primaryJWTKey(keys []JWTKey, now time.Time) int {
+	for i, k := range keys {
+		if now.Sub(time.Unix(k.CreatedOn, 0)) >= rotationLead {
+			return i
+		}
+	}
+	return len(keys) - 1
+}
+
+func readJWTKeyFile() ([]JWTKey, error) {
+	b, err := ioutil.ReadFile(secretFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := []JWTKey{}
+	if err = json.Unmarshal(b, &keys); err == nil {
+		return keys, nil
+	}
+
+	// the plain secret from before rotation was turned on, keep accepting the tokens it signed
+	fi, err := os.Stat(secretFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("keeping the jwt.secret from %s until its tokens have expired", secretFile)
+	return []JWTKey{{
+		SigningMethod: "HS256",
+		Secret:        strings.TrimSpace(string(b)),
+		CreatedOn:     fi.ModTime().Unix(),
+	}}, nil
+}
+
+// writeJWTKeyFile replaces the file in one go so that other instances never read half of it
+func writeJWTKeyFile(keys []JWTKey) error {
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := secretFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, secretFile)
+}
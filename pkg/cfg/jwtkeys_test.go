@@ -0,0 +1,68 @@
+package cfg
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateJWTKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vouch-jwtkeys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldSecretFile, oldKeys := secretFile, Cfg.JWT.Keys
+	defer func() {
+		secretFile = oldSecretFile
+		Cfg.JWT.Keys = oldKeys
+		Cfg.JWT.PrimaryKey = ""
+		Cfg.JWT.Rotate = 0
+	}()
+
+	secretFile = dir + "/secret"
+	Cfg.JWT.Rotate = 24 * time.Hour
+	maxAge := time.Duration(Cfg.JWT.MaxAge) * time.Minute
+
+	// the plain secret from before rotation
+	assert.NoError(t, ioutil.WriteFile(secretFile, []byte("the old secret\n"), 0600))
+	start := time.Now()
+	assert.NoError(t, os.Chtimes(secretFile, start.Add(-48*time.Hour), start.Add(-48*time.Hour)))
+
+	assert.NoError(t, rotateJWTKeys(start))
+	assert.Len(t, Cfg.JWT.Keys, 2)
+	assert.Equal(t, "the old secret", Cfg.JWT.Keys[1].Secret)
+	// the new key waits before it signs
+	assert.Equal(t, "", Cfg.JWT.PrimaryKey)
+	newKID := Cfg.JWT.Keys[0].ID
+
+	assert.NoError(t, rotateJWTKeys(start.Add(rotationLead)))
+	assert.Len(t, Cfg.JWT.Keys, 2)
+	assert.Equal(t, newKID, Cfg.JWT.PrimaryKey)
+
+	// the tokens signed with the old secret have expired
+	assert.NoError(t, rotateJWTKeys(start.Add(rotationLead+maxAge+time.Minute)))
+	assert.Len(t, Cfg.JWT.Keys, 1)
+	assert.Equal(t, newKID, Cfg.JWT.PrimaryKey)
+
+	// a day later the next key takes over
+	next := start.Add(24 * time.Hour)
+	assert.NoError(t, rotateJWTKeys(next))
+	assert.Len(t, Cfg.JWT.Keys, 2)
+	assert.Equal(t, newKID, Cfg.JWT.PrimaryKey)
+	assert.NoError(t, rotateJWTKeys(next.Add(rotationLead)))
+	assert.NotEqual(t, newKID, Cfg.JWT.PrimaryKey)
+	assert.Len(t, Cfg.JWT.Keys[0].Secret, minBase64Length)
+}
+
+func TestPrimaryJWTKey(t *testing.T) {
+	now := time.Now()
+	keys := []JWTKey{
+		{ID: "c", CreatedOn: now.Unix()},
+		{ID: "b", CreatedOn: now.Add(-time.Hour).Unix()},
+		{ID: "a", CreatedOn: now.Add(-2 * time.Hour).Unix()},
+	}
+	assert.Equal(t, 1, primaryJWTKey(keys, now))
+	assert.Equal(t, 0, primaryJWTKey(keys[:1], now))
+}
@@ -0,0 +1,92 @@
+package clientip
+
+// The address of the client making a request
+//
+// behind nginx the client is the last address of X-Forwarded-For, the one nginx added (`proxy_add_x_forwarded_for`).
+// Anybody can send an X-Forwarded-For header though, so it is only believed when the request came from one of the
+// proxies listed in `vouch.rateLimit.trustedProxies`. Otherwise the client is the peer of the connection.
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+var trusted []*net.IPNet
+
+func init() {
+	Refresh()
+}
+
+// Refresh reads `vouch.rateLimit.trustedProxies` again
+func Refresh() {
+	trusted = nil
+	for _, p := range cfg.Cfg.RateLimit.TrustedProxies {
+		if n, err := ParseProxy(p); err == nil {
+			trusted = append(trusted, n)
+		}
+	}
+}
+
+// ParseProxy reads a trusted proxy, a CIDR such as 10.0.0.0/8 or a single address
+func ParseProxy(p string) (*net.IPNet, error) {
+	if !strings.Contains(p, "/") {
+		if ip := net.ParseIP(p); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+		}
+	}
+	_, n, err := net.ParseCIDR(p)
+	return n, err
+}
+
+// Trusted reports whether ip is one of the trusted proxies
+func Trusted(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Peer the host of the RemoteAddr of r, the other end of the connection
+func Peer(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Of the request r
+// X-Forwarded-For is read from the right, past the trusted proxies, when the peer is one of them
+func Of(r *http.Request) string {
+	ip := Peer(r)
+	if !Trusted(ip) {
+		return ip
+	}
+	xff := r.Header.Values("X-Forwarded-For")
+	addrs := strings.Split(strings.Join(xff, ","), ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		a := strings.TrimSpace(addrs[i])
+		if a == "" {
+			continue
+		}
+		ip = a
+		if !Trusted(ip) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,69 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func setUp(t *testing.T, proxies ...string) {
+	cfg.Cfg.RateLimit.TrustedProxies = proxies
+	Refresh()
+	t.Cleanup(func() {
+		cfg.Cfg.RateLimit.TrustedProxies = nil
+		Refresh()
+	})
+}
+
+func TestOf(t *testing.T) {
+	setUp(t, "10.0.0.0/8", "192.0.2.1")
+
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, "192.0.2.1", Of(r))
+
+	// nginx added the client to what the client sent
+	r.Header.Set("X-Forwarded-For", "198.51.100.9, 203.0.113.7")
+	assert.Equal(t, "203.0.113.7", Of(r))
+
+	// a load balancer in front of nginx
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.1.2.3")
+	assert.Equal(t, "203.0.113.7", Of(r))
+
+	// nobody but the trusted proxies
+	r.Header.Set("X-Forwarded-For", "10.1.2.3")
+	assert.Equal(t, "10.1.2.3", Of(r))
+}
+
+func TestOfUntrusted(t *testing.T) {
+	setUp(t, "10.0.0.0/8")
+
+	// a client making up its address
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.RemoteAddr = "203.0.113.7:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.9")
+	assert.Equal(t, "203.0.113.7", Of(r))
+
+	// nothing is trusted by default
+	setUp(t)
+	r.RemoteAddr = "10.1.2.3:1234"
+	assert.Equal(t, "10.1.2.3", Of(r))
+}
+
+func TestParseProxy(t *testing.T) {
+	for _, p := range []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::1"} {
+		_, err := ParseProxy(p)
+		assert.NoError(t, err, p)
+	}
+	for _, p := range []string{"", "10.0.0.0/33", "nginx"} {
+		_, err := ParseProxy(p)
+		assert.Error(t, err, p)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	// "github.com/vouch/vouch-proxy/pkg/structs"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
 	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
 )
 
 const maxCookieSize = 4000
@@ -50,6 +51,7 @@ func setCookie(w http.ResponseWriter, r *http.Request, val string, maxAge int) {
 		// https://www.lifewire.com/cookie-limit-per-domain-3466809
 		log.Warnf("cookie size: %d.  cookie sizes over ~4093 bytes(depending on the browser and platform) have shown to cause issues or simply aren't supported.", cookieSize)
 		cookieParts := SplitCookie(val, maxCookieSize-emptyCookieSize)
+		metrics.Cookie(len(val), len(cookieParts))
 		for i, cookiePart := range cookieParts {
 			// Cookies are named 1of3, 2of3, 3of3
 			cookieName = fmt.Sprintf("%s_%dof%d", cfg.Cfg.Cookie.Name, i+1, len(cookieParts))
@@ -64,6 +66,7 @@ func setCookie(w http.ResponseWriter, r *http.Request, val string, maxAge int) {
 			})
 		}
 	} else {
+		metrics.Cookie(len(val), 1)
 		http.SetCookie(w, &http.Cookie{
 			Name:     cookieName,
 			Value:    val,
@@ -0,0 +1,325 @@
+package device
+
+// OAuth 2.0 Device Authorization Grant (RFC 8628) for CLIs
+// https://tools.ietf.org/html/rfc8628
+//
+// - the CLI POSTs to /device/code and shows the user the user_code and verification_uri
+// - the user opens /device in the browser, logs in through the usual /login -> /auth, and approves the code
+// - meanwhile the CLI polls /device/token with the device_code until it's handed a Vouch Proxy JWT,
+//   which it then sends as `Authorization: Bearer`
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+const (
+	// CodePath the device authorization endpoint
+	CodePath = "/device/code"
+	// TokenPath the endpoint the device polls
+	TokenPath = "/device/token"
+	// VerifyPath where the user approves the device in the browser
+	VerifyPath = "/device"
+
+	// GrantType of the device's token requests
+	GrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	expiresIn = 10 * time.Minute
+	// seconds between polls, and the penalty for polling too often
+	interval = 5
+
+	deviceCodeBytes = 32
+	// no vowels, so no words, and nothing that looks alike
+	userCodeChars  = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength = 8
+
+	// how often the expired device codes are deleted from the db
+	purgeEvery = time.Minute
+)
+
+var (
+	// ErrNotFound the user code is unknown or has expired
+	ErrNotFound = errors.New("device code not found or expired")
+
+	// the db, see SetStore
+	db model.Store
+
+	stop chan struct{}
+
+	log = cfg.Cfg.Logger
+)
+
+// SetStore sets the db the device codes are kept in
+func SetStore(s model.Store) {
+	db = s
+}
+
+// Start deleting the expired device codes from the db every minute
+func Start() {
+	stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(purgeEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := db.PurgeDeviceCodes(time.Now().Unix()); err != nil {
+					log.Error(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(stop)
+}
+
+// Stop purging
+func Stop() {
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+}
+
+type codeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func hash(deviceCode string) string {
+	sum := sha256.Sum256([]byte(deviceCode))
+	return hex.EncodeToString(sum[:])
+}
+
+// NormalizeUserCode accepts the user code however the user typed it
+func NormalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	userCode = strings.Replace(userCode, "-", "", -1)
+	return strings.Replace(userCode, " ", "", -1)
+}
+
+// FormatUserCode XXXX-XXXX for display
+func FormatUserCode(userCode string) string {
+	if len(userCode) != userCodeLength {
+		return userCode
+	}
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
+
+func newUserCode() (string, error) {
+	b := make([]byte, userCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// 256 is not a multiple of 20, the bias is negligible for a code that lives for ten minutes
+	for i := range b {
+		b[i] = userCodeChars[int(b[i])%len(userCodeChars)]
+	}
+	return string(b), nil
+}
+
+// verificationURI is built from the request, honoring the X-Forwarded-Proto set by the reverse proxy
+func verificationURI(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + VerifyPath
+}
+
+// CodeHandler /device/code
+// starts a device authorization
+func CodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	b := make([]byte, deviceCodeBytes)
+	if _, err := rand.Read(b); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deviceCode := base64.RawURLEncoding.EncodeToString(b)
+	userCode, err := newUserCode()
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dc := structs.DeviceCode{
+		Hash:      hash(deviceCode),
+		UserCode:  userCode,
+		Interval:  interval,
+		ExpiresOn: now.Add(expiresIn).Unix(),
+		CreatedOn: now.Unix(),
+	}
+	if err = db.PutDeviceCode(dc); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Debugf("device authorization started for user code %s", userCode)
+
+	uri := verificationURI(r)
+	writeJSON(w, http.StatusOK, codeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                FormatUserCode(userCode),
+		VerificationURI:         uri,
+		VerificationURIComplete: uri + "?user_code=" + userCode,
+		ExpiresIn:               int(expiresIn.Seconds()),
+		Interval:                interval,
+	})
+}
+
+// TokenHandler /device/token
+// the device polls here until the user has approved or denied it, or the code expires
+func TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.PostFormValue("grant_type") != GrantType {
+		writeJSON(w, http.StatusBadRequest, errorResponse{"unsupported_grant_type"})
+		return
+	}
+
+	key := []byte(hash(r.PostFormValue("device_code")))
+	dc := structs.DeviceCode{}
+	if err := db.DeviceCode(key, &dc); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{"invalid_grant"})
+		return
+	}
+
+	now := time.Now().Unix()
+	if now >= dc.ExpiresOn || dc.Denied || dc.Token != "" {
+		// the device code is done with, whichever poll takes it from the db answers the device
+		// so that the token is handed out exactly once
+		if err := db.TakeDeviceCode(key, &dc); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{"invalid_grant"})
+			return
+		}
+		switch {
+		case now >= dc.ExpiresOn:
+			writeJSON(w, http.StatusBadRequest, errorResponse{"expired_token"})
+		case dc.Denied:
+			writeJSON(w, http.StatusBadRequest, errorResponse{"access_denied"})
+		default:
+			log.Infof("device authorization for %s completed", dc.Username)
+			writeJSON(w, http.StatusOK, tokenResponse{
+				AccessToken: dc.Token,
+				TokenType:   "Bearer",
+				ExpiresIn:   cfg.Cfg.JWT.MaxAge * 60,
+			})
+		}
+		return
+	}
+
+	res := errorResponse{"authorization_pending"}
+	if err := db.UpdateDeviceCode(key, func(dc *structs.DeviceCode) error {
+		if now-dc.LastPoll < dc.Interval {
+			dc.Interval += interval
+			res = errorResponse{"slow_down"}
+		}
+		dc.LastPoll = now
+		return nil
+	}); err != nil {
+		if err != model.ErrNotFound {
+			log.Error(err)
+		}
+		writeJSON(w, http.StatusBadRequest, errorResponse{"invalid_grant"})
+		return
+	}
+	writeJSON(w, http.StatusBadRequest, res)
+}
+
+// Pending returns the unexpired device authorization for userCode which awaits the user's decision
+func Pending(userCode string) (structs.DeviceCode, error) {
+	dc := structs.DeviceCode{}
+	if err := db.DeviceCodeByUserCode(NormalizeUserCode(userCode), time.Now().Unix(), &dc); err != nil {
+		return dc, ErrNotFound
+	}
+	if dc.Denied || dc.Token != "" {
+		return dc, ErrNotFound
+	}
+	return dc, nil
+}
+
+// Approve hands token, a Vouch Proxy JWT for username, to the device which was given userCode
+func Approve(userCode, username, token string) error {
+	if err := decide(userCode, func(dc *structs.DeviceCode) {
+		dc.Username = username
+		dc.Token = token
+	}); err != nil {
+		return err
+	}
+	log.Infof("device authorization for user code %s approved by %s", NormalizeUserCode(userCode), username)
+	return nil
+}
+
+// Deny refuses the device which was given userCode
+func Deny(userCode string) error {
+	if err := decide(userCode, func(dc *structs.DeviceCode) {
+		dc.Denied = true
+	}); err != nil {
+		return err
+	}
+	log.Infof("device authorization for user code %s denied", NormalizeUserCode(userCode))
+	return nil
+}
+
+// decide applies the user's decision to the pending device authorization for userCode, unless it has
+// been decided or taken in the meantime
+func decide(userCode string, fn func(dc *structs.DeviceCode)) error {
+	dc, err := Pending(userCode)
+	if err != nil {
+		return err
+	}
+	err = db.UpdateDeviceCode([]byte(dc.Hash), func(dc *structs.DeviceCode) error {
+		if dc.Denied || dc.Token != "" || time.Now().Unix() >= dc.ExpiresOn {
+			return ErrNotFound
+		}
+		fn(dc)
+		return nil
+	})
+	if err == model.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,142 @@
+package device
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+	SetStore(model.NewMemoryStore())
+}
+
+func startFlow(t *testing.T) codeResponse {
+	r := httptest.NewRequest("POST", "http://vouch.example.com"+CodePath, nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	CodeHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	res := codeResponse{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, "https://vouch.example.com/device", res.VerificationURI)
+	assert.Regexp(t, "^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$", res.UserCode)
+	assert.Equal(t, 5, int(res.Interval))
+	return res
+}
+
+func poll(deviceCode string) (int, map[string]interface{}) {
+	form := url.Values{"grant_type": {GrantType}, "device_code": {deviceCode}}
+	r := httptest.NewRequest("POST", TokenPath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	TokenHandler(w, r)
+	res := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res
+}
+
+// rewind pretends the device waited before polling again
+func rewind(t *testing.T, deviceCode string) {
+	dc := structs.DeviceCode{}
+	assert.NoError(t, db.DeviceCode([]byte(hash(deviceCode)), &dc))
+	dc.LastPoll -= dc.Interval
+	assert.NoError(t, db.PutDeviceCode(dc))
+}
+
+func TestDeviceFlowApproved(t *testing.T) {
+	res := startFlow(t)
+
+	code, body := poll(res.DeviceCode)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "authorization_pending", body["error"])
+
+	// too soon
+	_, body = poll(res.DeviceCode)
+	assert.Equal(t, "slow_down", body["error"])
+
+	// the user types the code in lower case without the dash
+	userCode := strings.ToLower(strings.Replace(res.UserCode, "-", "", 1))
+	_, err := Pending(userCode)
+	assert.NoError(t, err)
+	assert.NoError(t, Approve(userCode, "alice", "the.vouch.jwt"))
+	// can't be approved twice
+	assert.Equal(t, ErrNotFound, Approve(userCode, "mallory", "another.vouch.jwt"))
+
+	code, body = poll(res.DeviceCode)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "the.vouch.jwt", body["access_token"])
+	assert.Equal(t, "Bearer", body["token_type"])
+
+	// handed out once
+	_, body = poll(res.DeviceCode)
+	assert.Equal(t, "invalid_grant", body["error"])
+}
+
+func TestDeviceFlowDenied(t *testing.T) {
+	res := startFlow(t)
+	assert.NoError(t, Deny(res.UserCode))
+	rewind(t, res.DeviceCode)
+	_, body := poll(res.DeviceCode)
+	assert.Equal(t, "access_denied", body["error"])
+}
+
+func TestDeviceFlowExpired(t *testing.T) {
+	res := startFlow(t)
+	dc := structs.DeviceCode{}
+	assert.NoError(t, db.DeviceCode([]byte(hash(res.DeviceCode)), &dc))
+	dc.ExpiresOn = dc.CreatedOn - 1
+	assert.NoError(t, db.PutDeviceCode(dc))
+
+	assert.Equal(t, ErrNotFound, Approve(res.UserCode, "alice", "the.vouch.jwt"))
+	_, body := poll(res.DeviceCode)
+	assert.Equal(t, "expired_token", body["error"])
+}
+
+func TestTokenHandlerBadRequests(t *testing.T) {
+	_, body := poll("no-such-device-code")
+	assert.Equal(t, "invalid_grant", body["error"])
+
+	r := httptest.NewRequest("POST", TokenPath, strings.NewReader("grant_type=password"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	TokenHandler(w, r)
+	assert.Contains(t, w.Body.String(), "unsupported_grant_type")
+}
+
+func TestDeviceFlowConcurrentPolls(t *testing.T) {
+	res := startFlow(t)
+	assert.NoError(t, Approve(res.UserCode, "alice", "the.vouch.jwt"))
+
+	// two copies of the CLI polling with the same device code get the token once between them
+	var wg sync.WaitGroup
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, _ := poll(res.DeviceCode)
+			codes <- code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	ok := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			ok++
+		}
+	}
+	assert.Equal(t, 1, ok)
+}
@@ -0,0 +1,199 @@
+package extauthz
+
+// Envoy external authorization
+//
+// with `vouch.extAuthz.enabled` Vouch Proxy serves the `envoy.service.auth.v3.Authorization` gRPC API at
+// `vouch.extAuthz.listen`, for Envoy's ext_authz filter and Istio's CUSTOM authorization policies
+//
+// each CheckRequest is turned into the request Traefik would send to /forward-auth, and answered by the same handler,
+// so the jwt is found, checked and its claims turned into headers just as at /validate. A 200 becomes an OkResponse
+// which adds the X-Vouch-User and claim headers to the request sent upstream, anything else a DeniedResponse which
+// hands the client the 302 to /login, or the 401, as it is
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// Path of the requests handed to the handler, as seen in the access log and the metrics
+const Path = "/ext_authz"
+
+var (
+	srv *grpc.Server
+
+	log = cfg.Cfg.Logger
+)
+
+// the headers of a response which aren't sent upstream along with the request
+var notUpstream = map[string]bool{
+	"Content-Type":           true,
+	"Content-Length":         true,
+	"X-Content-Type-Options": true,
+	"Set-Cookie":             true,
+}
+
+// Server answers Envoy's CheckRequests with the handler of /forward-auth, see forwardauth.Handler
+type Server struct {
+	handler http.Handler
+}
+
+// NewServer which hands the requests to handler
+func NewServer(handler http.Handler) *Server {
+	return &Server{handler: handler}
+}
+
+// Enabled reports whether `vouch.extAuthz.enabled` is set
+func Enabled() bool {
+	return cfg.Cfg.ExtAuthz.Enabled
+}
+
+// Start serving the Authorization API at `vouch.extAuthz.listen`
+func Start(handler http.Handler) error {
+	l, err := net.Listen("tcp", cfg.Cfg.ExtAuthz.Listen)
+	if err != nil {
+		return err
+	}
+	srv = grpc.NewServer()
+	authv3.RegisterAuthorizationServer(srv, NewServer(handler))
+	log.Infof("serving envoy ext_authz on %s", cfg.Cfg.ExtAuthz.Listen)
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			log.Error(err)
+		}
+	}()
+	return nil
+}
+
+// Stop the server once the Checks being made have been answered
+func Stop() {
+	if srv != nil {
+		srv.GracefulStop()
+	}
+}
+
+// Check the request Envoy is about to send upstream
+func (s *Server) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	r := httpRequest(ctx, req)
+	w := newRecorder()
+	s.handler.ServeHTTP(w, r)
+	return checkResponse(w), nil
+}
+
+// httpRequest the request /forward-auth would get from a proxy for the request Envoy is checking
+func httpRequest(ctx context.Context, req *authv3.CheckRequest) *http.Request {
+	a := req.GetAttributes().GetRequest().GetHttp()
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, Path, nil)
+	for k, v := range a.GetHeaders() {
+		// pseudo headers such as :authority
+		if len(k) > 0 && k[0] == ':' {
+			continue
+		}
+		// the client is the source of the request Envoy saw, whatever the client claims
+		if http.CanonicalHeaderKey(k) == "X-Forwarded-For" {
+			continue
+		}
+		r.Header.Set(k, v)
+	}
+	scheme := a.GetScheme()
+	if scheme == "" {
+		scheme = r.Header.Get("X-Forwarded-Proto")
+	}
+	r.Header.Set("X-Forwarded-Method", a.GetMethod())
+	r.Header.Set("X-Forwarded-Proto", scheme)
+	r.Header.Set("X-Forwarded-Host", a.GetHost())
+	r.Header.Set("X-Forwarded-Uri", a.GetPath())
+	if sa := req.GetAttributes().GetSource().GetAddress().GetSocketAddress(); sa != nil {
+		r.RemoteAddr = net.JoinHostPort(sa.GetAddress(), strconv.Itoa(int(sa.GetPortValue())))
+	}
+	return r
+}
+
+func checkResponse(w *recorder) *authv3.CheckResponse {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	if w.code >= 200 && w.code < 300 {
+		var headers []*corev3.HeaderValueOption
+		for k, vs := range w.header {
+			if notUpstream[k] {
+				continue
+			}
+			for _, v := range vs {
+				headers = append(headers, header(k, v, corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD))
+			}
+		}
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: &authv3.OkHttpResponse{Headers: headers},
+			},
+		}
+	}
+
+	var headers []*corev3.HeaderValueOption
+	for k, vs := range w.header {
+		for _, v := range vs {
+			// the cookie is cleared with more than one Set-Cookie
+			headers = append(headers, header(k, v, corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD))
+		}
+	}
+	code := codes.PermissionDenied
+	if w.code == http.StatusUnauthorized || w.code == http.StatusFound {
+		code = codes.Unauthenticated
+	}
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(code)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(w.code)},
+				Headers: headers,
+				Body:    w.body.String(),
+			},
+		},
+	}
+}
+
+func header(k, v string, action corev3.HeaderValueOption_HeaderAppendAction) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header:       &corev3.HeaderValue{Key: k, Value: v},
+		AppendAction: action,
+	}
+}
+
+// recorder keeps the response the handler makes
+type recorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newRecorder() *recorder {
+	return &recorder{header: make(http.Header)}
+}
+
+func (w *recorder) Header() http.Header {
+	return w.header
+}
+
+func (w *recorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
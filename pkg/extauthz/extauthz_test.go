@@ -0,0 +1,144 @@
+package extauthz
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/forwardauth"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+	domains.Refresh()
+}
+
+// validate answers as /validate would, alice is logged in
+var validate = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Cookie") != "VouchCookie=alice" {
+		http.SetCookie(w, &http.Cookie{Name: "VouchCookie", MaxAge: -1})
+		http.Error(w, "no jwt found in request", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Add("X-Vouch-User", "alice@yourdomain.com")
+	w.Header().Add("X-Vouch-Idp-Claims-Groups", `"admins","users"`)
+	w.Header().Add("X-Vouch-Host", r.Host)
+	w.WriteHeader(http.StatusOK)
+})
+
+// client of a Server serving the handler of /forward-auth
+func client(t *testing.T) authv3.AuthorizationClient {
+	l := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(s, NewServer(forwardauth.Handler(validate)))
+	go s.Serve(l)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.Stop()
+	})
+	return authv3.NewAuthorizationClient(conn)
+}
+
+func check(headers map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Source: &authv3.AttributeContext_Peer{
+				Address: &corev3.Address{Address: &corev3.Address_SocketAddress{
+					SocketAddress: &corev3.SocketAddress{Address: "203.0.113.7", PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: 52000}},
+				}},
+			},
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:  "GET",
+					Scheme:  "https",
+					Host:    "app.vouch.github.io",
+					Path:    "/reports?year=2020",
+					Headers: headers,
+				},
+			},
+		},
+	}
+}
+
+func headers(hs []*corev3.HeaderValueOption) map[string]string {
+	m := make(map[string]string)
+	for _, h := range hs {
+		m[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+	}
+	return m
+}
+
+func TestCheckOk(t *testing.T) {
+	res, err := client(t).Check(context.Background(), check(map[string]string{
+		":authority": "app.vouch.github.io",
+		"cookie":     "VouchCookie=alice",
+		"accept":     "text/html",
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int32(codes.OK), res.GetStatus().GetCode())
+	hs := headers(res.GetOkResponse().GetHeaders())
+	assert.Equal(t, "alice@yourdomain.com", hs["X-Vouch-User"])
+	assert.Equal(t, `"admins","users"`, hs["X-Vouch-Idp-Claims-Groups"])
+	// checked for the host Envoy is sending the request to
+	assert.Equal(t, "app.vouch.github.io", hs["X-Vouch-Host"])
+}
+
+func TestCheckDenied(t *testing.T) {
+	c := client(t)
+
+	// a browser is sent to log in
+	res, err := c.Check(context.Background(), check(map[string]string{"accept": "text/html"}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int32(codes.Unauthenticated), res.GetStatus().GetCode())
+	denied := res.GetDeniedResponse()
+	assert.EqualValues(t, http.StatusFound, denied.GetStatus().GetCode())
+	hs := headers(denied.GetHeaders())
+	assert.Equal(t, "http://vouch.github.io:9090/login?url=https%3A%2F%2Fapp.vouch.github.io%2Freports%3Fyear%3D2020", hs["Location"])
+	assert.Contains(t, hs["Set-Cookie"], "VouchCookie=")
+
+	// an API client gets the 401
+	res, err = c.Check(context.Background(), check(map[string]string{"accept": "application/json"}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	denied = res.GetDeniedResponse()
+	assert.EqualValues(t, http.StatusUnauthorized, denied.GetStatus().GetCode())
+	assert.Equal(t, "no jwt found in request\n", denied.GetBody())
+}
+
+func TestHTTPRequest(t *testing.T) {
+	r := httpRequest(context.Background(), check(map[string]string{
+		":authority":      "app.vouch.github.io",
+		"authorization":   "Bearer abc",
+		"x-forwarded-for": "198.51.100.9",
+	}))
+	assert.Equal(t, "Bearer abc", r.Header.Get("Authorization"))
+	assert.Equal(t, "app.vouch.github.io", r.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "/reports?year=2020", r.Header.Get("X-Forwarded-Uri"))
+	assert.Equal(t, "https", r.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "GET", r.Header.Get("X-Forwarded-Method"))
+	assert.Equal(t, "203.0.113.7:52000", r.RemoteAddr)
+	assert.Empty(t, r.Header.Get("X-Forwarded-For"))
+	assert.Empty(t, r.Header.Get(":authority"))
+}
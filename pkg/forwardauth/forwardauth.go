@@ -0,0 +1,138 @@
+package forwardauth
+
+// Forward auth for Traefik and Caddy
+//
+// nginx turns the 401 of /validate into a redirect to /login with `error_page 401`, Traefik's ForwardAuth and Caddy's
+// forward_auth hand the response of the auth server to the client as it is. /forward-auth answers as /validate does,
+// for the host of the X-Forwarded-Host header, but sends a browser which isn't logged in to
+// /login?url=<the original URL>, rebuilt from the X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Uri headers.
+// API clients still get the 401.
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/requestlog"
+)
+
+// Path of the forward auth endpoint
+const Path = "/forward-auth"
+
+var (
+	// ErrNoHost the proxy didn't send X-Forwarded-Host
+	ErrNoHost = errors.New("forward auth: no X-Forwarded-Host header")
+	// ErrUnknownHost X-Forwarded-Host is not one of `vouch.domains`
+	ErrUnknownHost = errors.New("forward auth: X-Forwarded-Host is not in any of the domains")
+)
+
+// OriginalURL the URL the client asked the proxy for
+func OriginalURL(r *http.Request) (*url.URL, error) {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return nil, ErrNoHost
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto != "http" {
+		proto = "https"
+	}
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	u, err := url.Parse(proto + "://" + host + uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host != host {
+		return nil, ErrUnknownHost
+	}
+	if len(cfg.Cfg.Domains) > 0 && domains.Matches(u.Hostname()) == "" {
+		return nil, ErrUnknownHost
+	}
+	return u, nil
+}
+
+// IsBrowser reports whether the request was made by a browser navigating to a page, which can be sent to log in
+func IsBrowser(r *http.Request) bool {
+	switch r.Header.Get("X-Forwarded-Method") {
+	case "", http.MethodGet, http.MethodHead:
+	default:
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// LoginURL the /login of Vouch Proxy which brings the user back to original
+// `vouch.forwardAuth.loginURL`, or else /login at the host of the callback_url for the domain of original
+func LoginURL(original *url.URL) string {
+	login := cfg.Cfg.ForwardAuth.LoginURL
+	if login == "" {
+		callback := cfg.GenOAuth.RedirectURL
+		domain := domains.Matches(original.Hostname())
+		for _, v := range cfg.GenOAuth.RedirectURLs {
+			if domain != "" && strings.Contains(v, domain) {
+				callback = v
+				break
+			}
+		}
+		if u, err := url.Parse(callback); err == nil {
+			login = u.Scheme + "://" + u.Host + "/login"
+		}
+	}
+	return login + "?url=" + url.QueryEscape(original.String())
+}
+
+// Handler hands the request to validate, /validate, as if it had been made for the original host
+// and turns the 401 of a browser into a redirect to LoginURL
+func Handler(validate http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		original, err := OriginalURL(r)
+		if err != nil {
+			requestlog.Logger(r).Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Host = original.Host
+		if !IsBrowser(r) {
+			validate.ServeHTTP(w, r)
+			return
+		}
+		validate.ServeHTTP(&redirectWriter{ResponseWriter: w, login: LoginURL(original)}, r)
+	})
+}
+
+// redirectWriter turns a 401 into a 302 to login
+type redirectWriter struct {
+	http.ResponseWriter
+	login      string
+	redirected bool
+}
+
+func (rw *redirectWriter) WriteHeader(code int) {
+	if code != http.StatusUnauthorized {
+		rw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	rw.redirected = true
+	h := rw.Header()
+	h.Del("Content-Type")
+	h.Del("X-Content-Type-Options")
+	h.Set("Location", rw.login)
+	rw.ResponseWriter.WriteHeader(http.StatusFound)
+}
+
+// Write drops the body of the 401
+func (rw *redirectWriter) Write(b []byte) (int, error) {
+	if rw.redirected {
+		return len(b), nil
+	}
+	return rw.ResponseWriter.Write(b)
+}
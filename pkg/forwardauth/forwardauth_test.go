@@ -0,0 +1,112 @@
+package forwardauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+	domains.Refresh()
+}
+
+// forwarded as Traefik does
+func forwarded(uri, accept string) *http.Request {
+	r := httptest.NewRequest("GET", Path, nil)
+	r.Header.Set("X-Forwarded-Method", "GET")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "app.vouch.github.io")
+	r.Header.Set("X-Forwarded-Uri", uri)
+	r.Header.Set("Accept", accept)
+	return r
+}
+
+// validate answers as /validate would when the user isn't logged in
+var validate = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Cookie") == "" {
+		http.Error(w, "no jwt found in request", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("X-Vouch-User", "alice@yourdomain.com")
+	w.Write([]byte(r.Host))
+})
+
+func TestOriginalURL(t *testing.T) {
+	u, err := OriginalURL(forwarded("/reports?year=2020", "text/html"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "https://app.vouch.github.io/reports?year=2020", u.String())
+
+	r := forwarded("/", "text/html")
+	r.Header.Set("X-Forwarded-Host", "evil.example")
+	_, err = OriginalURL(r)
+	assert.Equal(t, ErrUnknownHost, err)
+
+	r.Header.Set("X-Forwarded-Host", "evil.example/app.vouch.github.io")
+	_, err = OriginalURL(r)
+	assert.Equal(t, ErrUnknownHost, err)
+
+	r.Header.Del("X-Forwarded-Host")
+	_, err = OriginalURL(r)
+	assert.Equal(t, ErrNoHost, err)
+}
+
+func TestIsBrowser(t *testing.T) {
+	assert.True(t, IsBrowser(forwarded("/", "text/html,application/xhtml+xml,*/*;q=0.8")))
+	assert.False(t, IsBrowser(forwarded("/", "application/json")))
+
+	r := forwarded("/", "text/html")
+	r.Header.Set("X-Forwarded-Method", "POST")
+	assert.False(t, IsBrowser(r))
+
+	r = forwarded("/", "text/html")
+	r.Header.Set("Authorization", "Bearer abc")
+	assert.False(t, IsBrowser(r))
+}
+
+func TestLoginURL(t *testing.T) {
+	u, _ := OriginalURL(forwarded("/reports?year=2020", "text/html"))
+	assert.Equal(t, "http://vouch.github.io:9090/login?url=https%3A%2F%2Fapp.vouch.github.io%2Freports%3Fyear%3D2020", LoginURL(u))
+
+	cfg.Cfg.ForwardAuth.LoginURL = "https://login.vouch.github.io/login"
+	defer func() { cfg.Cfg.ForwardAuth.LoginURL = "" }()
+	assert.Equal(t, "https://login.vouch.github.io/login?url=https%3A%2F%2Fapp.vouch.github.io%2Freports%3Fyear%3D2020", LoginURL(u))
+}
+
+func TestHandler(t *testing.T) {
+	h := Handler(validate)
+
+	// a browser is sent to log in
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, forwarded("/reports", "text/html"))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "http://vouch.github.io:9090/login?url=https%3A%2F%2Fapp.vouch.github.io%2Freports", w.Header().Get("Location"))
+	assert.Empty(t, w.Body.String())
+
+	// an API client gets the 401
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, forwarded("/api/reports", "application/json"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// a user who is logged in is validated for the original host
+	w = httptest.NewRecorder()
+	r := forwarded("/reports", "text/html")
+	r.Header.Set("Cookie", "VouchCookie=abc")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "app.vouch.github.io", w.Body.String())
+	assert.Equal(t, "alice@yourdomain.com", w.Header().Get("X-Vouch-User"))
+
+	w = httptest.NewRecorder()
+	r = forwarded("/", "text/html")
+	r.Header.Set("X-Forwarded-Host", "evil.example")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,190 @@
+package introspection
+
+// OAuth 2.0 Token Introspection (RFC 7662) for IdP issued opaque access tokens
+// https://tools.ietf.org/html/rfc7662
+//
+// clients which hold an access token from the IdP rather than a Vouch Proxy cookie send it as
+//
+//   Authorization: Bearer <access token>
+//
+// and /validate asks oauth.introspection_url whether the token is active
+//
+// the answers are cached in a pkg/lru of cacheSize tokens, an active token until its `exp`. A token which isn't active
+// is remembered for a minute, or until its `exp` when the IdP sends one, so that a client repeating a made up token
+// costs one request to the IdP. Each of them is a failed bearer token as well (see pkg/ratelimit) and the IdP isn't
+// asked about the new tokens of a client which has run out of those
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/keycloak"
+	"github.com/vouch/vouch-proxy/pkg/lru"
+	"github.com/vouch/vouch-proxy/pkg/ratelimit"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+const (
+	// tokens without an `exp`, and inactive tokens, are remembered this long
+	defaultTTL = time.Minute
+	// the most tokens cached
+	cacheSize = 10000
+)
+
+var (
+	// ErrInactive the IdP reports that the token is not active (expired, revoked, or never was)
+	ErrInactive = errors.New("token is not active")
+	// ErrLimited the client has sent too many bad bearer tokens for the IdP to be asked about another one
+	ErrLimited = errors.New("too many failed bearer tokens")
+
+	// Client used to call the introspection endpoint
+	Client = &http.Client{Timeout: 10 * time.Second}
+
+	cache = lru.New(cacheSize)
+
+	log = cfg.Cfg.Logger
+)
+
+// Result of an introspection request
+type Result struct {
+	Active   bool   `json:"active"`
+	Sub      string `json:"sub"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Scope    string `json:"scope"`
+	Exp      int64  `json:"exp"`
+	// Claims is the complete response
+	Claims map[string]interface{} `json:"-"`
+}
+
+// Enabled reports whether oauth.introspection_url is configured
+func Enabled() bool {
+	return cfg.GenOAuth != nil && cfg.GenOAuth.IntrospectionURL != ""
+}
+
+// Introspect asks the IdP about token, sent by the client of r
+// the answer is cached, see store
+func Introspect(r *http.Request, token string) (*Result, error) {
+	hash := sha256.Sum256([]byte(token))
+	if v, ok := cache.Get(hash, time.Now()); ok {
+		res := v.(*Result)
+		if !res.Active {
+			return nil, ErrInactive
+		}
+		log.Debugf("introspection cache hit for %s", res.Username)
+		return res, nil
+	}
+
+	// a miss costs a request to the IdP, which a client that keeps sending bad tokens doesn't get
+	if !ratelimit.BearerAllowed(r) {
+		return nil, ErrLimited
+	}
+	res, err := introspect(token)
+	if err != nil {
+		// failures to reach the IdP aren't cached
+		return nil, err
+	}
+	store(hash, res)
+	if !res.Active {
+		return nil, ErrInactive
+	}
+	return res, nil
+}
+
+func introspect(token string) (res *Result, rerr error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest("POST", cfg.GenOAuth.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// the introspection endpoint is protected by the client's credentials
+	req.SetBasicAuth(url.QueryEscape(cfg.GenOAuth.ClientID), url.QueryEscape(cfg.GenOAuth.ClientSecret))
+
+	resp, err := Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned %d: %s", resp.StatusCode, string(data))
+	}
+
+	res = &Result{}
+	if err = json.Unmarshal(data, res); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &res.Claims); err != nil {
+		return nil, err
+	}
+	log.Debugf("introspection result: %+v", res.Claims)
+	return res, nil
+}
+
+// User the user the token was issued to
+func (res *Result) User() structs.User {
+	user := structs.User{Username: res.Username, Email: res.Email}
+	if user.Username == "" {
+		user.Username = res.Sub
+	}
+	user.PrepareUserData()
+	return user
+}
+
+// VouchClaims maps the result into the same claims a Vouch Proxy JWT carries,
+// keeping the claims configured in `headers.claims`
+func (res *Result) VouchClaims() jwtmanager.VouchClaims {
+	customClaims := make(map[string]interface{})
+	for _, c := range cfg.Cfg.Headers.Claims {
+		if v, ok := res.Claims[c]; ok {
+			customClaims[c] = v
+		}
+	}
+	if cfg.GenOAuth != nil && cfg.GenOAuth.KeycloakRoles {
+		// the same roles claim as the users who log in get, for `vouch.allowRoles`
+		customClaims[keycloak.Claim] = keycloak.Roles(cfg.GenOAuth.KeycloakClient, res.Claims)
+	}
+	return jwtmanager.VouchClaims{
+		Username:     res.User().Username,
+		Sites:        jwtmanager.Sites,
+		CustomClaims: customClaims,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   res.Sub,
+			ExpiresAt: res.Exp,
+		},
+	}
+}
+
+// store res until the token's `exp`, or for defaultTTL when there's none
+// an inactive token which has already expired is remembered for defaultTTL as well
+func store(hash lru.Key, res *Result) {
+	now := time.Now()
+	expires := now.Add(defaultTTL)
+	if res.Exp != 0 && (res.Active || time.Unix(res.Exp, 0).After(now)) {
+		expires = time.Unix(res.Exp, 0)
+	}
+	if !expires.After(now) {
+		return
+	}
+	cache.Add(hash, res, expires)
+}
@@ -0,0 +1,142 @@
+package introspection
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/ratelimit"
+)
+
+var (
+	calls  = 0
+	tokens = map[string]map[string]interface{}{}
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+	cfg.Cfg.Headers.Claims = []string{"scope", "sub"}
+	cfg.GenOAuth.ClientID = "vouch"
+	cfg.GenOAuth.ClientSecret = "s3cret"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if id, secret, ok := r.BasicAuth(); !ok || id != "vouch" || secret != "s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		res, ok := tokens[r.PostFormValue("token")]
+		if !ok {
+			res = map[string]interface{}{"active": false}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	cfg.GenOAuth.IntrospectionURL = srv.URL
+}
+
+func introspectToken(token string) (*Result, error) {
+	r := httptest.NewRequest("GET", "/validate", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return Introspect(r, token)
+}
+
+func TestIntrospect(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	tokens["opaque1"] = map[string]interface{}{
+		"active":   true,
+		"sub":      "f1a2",
+		"username": "alice",
+		"email":    "alice@example.com",
+		"scope":    "read write",
+		"exp":      exp,
+	}
+	calls = 0
+
+	res, err := introspectToken("opaque1")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", res.User().Username)
+	assert.Equal(t, "alice@example.com", res.User().Email)
+
+	claims := res.VouchClaims()
+	assert.Equal(t, "alice", claims.Username)
+	assert.Equal(t, exp, claims.ExpiresAt)
+	assert.Equal(t, map[string]interface{}{"scope": "read write", "sub": "f1a2"}, claims.CustomClaims)
+
+	// cached
+	_, err = introspectToken("opaque1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestIntrospectSubOnly(t *testing.T) {
+	tokens["opaque2"] = map[string]interface{}{"active": true, "sub": "service-account-ci"}
+	res, err := introspectToken("opaque2")
+	assert.NoError(t, err)
+	assert.Equal(t, "service-account-ci", res.VouchClaims().Username)
+}
+
+func TestIntrospectInactive(t *testing.T) {
+	calls = 0
+	_, err := introspectToken("revoked")
+	assert.Equal(t, ErrInactive, err)
+	// the answer is cached as well, the IdP isn't asked again
+	_, err = introspectToken("revoked")
+	assert.Equal(t, ErrInactive, err)
+	assert.Equal(t, 1, calls)
+	v, ok := cache.Get(sha256.Sum256([]byte("revoked")), time.Now().Add(defaultTTL-time.Second))
+	if assert.True(t, ok) {
+		assert.False(t, v.(*Result).Active)
+	}
+	_, ok = cache.Get(sha256.Sum256([]byte("revoked")), time.Now().Add(defaultTTL))
+	assert.False(t, ok)
+}
+
+func TestIntrospectInactiveExpired(t *testing.T) {
+	// an expired token's exp has passed, it's remembered for defaultTTL instead
+	tokens["expired"] = map[string]interface{}{"active": false, "exp": time.Now().Add(-time.Hour).Unix()}
+	calls = 0
+	for i := 0; i < 2; i++ {
+		_, err := introspectToken("expired")
+		assert.Equal(t, ErrInactive, err)
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestIntrospectLimited(t *testing.T) {
+	cfg.Cfg.RateLimit.Enabled = true
+	cfg.Cfg.RateLimit.Bearer = cfg.TokenBucket{Every: time.Hour, Burst: 2}
+	ratelimit.Configure()
+	defer func() { cfg.Cfg.RateLimit.Enabled = false }()
+
+	calls = 0
+	r := httptest.NewRequest("GET", "/validate", nil)
+	for _, token := range []string{"made-up-1", "made-up-2"} {
+		_, err := Introspect(r, token)
+		assert.Equal(t, ErrInactive, err)
+		ratelimit.BearerFailed(r)
+	}
+	// the IdP isn't asked about another one
+	_, err := Introspect(r, "made-up-3")
+	assert.Equal(t, ErrLimited, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestIntrospectBadCredentials(t *testing.T) {
+	cfg.GenOAuth.ClientSecret = "wrong"
+	defer func() { cfg.GenOAuth.ClientSecret = "s3cret" }()
+
+	calls = 0
+	_, err := introspectToken("whatever")
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrInactive, err)
+	// errors aren't cached
+	_, err = introspectToken("whatever")
+	assert.Error(t, err)
+	assert.Equal(t, 2, calls)
+}
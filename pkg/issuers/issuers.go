@@ -0,0 +1,179 @@
+package issuers
+
+// JWT access tokens issued by the IdPs listed in `vouch.jwt.trustedIssuers`
+//
+// clients send them as `Authorization: Bearer <jwt>`, /validate verifies the signature with the keys
+// published at the issuer's jwksURL, checks `exp` and `aud`, and then treats the token as if it were
+// a Vouch Proxy JWT
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/keycloak"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+var (
+	// ErrUntrusted the token isn't a JWT from any of the trusted issuers
+	ErrUntrusted = errors.New("token is not from a trusted issuer")
+
+	mu      sync.Mutex
+	remotes = make(map[string]*jwks.Remote)
+
+	log = cfg.Cfg.Logger
+)
+
+// Token a verified third party JWT
+type Token struct {
+	Issuer *cfg.TrustedIssuer
+	Claims jwt.MapClaims
+}
+
+// Enabled reports whether any trusted issuers are configured
+func Enabled() bool {
+	return len(cfg.Cfg.JWT.TrustedIssuers) > 0
+}
+
+func trusted(iss string) *cfg.TrustedIssuer {
+	for i, ti := range cfg.Cfg.JWT.TrustedIssuers {
+		if ti.Issuer == iss {
+			return &cfg.Cfg.JWT.TrustedIssuers[i]
+		}
+	}
+	return nil
+}
+
+func remote(ti *cfg.TrustedIssuer) *jwks.Remote {
+	mu.Lock()
+	defer mu.Unlock()
+	r, ok := remotes[ti.JWKSURL]
+	if !ok {
+		r = jwks.NewRemote(ti.JWKSURL)
+		remotes[ti.JWKSURL] = r
+	}
+	return r
+}
+
+// Verify checks the signature, `exp` and `aud` of a JWT from one of the trusted issuers
+func Verify(tokenString string) (*Token, error) {
+	// find out who claims to have issued the token before trusting anything in it
+	unverified := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, unverified); err != nil {
+		return nil, ErrUntrusted
+	}
+	iss, _ := unverified["iss"].(string)
+	ti := trusted(iss)
+	if ti == nil {
+		return nil, ErrUntrusted
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := remote(ti).Key(kid)
+		if err != nil {
+			return nil, err
+		}
+		// the key decides the algorithm, never the token (and never HMAC)
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
+				return key, nil
+			}
+			if _, ok := token.Method.(*jwt.SigningMethodRSAPSS); ok {
+				return key, nil
+			}
+		case *ecdsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+				return key, nil
+			}
+		case ed25519.PublicKey:
+			if token.Method == jwtmanager.SigningMethodEdDSA {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("unexpected signing method %v for key %s", token.Header["alg"], kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", iss, err)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("%s: token has no exp", iss)
+	}
+	if !audienceMatches(claims["aud"], ti.Audience) {
+		return nil, fmt.Errorf("%s: token is not for audience %s", iss, ti.Audience)
+	}
+	log.Debugf("verified token from %s: %+v", iss, claims)
+	return &Token{ti, claims}, nil
+}
+
+// aud is either a single string or a list of them
+func audienceMatches(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *Token) claim(name string) string {
+	s, _ := t.Claims[name].(string)
+	return s
+}
+
+// User the user the token was issued to, the Username comes from the issuer's usernameClaim (default `sub`)
+func (t *Token) User() structs.User {
+	usernameClaim := t.Issuer.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+	user := structs.User{
+		Username: t.claim(usernameClaim),
+		Email:    t.claim("email"),
+		Name:     t.claim("name"),
+	}
+	user.PrepareUserData()
+	return user
+}
+
+// VouchClaims maps the token into the same claims a Vouch Proxy JWT carries,
+// keeping the claims configured in `headers.claims`
+func (t *Token) VouchClaims() jwtmanager.VouchClaims {
+	customClaims := make(map[string]interface{})
+	for _, c := range cfg.Cfg.Headers.Claims {
+		if v, ok := t.Claims[c]; ok {
+			customClaims[c] = v
+		}
+	}
+	if cfg.GenOAuth != nil && cfg.GenOAuth.KeycloakRoles {
+		// the same roles claim as the users who log in get, for `vouch.allowRoles`
+		customClaims[keycloak.Claim] = keycloak.Roles(cfg.GenOAuth.KeycloakClient, map[string]interface{}(t.Claims))
+	}
+	exp, _ := t.Claims["exp"].(float64)
+	return jwtmanager.VouchClaims{
+		Username:     t.User().Username,
+		Sites:        jwtmanager.Sites,
+		CustomClaims: customClaims,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    t.Issuer.Issuer,
+			Subject:   t.claim("sub"),
+			ExpiresAt: int64(exp),
+		},
+	}
+}
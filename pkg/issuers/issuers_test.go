@@ -0,0 +1,121 @@
+package issuers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+)
+
+var (
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+	cfg.Cfg.Headers.Claims = []string{"groups"}
+
+	rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaJWK, _ := jwks.NewKey("rsa1", &rsaKey.PublicKey)
+	ecJWK, _ := jwks.NewKey("ec1", &ecKey.PublicKey)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwks.Set{Keys: []jwks.Key{rsaJWK, ecJWK}})
+	}))
+
+	cfg.Cfg.JWT.TrustedIssuers = []cfg.TrustedIssuer{
+		{Issuer: "https://idp.example.com/", JWKSURL: srv.URL, Audience: "https://api.example.com"},
+		{Issuer: "https://other.example.com/", JWKSURL: srv.URL, Audience: "other", UsernameClaim: "preferred_username"},
+	}
+}
+
+func claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":    "https://idp.example.com/",
+		"sub":    "alice",
+		"aud":    "https://api.example.com",
+		"email":  "alice@example.com",
+		"groups": []interface{}{"staff"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, c jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, c)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return s
+}
+
+func TestVerify(t *testing.T) {
+	for _, s := range []string{
+		sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, claims()),
+		sign(t, jwt.SigningMethodES256, "ec1", ecKey, claims()),
+	} {
+		token, err := Verify(s)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, "alice", token.User().Username)
+		assert.Equal(t, "alice@example.com", token.User().Email)
+		vc := token.VouchClaims()
+		assert.Equal(t, "alice", vc.Username)
+		assert.Equal(t, "https://idp.example.com/", vc.Issuer)
+		assert.Equal(t, map[string]interface{}{"groups": []interface{}{"staff"}}, vc.CustomClaims)
+	}
+}
+
+func TestVerifyAudienceList(t *testing.T) {
+	c := claims()
+	c["iss"] = "https://other.example.com/"
+	c["aud"] = []interface{}{"account", "other"}
+	c["preferred_username"] = "alice.smith"
+	token, err := Verify(sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, c))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice.smith", token.User().Username)
+}
+
+func TestVerifyRejects(t *testing.T) {
+	wrongAud := claims()
+	wrongAud["aud"] = "https://someone-else.example.com"
+	expired := claims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	noExp := claims()
+	delete(noExp, "exp")
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	for name, s := range map[string]string{
+		"wrong audience": sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, wrongAud),
+		"expired":        sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, expired),
+		"no exp":         sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, noExp),
+		"forged":         sign(t, jwt.SigningMethodRS256, "rsa1", otherKey, claims()),
+		"unknown kid":    sign(t, jwt.SigningMethodRS256, "rsa2", rsaKey, claims()),
+		"key mismatch":   sign(t, jwt.SigningMethodES256, "rsa1", ecKey, claims()),
+		// the public key must never be usable as an HMAC secret
+		"hmac": sign(t, jwt.SigningMethodHS256, "rsa1", []byte("whatever"), claims()),
+	} {
+		_, err := Verify(s)
+		assert.Error(t, err, name)
+		assert.NotEqual(t, ErrUntrusted, err, name)
+	}
+
+	untrusted := claims()
+	untrusted["iss"] = "https://evil.example.com/"
+	_, err := Verify(sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, untrusted))
+	assert.Equal(t, ErrUntrusted, err)
+	_, err = Verify("opaque-access-token")
+	assert.Equal(t, ErrUntrusted, err)
+}
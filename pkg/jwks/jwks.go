@@ -0,0 +1,256 @@
+package jwks
+
+// JSON Web Key Sets
+// https://tools.ietf.org/html/rfc7517
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+const (
+	// a key set is fetched again after this long
+	maxAge = time.Hour
+	// an unknown kid triggers a fetch, but no more often than this
+	minRefresh = time.Minute
+)
+
+var log = cfg.Cfg.Logger
+
+// Key is a single JSON Web Key, only public keys are supported
+type Key struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP (Ed25519)
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Set is a JSON Web Key Set
+type Set struct {
+	Keys []Key `json:"keys"`
+}
+
+// PublicKey converts the JWK into an *rsa.PublicKey, an *ecdsa.PublicKey or an ed25519.PublicKey
+func (k Key) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, fmt.Errorf("jwks: key %s has an invalid exponent", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("jwks: key %s has unsupported curve %s", k.Kid, k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("jwks: key %s is not on curve %s", k.Kid, k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("jwks: key %s has unsupported curve %s", k.Kid, k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("jwks: key %s is not an Ed25519 public key", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("jwks: key %s has unsupported kty %s", k.Kid, k.Kty)
+}
+
+// NewKey the JWK for an *rsa.PublicKey, an *ecdsa.PublicKey or an ed25519.PublicKey
+func NewKey(kid string, pub crypto.PublicKey) (Key, error) {
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		return Key{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   encodeInt(p.N, 0),
+			E:   encodeInt(big.NewInt(int64(p.E)), 0),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (p.Curve.Params().BitSize + 7) / 8
+		return Key{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Crv: p.Curve.Params().Name,
+			X:   encodeInt(p.X, size),
+			Y:   encodeInt(p.Y, size),
+		}, nil
+	case ed25519.PublicKey:
+		return Key{
+			Kty: "OKP",
+			Kid: kid,
+			Use: "sig",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(p),
+		}, nil
+	}
+	return Key{}, fmt.Errorf("jwks: unsupported public key type %T", pub)
+}
+
+// Thumbprint the RFC 7638 SHA-256 thumbprint of the key, suitable as a kid
+// https://tools.ietf.org/html/rfc7638
+func (k Key) Thumbprint() string {
+	// the required members in lexicographic order
+	var members string
+	switch k.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, k.E, k.Kty, k.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Crv, k.Kty, k.X, k.Y)
+	default:
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Crv, k.Kty, k.X)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// encodeInt base64url of the big-endian bytes, EC coordinates are padded to the size of the curve
+func encodeInt(i *big.Int, size int) string {
+	b := i.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("jwks: missing key parameter")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Remote is a key set published at a url, such as an IdP's jwks_uri
+type Remote struct {
+	URL    string
+	Client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time // last attempt
+}
+
+// NewRemote the key set at url
+func NewRemote(url string) *Remote {
+	return &Remote{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Key returns the public key with the given kid.
+// The set is fetched when it is stale or doesn't contain kid.
+func (r *Remote) Key(kid string) (crypto.PublicKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	since := time.Since(r.fetched)
+	key, ok := r.keys[kid]
+	if (!ok && since > minRefresh) || since > maxAge {
+		// failed attempts count too, an unreachable IdP isn't asked on every request
+		r.fetched = time.Now()
+		if err := r.fetch(); err != nil {
+			// keep using the keys we have
+			log.Errorf("jwks: could not fetch %s: %s", r.URL, err)
+		}
+		key, ok = r.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("jwks: no key %s at %s", kid, r.URL)
+	}
+	return key, nil
+}
+
+func (r *Remote) fetch() (rerr error) {
+	log.Debugf("jwks: fetching %s", r.URL)
+	resp, err := r.Client.Get(r.URL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", r.URL, resp.StatusCode)
+	}
+
+	set := Set{}
+	if err = json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	r.keys = keys
+	return nil
+}
@@ -0,0 +1,96 @@
+package jwks
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	for _, pub := range []interface{}{&rsaKey.PublicKey, &ecKey.PublicKey, edPub} {
+		k, err := NewKey("kid1", pub)
+		assert.NoError(t, err)
+		assert.Equal(t, "sig", k.Use)
+		got, err := k.PublicKey()
+		assert.NoError(t, err)
+		assert.Equal(t, pub, got)
+	}
+
+	_, err = Key{Kty: "EC", Crv: "P-256", X: "AQ", Y: "AQ"}.PublicKey()
+	assert.Error(t, err)
+	_, err = Key{Kty: "oct"}.PublicKey()
+	assert.Error(t, err)
+}
+
+func TestThumbprint(t *testing.T) {
+	// the example from https://tools.ietf.org/html/rfc7638#section-3.1
+	k := Key{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+	}
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", k.Thumbprint())
+}
+
+func TestRemote(t *testing.T) {
+	key1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk1, _ := NewKey("1", &key1.PublicKey)
+	jwk2, _ := NewKey("2", &key2.PublicKey)
+	enc, _ := NewKey("enc", &key2.PublicKey)
+	enc.Use = "enc"
+
+	set := Set{Keys: []Key{jwk1, enc}}
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer srv.Close()
+
+	r := NewRemote(srv.URL)
+	pub, err := r.Key("1")
+	assert.NoError(t, err)
+	assert.Equal(t, &key1.PublicKey, pub)
+	_, err = r.Key("1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetches)
+
+	// encryption keys are left out
+	_, err = r.Key("enc")
+	assert.Error(t, err)
+
+	// the IdP rotates its keys, an unknown kid fetches the set again but not straight away
+	set.Keys = append(set.Keys, jwk2)
+	_, err = r.Key("2")
+	assert.Error(t, err)
+	assert.Equal(t, 1, fetches)
+
+	r.fetched = time.Now().Add(-2 * minRefresh)
+	pub, err = r.Key("2")
+	assert.NoError(t, err)
+	assert.Equal(t, &key2.PublicKey, pub)
+	assert.Equal(t, 2, fetches)
+}
@@ -0,0 +1,101 @@
+package jwtmanager
+
+// a cache of the tokens /validate has already verified
+//
+// nginx calls /validate for every subrequest, each time with the same token. Verifying it means decompressing or
+// decrypting it, checking the signature and unmarshalling the claims, so the claims are kept, keyed by the sha256 of
+// the token, until the token expires. Whether the token may reach a host is remembered along with them.
+//
+// the cache holds `vouch.jwt.cacheSize` tokens, the least recently used one makes way for a new one. It's emptied
+// whenever a key leaves the ring (see ConfigureSigning), so a token signed with a key which is no longer accepted is
+// never served from it. A server side session is looked up before its jwt is, revoking the session still takes effect
+// as described in pkg/sessionstore.
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/lru"
+)
+
+// the most hosts remembered for a token, the Host header is up to the client
+const maxHosts = 64
+
+var tokens *lru.Cache
+
+type cacheEntry struct {
+	claims VouchClaims
+	// whether the token may reach the host, by host
+	mu    sync.Mutex
+	hosts map[string]bool
+}
+
+func init() {
+	tokens = lru.New(cfg.Cfg.JWT.CacheSize)
+}
+
+// cached the entry of tokenString unless it has expired
+func cached(tokenString string) (*cacheEntry, bool) {
+	v, ok := tokens.Get(sha256.Sum256([]byte(tokenString)), jwt.TimeFunc())
+	if !ok {
+		return nil, false
+	}
+	return v.(*cacheEntry), true
+}
+
+// ParseClaims verifies tokenString and returns its claims, which are taken from the cache when it was verified before
+// the claims are shared with the other requests which present the same token and must not be modified
+func ParseClaims(tokenString string) (VouchClaims, error) {
+	if tokens.Size() <= 0 {
+		return parseClaims(tokenString)
+	}
+	if e, ok := cached(tokenString); ok {
+		return e.claims, nil
+	}
+
+	claims, err := parseClaims(tokenString)
+	if err != nil {
+		return claims, err
+	}
+	// a token which never expires is verified each time
+	if claims.ExpiresAt != 0 {
+		tokens.Add(sha256.Sum256([]byte(tokenString)), &cacheEntry{
+			claims: claims,
+			hosts:  make(map[string]bool),
+		}, time.Unix(claims.ExpiresAt, 0))
+	}
+	return claims, nil
+}
+
+func parseClaims(tokenString string) (VouchClaims, error) {
+	token, err := ParseTokenString(tokenString)
+	if err != nil {
+		return VouchClaims{}, err
+	}
+	return PTokenClaims(token)
+}
+
+// HostInClaims is SiteInClaims, remembered for the token the claims were parsed from
+func HostInClaims(tokenString, host string, claims *VouchClaims) bool {
+	if tokens.Size() <= 0 {
+		return SiteInClaims(host, claims)
+	}
+	e, ok := cached(tokenString)
+	if !ok {
+		return SiteInClaims(host, claims)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	allowed, ok := e.hosts[host]
+	if !ok {
+		allowed = SiteInClaims(host, claims)
+		if len(e.hosts) < maxHosts {
+			e.hosts[host] = allowed
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,118 @@
+package jwtmanager
+
+import (
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/lru"
+)
+
+// useCache of size, the returned func restores the one there was
+func useCache(size int) func() {
+	was := tokens
+	tokens = lru.New(size)
+	return func() { tokens = was }
+}
+
+func TestParseClaimsCached(t *testing.T) {
+	defer useCache(2)()
+	uts := CreateUserTokenString(u1, customClaims, t1)
+
+	claims, err := ParseClaims(uts)
+	assert.NoError(t, err)
+	assert.Equal(t, u1.Username, claims.Username)
+	assert.Equal(t, 1, tokens.Len())
+
+	cached, err := ParseClaims(uts)
+	assert.NoError(t, err)
+	assert.Equal(t, claims, cached)
+	assert.Equal(t, 1, tokens.Len())
+
+	// a bad token isn't kept
+	_, err = ParseClaims("not a token")
+	assert.Error(t, err)
+	assert.Equal(t, 1, tokens.Len())
+}
+
+func TestParseClaimsExpires(t *testing.T) {
+	defer useCache(2)()
+	uts := CreateUserTokenString(u1, customClaims, t1)
+	_, err := ParseClaims(uts)
+	assert.NoError(t, err)
+
+	jwt.TimeFunc = func() time.Time {
+		return time.Now().Add(time.Duration(cfg.Cfg.JWT.MaxAge+1) * time.Minute)
+	}
+	defer func() { jwt.TimeFunc = time.Now }()
+	_, err = ParseClaims(uts)
+	assert.True(t, IsExpired(err))
+	assert.Equal(t, 0, tokens.Len())
+}
+
+func TestHostInClaims(t *testing.T) {
+	defer useCache(2)()
+	populateSites()
+	uts := CreateUserTokenString(u1, customClaims, t1)
+	claims, err := ParseClaims(uts)
+	assert.NoError(t, err)
+
+	assert.True(t, HostInClaims(uts, cfg.Cfg.Domains[0], &claims))
+	assert.False(t, HostInClaims(uts, "elsewhere.example", &claims))
+	e, _ := cached(uts)
+	assert.Equal(t, map[string]bool{cfg.Cfg.Domains[0]: true, "elsewhere.example": false}, e.hosts)
+}
+
+func TestRetiredKeyPurgesCache(t *testing.T) {
+	defer useCache(2)()
+	defer func() {
+		cfg.Cfg.JWT.Keys = nil
+		cfg.Cfg.JWT.PrimaryKey = ""
+		ConfigureSigning()
+	}()
+	cfg.Cfg.JWT.Keys = []cfg.JWTKey{
+		{ID: "2020-01", Secret: "the first secret"},
+		{ID: "2020-02", Secret: "the second secret"},
+	}
+	cfg.Cfg.JWT.PrimaryKey = "2020-01"
+	assert.NoError(t, ConfigureSigning())
+	first := CreateUserTokenString(u1, customClaims, t1)
+	_, err := ParseClaims(first)
+	assert.NoError(t, err)
+
+	// rereading the same keys keeps the cache
+	assert.NoError(t, ConfigureSigning())
+	assert.Equal(t, 1, tokens.Len())
+
+	cfg.Cfg.JWT.Keys = cfg.Cfg.JWT.Keys[1:]
+	cfg.Cfg.JWT.PrimaryKey = "2020-02"
+	assert.NoError(t, ConfigureSigning())
+	assert.Equal(t, 0, tokens.Len())
+	_, err = ParseClaims(first)
+	assert.Error(t, err)
+}
+
+func benchmarkValidate(b *testing.B, size int) {
+	defer useCache(size)()
+	populateSites()
+	uts := CreateUserTokenString(u1, customClaims, t1)
+	host := cfg.Cfg.Domains[0]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		claims, err := ParseClaims(uts)
+		if err != nil || !HostInClaims(uts, host, &claims) {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkValidateUncached(b *testing.B) {
+	benchmarkValidate(b, 0)
+}
+
+func BenchmarkValidateCached(b *testing.B) {
+	benchmarkValidate(b, 100)
+}
@@ -0,0 +1,146 @@
+package jwtmanager
+
+// with `vouch.jwt.encrypt` the signed token is wrapped in a JWE (RFC 7516) using direct encryption with A256GCM
+// and `vouch.jwt.encryptionKey`, so that the provider tokens it may carry can't be read out of the cookie
+//
+// BASE64URL(header) . (no encrypted key) . BASE64URL(iv) . BASE64URL(ciphertext) . BASE64URL(tag)
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Cty string `json:"cty"`
+	Zip string `json:"zip,omitempty"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// isEncrypted a JWE has five segments, a JWT three
+func isEncrypted(tokenString string) bool {
+	return strings.Count(tokenString, ".") == 4
+}
+
+// aead the AES-256-GCM cipher, its key is derived from `vouch.jwt.encryptionKey`
+func aead() (cipher.AEAD, error) {
+	if cfg.Cfg.JWT.EncryptionKey == "" {
+		return nil, errors.New("jwt.encryptionKey is not set")
+	}
+	key := sha256.Sum256([]byte(cfg.Cfg.JWT.EncryptionKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptTokenString wraps the signed token, deflating it first when `vouch.jwt.compress` is set
+func encryptTokenString(ss string) (string, error) {
+	gcm, err := aead()
+	if err != nil {
+		return "", err
+	}
+
+	header := jweHeader{Alg: "dir", Enc: "A256GCM", Cty: "JWT"}
+	plaintext := []byte(ss)
+	if cfg.Cfg.JWT.Compress {
+		header.Zip = "DEF"
+		var buf bytes.Buffer
+		zw, _ := flate.NewWriter(&buf, flate.BestCompression)
+		if _, err = zw.Write(plaintext); err != nil {
+			return "", err
+		}
+		if err = zw.Close(); err != nil {
+			return "", err
+		}
+		plaintext = buf.Bytes()
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	protected := b64.EncodeToString(h)
+
+	iv := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(iv); err != nil {
+		return "", err
+	}
+	// the protected header is the additional authenticated data
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	tagStart := len(sealed) - gcm.Overhead()
+	return strings.Join([]string{
+		protected,
+		"",
+		b64.EncodeToString(iv),
+		b64.EncodeToString(sealed[:tagStart]),
+		b64.EncodeToString(sealed[tagStart:]),
+	}, "."), nil
+}
+
+// decryptTokenString returns the signed token inside the JWE
+func decryptTokenString(tokenString string) (string, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 5 {
+		return "", errors.New("token is not a JWE")
+	}
+	h, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+	header := jweHeader{}
+	if err = json.Unmarshal(h, &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "dir" || header.Enc != "A256GCM" || parts[1] != "" {
+		return "", fmt.Errorf("unsupported JWE alg %s enc %s", header.Alg, header.Enc)
+	}
+
+	gcm, err := aead()
+	if err != nil {
+		return "", err
+	}
+	iv, err := b64.DecodeString(parts[2])
+	if err != nil || len(iv) != gcm.NonceSize() {
+		return "", errors.New("invalid JWE iv")
+	}
+	ciphertext, err := b64.DecodeString(parts[3])
+	if err != nil {
+		return "", err
+	}
+	tag, err := b64.DecodeString(parts[4])
+	if err != nil || len(tag) != gcm.Overhead() {
+		return "", errors.New("invalid JWE tag")
+	}
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", errors.New("token could not be decrypted")
+	}
+
+	switch header.Zip {
+	case "":
+	case "DEF":
+		zr := flate.NewReader(bytes.NewReader(plaintext))
+		defer zr.Close()
+		if plaintext, err = ioutil.ReadAll(zr); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported JWE zip %s", header.Zip)
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,71 @@
+package jwtmanager
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func useEncryption(key string) func() {
+	cfg.Cfg.JWT.Encrypt = true
+	cfg.Cfg.JWT.EncryptionKey = key
+	return func() {
+		cfg.Cfg.JWT.Encrypt = false
+		cfg.Cfg.JWT.EncryptionKey = ""
+	}
+}
+
+func TestEncryptedToken(t *testing.T) {
+	plain := CreateUserTokenString(u1, customClaims, t1)
+	defer useEncryption("an encryption key which is not the jwt.secret")()
+
+	for _, compress := range []bool{true, false} {
+		cfg.Cfg.JWT.Compress = compress
+		uts := CreateUserTokenString(u1, customClaims, t1)
+		assert.True(t, isEncrypted(uts))
+		assert.NotContains(t, uts, t1.PAccessToken[:40])
+		for _, segment := range strings.Split(uts, ".") {
+			b, _ := base64.RawURLEncoding.DecodeString(segment)
+			assert.NotContains(t, string(b), u1.Username)
+		}
+
+		token, err := ParseTokenString(uts)
+		if assert.NoError(t, err) {
+			claims, _ := PTokenClaims(token)
+			assert.Equal(t, u1.Username, claims.Username)
+			assert.Equal(t, t1.PAccessToken, claims.PAccessToken)
+		}
+	}
+	cfg.Cfg.JWT.Compress = true
+
+	// tokens issued before encryption was turned on are still signed
+	_, err := ParseTokenString(plain)
+	assert.NoError(t, err)
+}
+
+func TestEncryptedTokenRejects(t *testing.T) {
+	reset := useEncryption("an encryption key which is not the jwt.secret")
+	uts := CreateUserTokenString(u1, customClaims, t1)
+
+	parts := strings.Split(uts, ".")
+	ct, _ := base64.RawURLEncoding.DecodeString(parts[3])
+	ct[0] ^= 1
+	parts[3] = base64.RawURLEncoding.EncodeToString(ct)
+	_, err := ParseTokenString(strings.Join(parts, "."))
+	assert.Error(t, err)
+
+	// the header is authenticated too
+	parts = strings.Split(uts, ".")
+	parts[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"dir","enc":"A256GCM","cty":"JWT"}`))
+	_, err = ParseTokenString(strings.Join(parts, "."))
+	assert.Error(t, err)
+
+	reset()
+	defer useEncryption("some other encryption key")()
+	_, err = ParseTokenString(uts)
+	assert.Error(t, err)
+}
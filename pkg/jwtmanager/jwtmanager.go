@@ -5,7 +5,6 @@ import (
 	"compress/gzip"
 	"encoding/base64"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"strings"
 	"time"
@@ -56,6 +55,7 @@ func populateSites() {
 }
 
 // CreateUserTokenString converts user to signed jwt
+// returns "" when the token can't be signed or encrypted, which has been logged
 func CreateUserTokenString(u structs.User, customClaims structs.CustomClaims, ptokens structs.PTokens) string {
 	// User`token`
 	// u.PrepareUserData()
@@ -71,7 +71,7 @@ func CreateUserTokenString(u structs.User, customClaims structs.CustomClaims, pt
 	claims.StandardClaims.ExpiresAt = time.Now().Add(time.Minute * time.Duration(cfg.Cfg.JWT.MaxAge)).Unix()
 
 	// https://godoc.org/github.com/dgrijalva/jwt-go#NewWithClaims
-	token := jwt.NewWithClaims(jwt.GetSigningMethod("HS256"), claims)
+	token, key := newToken(claims)
 	log.Debugf("token: %v", token)
 
 	// log.Debugf("token: %v", token)
@@ -79,10 +79,20 @@ func CreateUserTokenString(u structs.User, customClaims structs.CustomClaims, pt
 	log.Debugf("diff from now: %d", claims.StandardClaims.ExpiresAt-time.Now().Unix())
 
 	// token -> string. Only server knows this secret (foobar).
-	ss, err := token.SignedString([]byte(cfg.Cfg.JWT.Secret))
+	ss, err := token.SignedString(key)
 	// ss, err := token.SignedString([]byte("testing"))
 	if ss == "" || err != nil {
 		log.Errorf("signed token error: %s", err)
+		return ""
+	}
+	if cfg.Cfg.JWT.Encrypt {
+		ess, err := encryptTokenString(ss)
+		if err != nil {
+			// never fall back to handing out the provider tokens in the clear
+			log.Errorf("token encryption error: %s", err)
+			return ""
+		}
+		return ess
 	}
 	if cfg.Cfg.JWT.Compress {
 		return compressAndEncodeTokenString(ss)
@@ -109,6 +119,12 @@ func TokenIsValid(token *jwt.Token, err error) bool {
 	return false
 }
 
+// IsExpired reports whether err is that of a token which has expired or isn't valid yet
+func IsExpired(err error) bool {
+	ve, ok := err.(*jwt.ValidationError)
+	return ok && ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0
+}
+
 // SiteInToken searches does the token contain the site?
 func SiteInToken(site string, token *jwt.Token) bool {
 	if claims, ok := token.Claims.(*VouchClaims); ok {
@@ -124,19 +140,19 @@ func SiteInToken(site string, token *jwt.Token) bool {
 // ParseTokenString converts signed token to jwt struct
 func ParseTokenString(tokenString string) (*jwt.Token, error) {
 	log.Debugf("tokenString %s", tokenString)
-	if cfg.Cfg.JWT.Compress {
+	if isEncrypted(tokenString) {
+		ss, err := decryptTokenString(tokenString)
+		if err != nil {
+			return nil, err
+		}
+		tokenString = ss
+		log.Debugf("decrypted tokenString %s", tokenString)
+	} else if cfg.Cfg.JWT.Compress {
 		tokenString = decodeAndDecompressTokenString(tokenString)
 		log.Debugf("decompressed tokenString %s", tokenString)
 	}
 
-	return jwt.ParseWithClaims(tokenString, &VouchClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// return jwt.ParseWithClaims(tokenString, &VouchClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if token.Method != jwt.GetSigningMethod("HS256") {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-
-		return []byte(cfg.Cfg.JWT.Secret), nil
-	})
+	return jwt.ParseWithClaims(tokenString, &VouchClaims{}, keyFunc)
 
 }
 
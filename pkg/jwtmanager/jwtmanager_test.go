@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"testing"
 
+	jwt "github.com/dgrijalva/jwt-go"
+
 	"github.com/vouch/vouch-proxy/pkg/cfg"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 
@@ -64,6 +66,21 @@ func TestCreateUserTokenStringAndParseToUsername(t *testing.T) {
 
 }
 
+func TestCreateUserTokenStringUnsigned(t *testing.T) {
+	mu.Lock()
+	was := primary
+	// an RS256 key with a secret for a private key can't sign
+	primary = &key{"broken", jwt.SigningMethodRS256, []byte("secret"), nil}
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		primary = was
+		mu.Unlock()
+	}()
+
+	assert.Empty(t, CreateUserTokenString(u1, customClaims, t1))
+}
+
 func TestClaims(t *testing.T) {
 	populateSites()
 	log.Debugf("jwt config %s %d", string(cfg.Cfg.JWT.Secret), cfg.Cfg.JWT.MaxAge)
@@ -0,0 +1,308 @@
+package jwtmanager
+
+// Vouch Proxy JWTs are signed HS256 with `vouch.jwt.secret` unless `vouch.jwt.signingMethod` selects one of the
+// asymmetric methods, in which case they're signed with `vouch.jwt.privateKey` and the public key is published at
+// /.well-known/jwks.json for downstream apps to verify forwarded tokens with
+//
+// tokens carry the kid of the key which signed them, `vouch.jwt.keys` holds a ring of keys to rotate through
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+)
+
+// JWKSPath is where the public keys are served
+const JWKSPath = "/.well-known/jwks.json"
+
+// SigningMethodEdDSA Ed25519 signatures https://tools.ietf.org/html/rfc8037
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(k, []byte(signingString))), nil
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(k, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// key one key of the ring
+type key struct {
+	kid    string
+	method jwt.SigningMethod
+	// the secret for HS256, the private and public key for the asymmetric methods
+	sign   interface{}
+	verify interface{}
+}
+
+var (
+	mu      sync.RWMutex
+	primary *key
+	// keys by kid, for ParseTokenString and the JWKS
+	keys = map[string]*key{}
+)
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+// ring returns the primary key and all of the keys, HS256 with `vouch.jwt.secret` until ConfigureSigning has run
+func ring() (*key, map[string]*key) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if primary == nil {
+		k := hmacKey("", cfg.Cfg.JWT.Secret)
+		return k, map[string]*key{"": k}
+	}
+	return primary, keys
+}
+
+func hmacKey(kid, secret string) *key {
+	return &key{kid, jwt.SigningMethodHS256, []byte(secret), []byte(secret)}
+}
+
+// ConfigureSigning loads the key ring of `vouch.jwt.keys`, or the single key of `vouch.jwt.secret` or
+// `vouch.jwt.privateKey` for the signing method set in `vouch.jwt.signingMethod`
+func ConfigureSigning() error {
+	ring := cfg.Cfg.JWT.Keys
+	primaryID := cfg.Cfg.JWT.PrimaryKey
+	if len(ring) == 0 {
+		ring = []cfg.JWTKey{{
+			ID:            cfg.Cfg.JWT.KeyID,
+			SigningMethod: cfg.Cfg.JWT.SigningMethod,
+			Secret:        cfg.Cfg.JWT.Secret,
+			PrivateKey:    cfg.Cfg.JWT.PrivateKey,
+		}}
+		primaryID = ""
+	}
+
+	newKeys := make(map[string]*key)
+	var newPrimary *key
+	for _, ck := range ring {
+		k, err := loadKey(ck)
+		if err != nil {
+			return err
+		}
+		if _, ok := newKeys[k.kid]; ok {
+			return fmt.Errorf("%s.jwt.keys has more than one key with kid %s", cfg.Branding.LCName, k.kid)
+		}
+		newKeys[k.kid] = k
+		if newPrimary == nil || k.kid == primaryID {
+			newPrimary = k
+		}
+	}
+	if primaryID != "" && newPrimary.kid != primaryID {
+		return fmt.Errorf("%s.jwt.primaryKey %s is not one of %s.jwt.keys", cfg.Branding.LCName, primaryID, cfg.Branding.LCName)
+	}
+	// tokens signed with the secret before it had a kid, or before switching to an asymmetric signingMethod
+	if _, ok := newKeys[""]; !ok && cfg.Cfg.JWT.AcceptHS256 && cfg.Cfg.JWT.Secret != "" {
+		newKeys[""] = hmacKey("", cfg.Cfg.JWT.Secret)
+		log.Infof("HS256 jwts without a kid are still accepted, set %s.jwt.acceptHS256: false once they have expired", cfg.Branding.LCName)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if primary == nil || primary.kid != newPrimary.kid {
+		log.Infof("signing jwts %s with key %s, %d keys accepted", newPrimary.method.Alg(), newPrimary.kid, len(newKeys))
+	}
+	if dropsKey(keys, newKeys) {
+		// the cached tokens may have been signed with it
+		tokens.Purge()
+	}
+	primary = newPrimary
+	keys = newKeys
+	return nil
+}
+
+// dropsKey reports whether one of the old keys is no longer accepted, or now verifies differently
+func dropsKey(old, current map[string]*key) bool {
+	for kid, k := range old {
+		nk, ok := current[kid]
+		if !ok || nk.method != k.method || !reflect.DeepEqual(nk.verify, k.verify) {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchKeyFile rereads the rotating key file every interval and switches to its keys, for `vouch.jwt.rotate`
+func WatchKeyFile(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := cfg.RotateJWTKeys(); err != nil {
+			log.Error(err)
+			continue
+		}
+		if err := ConfigureSigning(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func loadKey(ck cfg.JWTKey) (*key, error) {
+	method := ck.Method()
+	if method == jwt.SigningMethodHS256.Alg() {
+		return hmacKey(ck.ID, ck.Secret), nil
+	}
+
+	signer, err := loadPrivateKey(ck.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	m, err := methodForKey(method, ck.PrivateKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	kid := ck.ID
+	if kid == "" {
+		jwk, err := jwks.NewKey("", signer.Public())
+		if err != nil {
+			return nil, err
+		}
+		kid = jwk.Thumbprint()
+	}
+	log.Debugf("loaded jwt key %s (%s) from %s", kid, m.Alg(), ck.PrivateKey)
+	return &key{kid, m, signer, signer.Public()}, nil
+}
+
+func loadPrivateKey(file string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s does not contain a PKCS#8, PKCS#1 or EC private key", file)
+}
+
+// methodForKey checks that the key suits the signing method
+func methodForKey(method, file string, key crypto.Signer) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		switch method {
+		case "RS256", "RS384", "RS512":
+			return jwt.GetSigningMethod(method), nil
+		}
+	case *ecdsa.PrivateKey:
+		// each ES method goes with its own curve
+		m, ok := map[string]*jwt.SigningMethodECDSA{
+			"P-256": jwt.SigningMethodES256,
+			"P-384": jwt.SigningMethodES384,
+			"P-521": jwt.SigningMethodES512,
+		}[k.Curve.Params().Name]
+		if ok && m.Alg() == method {
+			return m, nil
+		}
+	case ed25519.PrivateKey:
+		if method == SigningMethodEdDSA.Alg() {
+			return SigningMethodEdDSA, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a key for signing method %s", file, method)
+}
+
+// newToken creates a token signed by the primary key, and returns the key to sign it with
+func newToken(claims jwt.Claims) (*jwt.Token, interface{}) {
+	k, _ := ring()
+	token := jwt.NewWithClaims(k.method, claims)
+	if k.kid != "" {
+		token.Header["kid"] = k.kid
+	}
+	return token, k.sign
+}
+
+// keyFunc hands ParseTokenString the key to verify the token with
+func keyFunc(token *jwt.Token) (interface{}, error) {
+	_, keys := ring()
+	kid, _ := token.Header["kid"].(string)
+	k, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %s", kid)
+	}
+	// the key decides the algorithm, never the token
+	if token.Method != k.method {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	return k.verify, nil
+}
+
+// JWKS the public keys Vouch Proxy signs with, HS256 secrets are never published
+func JWKS() jwks.Set {
+	_, keys := ring()
+	set := jwks.Set{Keys: []jwks.Key{}}
+	for _, k := range keys {
+		if k.method == jwt.SigningMethodHS256 {
+			continue
+		}
+		jwk, err := jwks.NewKey(k.kid, k.verify)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		jwk.Alg = k.method.Alg()
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// JWKSHandler /.well-known/jwks.json
+// serves the public keys for downstream apps to verify Vouch Proxy JWTs with
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(JWKS()); err != nil {
+		log.Error(err)
+	}
+}
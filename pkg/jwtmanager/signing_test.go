@@ -0,0 +1,176 @@
+package jwtmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+)
+
+// writeKey saves key as a PKCS#8 PEM file
+func writeKey(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	f, err := ioutil.TempFile("", "vouch-signing-*.pem")
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	return f.Name()
+}
+
+// useSigning switches to method with key, the returned func switches back to HS256
+func useSigning(t *testing.T, method string, key crypto.Signer) func() {
+	file := writeKey(t, key)
+	cfg.Cfg.JWT.SigningMethod = method
+	cfg.Cfg.JWT.PrivateKey = file
+	assert.NoError(t, ConfigureSigning())
+	return func() {
+		os.Remove(file)
+		cfg.Cfg.JWT.SigningMethod = "HS256"
+		cfg.Cfg.JWT.PrivateKey = ""
+		cfg.Cfg.JWT.AcceptHS256 = true
+		ConfigureSigning()
+	}
+}
+
+func TestAsymmetricSigning(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for method, key := range map[string]crypto.Signer{
+		"RS256": rsaKey,
+		"ES256": ecKey,
+		"EdDSA": edKey,
+	} {
+		reset := useSigning(t, method, key)
+		k, _ := ring()
+
+		uts := CreateUserTokenString(u1, customClaims, t1)
+		assert.NotEmpty(t, uts, method)
+		token, err := ParseTokenString(uts)
+		if assert.NoError(t, err, method) {
+			assert.Equal(t, method, token.Method.Alg())
+			assert.Equal(t, k.kid, token.Header["kid"], method)
+			username, _ := PTokenToUsername(token)
+			assert.Equal(t, u1.Username, username, method)
+		}
+
+		// the published key verifies the token
+		w := httptest.NewRecorder()
+		JWKSHandler(w, httptest.NewRequest("GET", JWKSPath, nil))
+		set := jwks.Set{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &set))
+		if assert.Len(t, set.Keys, 1, method) {
+			assert.Equal(t, k.kid, set.Keys[0].Kid)
+			assert.Equal(t, method, set.Keys[0].Alg)
+			pub, err := set.Keys[0].PublicKey()
+			assert.NoError(t, err)
+			ss := uts
+			if cfg.Cfg.JWT.Compress {
+				ss = decodeAndDecompressTokenString(uts)
+			}
+			_, err = jwt.Parse(ss, func(*jwt.Token) (interface{}, error) { return pub, nil })
+			assert.NoError(t, err, method)
+		}
+
+		reset()
+	}
+}
+
+func TestAcceptHS256(t *testing.T) {
+	hs256 := CreateUserTokenString(u1, customClaims, t1)
+	_, err := ParseTokenString(hs256)
+	assert.NoError(t, err)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	reset := useSigning(t, "ES256", ecKey)
+	defer reset()
+
+	// still valid during the migration
+	_, err = ParseTokenString(hs256)
+	assert.NoError(t, err)
+
+	cfg.Cfg.JWT.AcceptHS256 = false
+	assert.NoError(t, ConfigureSigning())
+	_, err = ParseTokenString(hs256)
+	assert.Error(t, err)
+}
+
+func TestConfigureSigningRejectsMismatch(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	file := writeKey(t, ecKey)
+	defer os.Remove(file)
+	defer func() {
+		cfg.Cfg.JWT.SigningMethod = "HS256"
+		cfg.Cfg.JWT.PrivateKey = ""
+	}()
+
+	cfg.Cfg.JWT.PrivateKey = file
+	for _, method := range []string{"ES256", "RS256", "EdDSA"} {
+		cfg.Cfg.JWT.SigningMethod = method
+		err := ConfigureSigning()
+		if assert.Error(t, err, method) {
+			assert.True(t, strings.Contains(err.Error(), method))
+		}
+	}
+	cfg.Cfg.JWT.SigningMethod = "ES384"
+	assert.NoError(t, ConfigureSigning())
+	cfg.Cfg.JWT.SigningMethod = "HS256"
+	assert.NoError(t, ConfigureSigning())
+}
+
+func TestKeyRing(t *testing.T) {
+	defer func() {
+		cfg.Cfg.JWT.Keys = nil
+		cfg.Cfg.JWT.PrimaryKey = ""
+		ConfigureSigning()
+	}()
+	kidless := CreateUserTokenString(u1, customClaims, t1)
+
+	cfg.Cfg.JWT.Keys = []cfg.JWTKey{
+		{ID: "2020-01", Secret: "the first secret"},
+		{ID: "2020-02", Secret: "the second secret"},
+	}
+	cfg.Cfg.JWT.PrimaryKey = "2020-01"
+	assert.NoError(t, ConfigureSigning())
+	first := CreateUserTokenString(u1, customClaims, t1)
+
+	// promote the second key, the first one is still accepted
+	cfg.Cfg.JWT.PrimaryKey = "2020-02"
+	assert.NoError(t, ConfigureSigning())
+	second := CreateUserTokenString(u1, customClaims, t1)
+	for _, s := range []string{kidless, first, second} {
+		_, err := ParseTokenString(s)
+		assert.NoError(t, err)
+	}
+	token, _ := ParseTokenString(second)
+	assert.Equal(t, "2020-02", token.Header["kid"])
+
+	// retire the first key
+	cfg.Cfg.JWT.Keys = cfg.Cfg.JWT.Keys[1:]
+	assert.NoError(t, ConfigureSigning())
+	_, err := ParseTokenString(first)
+	assert.Error(t, err)
+	_, err = ParseTokenString(second)
+	assert.NoError(t, err)
+
+	cfg.Cfg.JWT.PrimaryKey = "2020-01"
+	assert.Error(t, ConfigureSigning())
+}
@@ -0,0 +1,75 @@
+package keycloak
+
+// Keycloak places roles in nested claims
+//
+//   "realm_access": { "roles": [ "admin", "user" ] },
+//   "resource_access": { "myclient": { "roles": [ "editor" ] } }
+//
+// https://www.keycloak.org/docs/latest/server_admin/#_protocol-mappers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// Claim is the name of the flattened claim
+const Claim = "roles"
+
+var log = cfg.Cfg.Logger
+
+// Roles flattens the realm roles and the roles for client found in each of the claim sets into a single list.
+// Duplicates are removed, the order of first appearance is kept.
+func Roles(client string, claimSets ...map[string]interface{}) []interface{} {
+	roles := []interface{}{}
+	seen := make(map[string]bool)
+	add := func(access interface{}) {
+		m, ok := access.(map[string]interface{})
+		if !ok {
+			return
+		}
+		list, ok := m["roles"].([]interface{})
+		if !ok {
+			return
+		}
+		for _, r := range list {
+			role := fmt.Sprint(r)
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	for _, claims := range claimSets {
+		if claims == nil {
+			continue
+		}
+		add(claims["realm_access"])
+		if client != "" {
+			if resource, ok := claims["resource_access"].(map[string]interface{}); ok {
+				add(resource[client])
+			}
+		}
+	}
+	log.Debugf("keycloak roles for client %s: %v", client, roles)
+	return roles
+}
+
+// Allowed checks the roles claim of claims against `vouch.allowRoles`, one of them is enough
+// everyone is allowed when the list is empty
+func Allowed(claims map[string]interface{}) error {
+	if len(cfg.Cfg.AllowRoles) == 0 {
+		return nil
+	}
+	roles, _ := claims[Claim].([]interface{})
+	for _, r := range roles {
+		for _, allowed := range cfg.Cfg.AllowRoles {
+			if fmt.Sprint(r) == allowed {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("user has none of the roles %s", strings.Join(cfg.Cfg.AllowRoles, ", "))
+}
@@ -0,0 +1,56 @@
+package keycloak
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+var (
+	userinfojson = `{
+		"sub": "f:a95afe53-60ba-4ac6-af15-fab870e72f3d:mrtester",
+		"realm_access": { "roles": ["offline_access", "user"] }
+	}`
+	accesstokenjson = `{
+		"realm_access": { "roles": ["user", "admin"] },
+		"resource_access": {
+			"vouch": { "roles": ["editor"] },
+			"account": { "roles": ["manage-account"] }
+		}
+	}`
+)
+
+func TestRoles(t *testing.T) {
+	var userinfo, accesstoken map[string]interface{}
+	json.Unmarshal([]byte(userinfojson), &userinfo)
+	json.Unmarshal([]byte(accesstokenjson), &accesstoken)
+
+	assert.Equal(t, []interface{}{"offline_access", "user", "admin", "editor"}, Roles("vouch", userinfo, accesstoken))
+	assert.Equal(t, []interface{}{"user", "admin", "manage-account"}, Roles("account", accesstoken))
+	assert.Equal(t, []interface{}{"user", "admin"}, Roles("", accesstoken))
+	assert.Equal(t, []interface{}{}, Roles("vouch", nil, map[string]interface{}{}))
+}
+
+func TestAllowed(t *testing.T) {
+	defer func() { cfg.Cfg.AllowRoles = nil }()
+	var accesstoken map[string]interface{}
+	json.Unmarshal([]byte(accesstokenjson), &accesstoken)
+	claims := map[string]interface{}{Claim: Roles("vouch", accesstoken)}
+
+	assert.NoError(t, Allowed(claims))
+	assert.NoError(t, Allowed(nil))
+
+	cfg.Cfg.AllowRoles = []string{"superuser", "editor"}
+	assert.NoError(t, Allowed(claims))
+	cfg.Cfg.AllowRoles = []string{"superuser"}
+	assert.Error(t, Allowed(claims))
+	// a token from before the roles were asked for
+	assert.Error(t, Allowed(map[string]interface{}{}))
+}
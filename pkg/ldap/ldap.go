@@ -0,0 +1,122 @@
+package ldap
+
+// Vouch Proxy authenticating users against an LDAP directory
+//
+// - /login renders a form which POSTs the username and password to /auth
+// - /auth binds to the directory as the user (simple bind over LDAPS or StartTLS)
+// - the user's own entry is then read for `mail`, `displayName` and `memberOf`
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+
+	goldap "github.com/go-ldap/ldap/v3"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// GroupsClaim is the custom claim carrying the user's memberOf values
+const GroupsClaim = "groups"
+
+var (
+	// ErrInvalidCredentials the directory refused the username and password
+	ErrInvalidCredentials = errors.New("ldap: invalid username or password")
+
+	attributes = []string{"mail", "displayName", "memberOf"}
+
+	log = cfg.Cfg.Logger
+)
+
+// Authenticate binds to oauth.ldap_url as the user described by oauth.ldap_user_dn and fills user and customClaims from the user's entry
+func Authenticate(username, password string, user *structs.User, customClaims *structs.CustomClaims) error {
+	// an empty password would turn this into an unauthenticated bind, which most directories accept
+	if username == "" || password == "" {
+		return ErrInvalidCredentials
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	dn := fmt.Sprintf(cfg.GenOAuth.LDAPUserDN, goldap.EscapeDN(username))
+	log.Debugf("ldap binding as %s", dn)
+	if err = conn.Bind(dn, password); err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+			log.Infof("ldap bind failed for %s: %s", dn, err)
+			return ErrInvalidCredentials
+		}
+		return err
+	}
+
+	res, err := conn.Search(goldap.NewSearchRequest(
+		dn, goldap.ScopeBaseObject, goldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)", attributes, nil,
+	))
+	if err != nil {
+		return err
+	}
+	if len(res.Entries) != 1 {
+		return fmt.Errorf("ldap: expected a single entry for %s, found %d", dn, len(res.Entries))
+	}
+	entry := res.Entries[0]
+	log.Debugf("ldap entry for %s: %+v", dn, entry.Attributes)
+
+	user.Username = username
+	user.Email = entry.GetAttributeValue("mail")
+	user.Name = entry.GetAttributeValue("displayName")
+	user.PrepareUserData()
+
+	groups := []interface{}{}
+	for _, g := range entry.GetAttributeValues("memberOf") {
+		groups = append(groups, g)
+	}
+	customClaims.Claims = map[string]interface{}{GroupsClaim: groups}
+	return nil
+}
+
+func dial() (*goldap.Conn, error) {
+	u, err := url.Parse(cfg.GenOAuth.LDAPURL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsConfig(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := goldap.DialURL(cfg.GenOAuth.LDAPURL, goldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "ldap" && cfg.GenOAuth.LDAPStartTLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// tlsConfig trusts oauth.ldap_ca_file if it's set, otherwise the system roots
+func tlsConfig(serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if cfg.GenOAuth.LDAPCAFile == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(cfg.GenOAuth.LDAPCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("ldap: no certificates found in oauth.ldap_ca_file %s", cfg.GenOAuth.LDAPCAFile)
+	}
+	return config, nil
+}
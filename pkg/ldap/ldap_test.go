@@ -0,0 +1,210 @@
+package ldap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// entry is a user in the in-process directory
+type entry struct {
+	password   string
+	attributes map[string][]string
+}
+
+var directory = map[string]entry{
+	"uid=alice,ou=people,dc=example,dc=com": {
+		password: "secret",
+		attributes: map[string][]string{
+			"mail":        {"alice@example.com"},
+			"displayName": {"Alice Smith"},
+			"memberOf":    {"cn=staff,ou=groups,dc=example,dc=com", "cn=admins,ou=groups,dc=example,dc=com"},
+		},
+	},
+	`uid=bob\,jr,ou=people,dc=example,dc=com`: {
+		password:   "hunter2",
+		attributes: map[string][]string{"mail": {"bob@example.com"}},
+	},
+}
+
+func init() {
+	cfg.InitForTestPurposes()
+	cfg.GenOAuth.LDAPUserDN = "uid=%s,ou=people,dc=example,dc=com"
+}
+
+// serve is a minimal LDAPv3 server which understands just enough of Bind, Search, StartTLS and Unbind
+// to stand in for a directory. Only the bound user's own entry can be read.
+func serve(t *testing.T, ln net.Listener, tlsConfig *tls.Config) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			bound := ""
+			for {
+				packet, err := ber.ReadPacket(conn)
+				if err != nil {
+					return
+				}
+				id := packet.Children[0].Value.(int64)
+				op := packet.Children[1]
+				switch op.Tag {
+				case goldap.ApplicationBindRequest:
+					dn := op.Children[1].Data.String()
+					code := int64(goldap.LDAPResultInvalidCredentials)
+					if e, ok := directory[dn]; ok && e.password == op.Children[2].Data.String() {
+						bound = dn
+						code = goldap.LDAPResultSuccess
+					}
+					conn.Write(result(id, goldap.ApplicationBindResponse, code).Bytes())
+				case goldap.ApplicationSearchRequest:
+					base := op.Children[0].Data.String()
+					if e, ok := directory[base]; ok && base == bound {
+						conn.Write(searchEntry(id, base, e.attributes).Bytes())
+					}
+					conn.Write(result(id, goldap.ApplicationSearchResultDone, goldap.LDAPResultSuccess).Bytes())
+				case goldap.ApplicationExtendedRequest:
+					conn.Write(result(id, goldap.ApplicationExtendedResponse, goldap.LDAPResultSuccess).Bytes())
+					conn = tls.Server(conn, tlsConfig)
+				case goldap.ApplicationUnbindRequest:
+					return
+				default:
+					t.Errorf("unexpected LDAP operation %d", op.Tag)
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+func message(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	p.AppendChild(op)
+	return p
+}
+
+func result(id int64, tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return message(id, op)
+}
+
+func searchEntry(id int64, dn string, attributes map[string][]string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultEntry, nil, "Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "objectName"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range attributes {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return message(id, op)
+}
+
+// startServer returns the ldap:// url of a fresh in-process directory
+// along with the path of the CA file to trust for StartTLS
+func startServer(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "vouch-ldap-test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go serve(t, ln, &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	return "ldap://" + ln.Addr().String(), caFile
+}
+
+func setUp(t *testing.T, startTLS bool) {
+	ldapURL, caFile := startServer(t)
+	cfg.GenOAuth.LDAPURL = ldapURL
+	cfg.GenOAuth.LDAPStartTLS = startTLS
+	cfg.GenOAuth.LDAPCAFile = caFile
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, startTLS := range []bool{false, true} {
+		setUp(t, startTLS)
+		user := structs.User{}
+		customClaims := structs.CustomClaims{}
+		assert.NoError(t, Authenticate("alice", "secret", &user, &customClaims))
+		assert.Equal(t, "alice", user.Username)
+		assert.Equal(t, "alice@example.com", user.Email)
+		assert.Equal(t, "Alice Smith", user.Name)
+		assert.Equal(t, map[string]interface{}{
+			"groups": []interface{}{"cn=staff,ou=groups,dc=example,dc=com", "cn=admins,ou=groups,dc=example,dc=com"},
+		}, customClaims.Claims)
+	}
+}
+
+func TestAuthenticateEscapesUsername(t *testing.T) {
+	setUp(t, false)
+	user := structs.User{}
+	customClaims := structs.CustomClaims{}
+	assert.NoError(t, Authenticate("bob,jr", "hunter2", &user, &customClaims))
+	assert.Equal(t, "bob@example.com", user.Email)
+	assert.Equal(t, map[string]interface{}{"groups": []interface{}{}}, customClaims.Claims)
+}
+
+func TestAuthenticateInvalidCredentials(t *testing.T) {
+	setUp(t, false)
+	assert.Equal(t, ErrInvalidCredentials, Authenticate("alice", "wrong", &structs.User{}, &structs.CustomClaims{}))
+	assert.Equal(t, ErrInvalidCredentials, Authenticate("mallory", "secret", &structs.User{}, &structs.CustomClaims{}))
+	// never fall back to an unauthenticated bind
+	assert.Equal(t, ErrInvalidCredentials, Authenticate("alice", "", &structs.User{}, &structs.CustomClaims{}))
+}
+
+func TestAuthenticateUntrustedServer(t *testing.T) {
+	setUp(t, true)
+	cfg.GenOAuth.LDAPCAFile = ""
+	err := Authenticate("alice", "secret", &structs.User{}, &structs.CustomClaims{})
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrInvalidCredentials, err)
+}
@@ -0,0 +1,96 @@
+package lru
+
+// A cache of the results of checking a token, keyed by the sha256 of the token
+//
+// each value expires, and the least recently used of the size of them makes way for a new one.
+// Used by pkg/jwtmanager for the verified Vouch Proxy JWTs and by pkg/introspection for the IdP's answers
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// Key the sha256 of a token
+type Key = [sha256.Size]byte
+
+// Cache is safe to use from several goroutines, the values it holds are shared between them
+type Cache struct {
+	mu   sync.Mutex
+	size int
+	// most recently used first
+	order   *list.List
+	entries map[Key]*list.Element
+}
+
+type entry struct {
+	key     Key
+	value   interface{}
+	expires time.Time
+}
+
+// New Cache of size values, nothing is kept when size isn't positive
+func New(size int) *Cache {
+	return &Cache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[Key]*list.Element),
+	}
+}
+
+// Size the most values kept
+func (c *Cache) Size() int {
+	return c.size
+}
+
+// Get the value of key unless it has expired at now
+func (c *Cache) Get(key Key, now time.Time) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if !now.Before(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+// Add value for key until expires
+func (c *Cache) Add(key Key, value interface{}, expires time.Time) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&entry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+}
+
+// Purge all of the values
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[Key]*list.Element)
+}
+
+// Len the number of values kept, some of which may have expired
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
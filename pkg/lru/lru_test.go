@@ -0,0 +1,44 @@
+package lru
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvicts(t *testing.T) {
+	c := New(2)
+	now := time.Now()
+	for _, b := range []byte{1, 2, 3} {
+		c.Add(Key{b}, b, now.Add(time.Hour))
+		// 1 is used, 2 is the least recently used once 3 is added
+		c.Get(Key{1}, now)
+	}
+	assert.Equal(t, 2, c.Len())
+	v, ok := c.Get(Key{1}, now)
+	assert.True(t, ok)
+	assert.Equal(t, byte(1), v)
+	_, ok = c.Get(Key{2}, now)
+	assert.False(t, ok)
+	_, ok = c.Get(Key{3}, now)
+	assert.True(t, ok)
+
+	c.Purge()
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestExpires(t *testing.T) {
+	c := New(2)
+	now := time.Now()
+	c.Add(Key{1}, "a", now.Add(time.Minute))
+	_, ok := c.Get(Key{1}, now.Add(time.Minute))
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestNoSize(t *testing.T) {
+	c := New(0)
+	c.Add(Key{1}, "a", time.Now().Add(time.Minute))
+	assert.Equal(t, 0, c.Len())
+}
@@ -0,0 +1,203 @@
+package metrics
+
+// Prometheus metrics
+//
+// served at `vouch.metrics.path` (/metrics) with `vouch.metrics.enabled`, on `vouch.metrics.listen` when that's set
+// so that the metrics aren't exposed alongside /validate
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// the outcomes of /validate
+const (
+	ValidateOK          = "ok"
+	ValidateNoJWT       = "no_jwt"
+	ValidateExpired     = "expired"
+	ValidateInvalid     = "invalid"
+	ValidateWrongHost   = "wrong_host"
+	ValidateForbidden   = "forbidden"
+	ValidateRateLimited = "rate_limited"
+)
+
+// the results of a login
+const (
+	LoginSucceeded = "success"
+	LoginDenied    = "denied"
+)
+
+var (
+	// Registry holds the vouch-proxy metrics along with the go runtime and process metrics
+	Registry = prometheus.NewRegistry()
+
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vouch",
+		Name:      "http_requests_total",
+		Help:      "Requests by route and status code.",
+	}, []string{"route", "code"})
+
+	latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "vouch",
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to respond, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+
+	validate = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vouch",
+		Name:      "validate_total",
+		Help:      "Responses of /validate by outcome.",
+	}, []string{"outcome"})
+
+	logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vouch",
+		Name:      "logins_total",
+		Help:      "Completed logins by provider and result.",
+	}, []string{"provider", "result"})
+
+	idpLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "vouch",
+		Name:      "idp_request_duration_seconds",
+		Help:      "Time taken by the IdP to respond, by provider and call.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"provider", "call"})
+
+	idpErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vouch",
+		Name:      "idp_errors_total",
+		Help:      "Failed IdP requests by provider and call, including error responses.",
+	}, []string{"provider", "call"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vouch",
+		Name:      "rate_limited_total",
+		Help:      "Requests refused with a 429 by the limit which ran out.",
+	}, []string{"limit"})
+
+	cookieChunks = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "vouch",
+		Name:      "cookie_chunks",
+		Help:      "The number of cookies the jwt is split into.",
+		Buckets:   []float64{1, 2, 3, 4, 5, 6},
+	})
+
+	jwtSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "vouch",
+		Name:      "jwt_size_bytes",
+		Help:      "The size of the jwt set in the cookie.",
+		Buckets:   prometheus.ExponentialBuckets(256, 2, 8),
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		requests, latency, validate, logins, idpLatency, idpErrors, rateLimited, cookieChunks, jwtSize,
+	)
+}
+
+// Enabled reports whether `vouch.metrics.enabled` is set
+func Enabled() bool {
+	return cfg.Cfg.Metrics.Enabled
+}
+
+// Handler serves the metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Request counts a response to route
+func Request(route string, code int, d time.Duration) {
+	// nothing was written, net/http responds 200
+	if code == 0 {
+		code = http.StatusOK
+	}
+	requests.WithLabelValues(route, strconv.Itoa(code)).Inc()
+	latency.WithLabelValues(route).Observe(d.Seconds())
+}
+
+// Validate counts a response of /validate
+func Validate(outcome string) {
+	validate.WithLabelValues(outcome).Inc()
+}
+
+// Login counts a login which succeeded or was denied
+func Login(result string) {
+	logins.WithLabelValues(provider(), result).Inc()
+}
+
+// RateLimited counts a request refused by limit
+func RateLimited(limit string) {
+	rateLimited.WithLabelValues(limit).Inc()
+}
+
+// Cookie records the size of the jwt and the number of cookies it took
+func Cookie(size, chunks int) {
+	jwtSize.Observe(float64(size))
+	cookieChunks.Observe(float64(chunks))
+}
+
+func provider() string {
+	if cfg.GenOAuth == nil {
+		return ""
+	}
+	return cfg.GenOAuth.Provider
+}
+
+// IdPClient times the requests made to the IdP
+func IdPClient() *http.Client {
+	return &http.Client{Transport: idpTransport{http.DefaultTransport}}
+}
+
+// IdPContext carries the IdPClient to the oauth2 package, for the token exchange and the userinfo requests
+func IdPContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, IdPClient())
+}
+
+type idpTransport struct {
+	base http.RoundTripper
+}
+
+func (t idpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call := idpCall(req)
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	idpLatency.WithLabelValues(provider(), call).Observe(time.Since(start).Seconds())
+	if err != nil || res.StatusCode >= 400 {
+		idpErrors.WithLabelValues(provider(), call).Inc()
+	}
+	return res, err
+}
+
+// idpCall names the request by the configured url it was made to
+func idpCall(req *http.Request) string {
+	if cfg.GenOAuth == nil {
+		return "other"
+	}
+	u := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+	for call, url := range map[string]string{
+		"token":    cfg.GenOAuth.TokenURL,
+		"userinfo": cfg.GenOAuth.UserInfoURL,
+		"auth":     cfg.GenOAuth.AuthURL,
+	} {
+		// the query string isn't part of it, github's userinfo url ends with `?access_token=`
+		if i := strings.Index(url, "?"); i >= 0 {
+			url = url[:i]
+		}
+		if url != "" && u == url {
+			return call
+		}
+	}
+	return "other"
+}
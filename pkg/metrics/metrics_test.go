@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func TestHandler(t *testing.T) {
+	Validate(ValidateWrongHost)
+	Request("/validate", 0, 10*time.Millisecond)
+	Cookie(5000, 2)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	assert.Contains(t, string(body), `vouch_validate_total{outcome="wrong_host"}`)
+	assert.Contains(t, string(body), `vouch_http_requests_total{code="200",route="/validate"}`)
+	assert.Contains(t, string(body), `vouch_http_request_duration_seconds_bucket{route="/validate",le="0.01"}`)
+	assert.Contains(t, string(body), `vouch_cookie_chunks_bucket{le="2"} 1`)
+	assert.Contains(t, string(body), `vouch_jwt_size_bytes_bucket{le="8192"} 1`)
+	assert.Contains(t, string(body), `go_goroutines`)
+}
+
+func TestLogin(t *testing.T) {
+	before := testutil.ToFloat64(logins.WithLabelValues(cfg.GenOAuth.Provider, LoginDenied))
+	Login(LoginDenied)
+	assert.Equal(t, before+1, testutil.ToFloat64(logins.WithLabelValues(cfg.GenOAuth.Provider, LoginDenied)))
+}
+
+func TestIdPClient(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	defer func(token, userinfo string) {
+		cfg.GenOAuth.TokenURL = token
+		cfg.GenOAuth.UserInfoURL = userinfo
+	}(cfg.GenOAuth.TokenURL, cfg.GenOAuth.UserInfoURL)
+	cfg.GenOAuth.TokenURL = ts.URL + "/token"
+	cfg.GenOAuth.UserInfoURL = ts.URL + "/user?access_token="
+
+	p := cfg.GenOAuth.Provider
+	errs := func(call string) float64 {
+		return testutil.ToFloat64(idpErrors.WithLabelValues(p, call))
+	}
+	tokenErrs, userinfoErrs := errs("token"), errs("userinfo")
+
+	c := IdPClient()
+	res, err := c.Post(ts.URL+"/token", "application/x-www-form-urlencoded", nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, tokenErrs, errs("token"))
+
+	status = http.StatusUnauthorized
+	res, err = c.Get(ts.URL + "/user?access_token=abc")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, userinfoErrs+1, errs("userinfo"))
+
+	// a histogram for each of the calls
+	assert.Equal(t, 2, testutil.CollectAndCount(idpLatency))
+}
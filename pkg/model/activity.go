@@ -0,0 +1,204 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/vouch/vouch-proxy/pkg/redis"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// site names have no spaces, usernames may
+func activityKey(a structs.Activity) []byte {
+	return []byte(a.Site + " " + a.Username)
+}
+
+func parseActivityKey(k string) structs.Activity {
+	a := structs.Activity{}
+	if i := strings.Index(k, " "); i >= 0 {
+		a.Site, a.Username = k[:i], k[i+1:]
+	}
+	return a
+}
+
+// addTo adds a to the record cur, which is nil when there is none yet
+func addTo(cur []byte, a structs.Activity) ([]byte, error) {
+	if cur != nil {
+		c := structs.Activity{}
+		if err := decode(cur, &c); err != nil {
+			return nil, err
+		}
+		a.Requests += c.Requests
+		if c.FirstSeen != 0 && c.FirstSeen < a.FirstSeen {
+			a.FirstSeen = c.FirstSeen
+		}
+		if c.LastSeen > a.LastSeen {
+			a.LastSeen = c.LastSeen
+		}
+	}
+	return encode(&a)
+}
+
+// AddActivity adds the requests counted since the last call to the activity in the db
+func (s kvStore) AddActivity(activity []structs.Activity) error {
+	return s.b.addActivity(activity)
+}
+
+// AllActivity collect all items
+func (s kvStore) AllActivity(activity *[]structs.Activity) error {
+	return s.b.allActivity(activity)
+}
+
+// allActivity of the backends which keep the activity as records of the activity bucket
+func allActivity(b backend, activity *[]structs.Activity) error {
+	return b.forEach(activityBucket, func(k, v []byte) error {
+		a := structs.Activity{}
+		if err := decode(v, &a); err != nil {
+			return err
+		}
+		*activity = append(*activity, a)
+		return nil
+	})
+}
+
+// addActivity in a single transaction
+func (bb boltBackend) addActivity(activity []structs.Activity) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		b := getBucket(tx, activityBucket)
+		if b == nil {
+			return fmt.Errorf("no bucket for %s", activityBucket)
+		}
+		for _, a := range activity {
+			val, err := addTo(b.Get(activityKey(a)), a)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(activityKey(a), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bb boltBackend) allActivity(activity *[]structs.Activity) error {
+	return allActivity(bb, activity)
+}
+
+func (m *memBackend) addActivity(activity []structs.Activity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.buckets[string(activityBucket)]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[string(activityBucket)] = b
+	}
+	for _, a := range activity {
+		k := string(activityKey(a))
+		val, err := addTo(b[k], a)
+		if err != nil {
+			return err
+		}
+		b[k] = val
+	}
+	return nil
+}
+
+func (m *memBackend) allActivity(activity *[]structs.Activity) error {
+	return allActivity(m, activity)
+}
+
+// redis keeps the requests, first seen and last seen of each user and site in a hash of its own, keyed by
+// activityKey, the script adds a batch up in one go with HINCRBY
+const redisAddActivity = `
+for i = 1, #ARGV, 4 do
+	local k = ARGV[i]
+	redis.call('HINCRBY', KEYS[1], k, ARGV[i+1])
+	local first = redis.call('HGET', KEYS[2], k)
+	if not first or tonumber(ARGV[i+2]) < tonumber(first) then
+		redis.call('HSET', KEYS[2], k, ARGV[i+2])
+	end
+	local last = redis.call('HGET', KEYS[3], k)
+	if not last or tonumber(ARGV[i+3]) > tonumber(last) then
+		redis.call('HSET', KEYS[3], k, ARGV[i+3])
+	end
+end
+return 0
+`
+
+func (r redisBackend) activityKeys() []string {
+	k := r.key(activityBucket)
+	return []string{k + ":requests", k + ":firstseen", k + ":lastseen"}
+}
+
+func (r redisBackend) addActivity(activity []structs.Activity) error {
+	if len(activity) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, 4*len(activity))
+	for _, a := range activity {
+		args = append(args, string(activityKey(a)), a.Requests, a.FirstSeen, a.LastSeen)
+	}
+	return redis.Client().Eval(redisAddActivity, r.activityKeys(), args...).Err()
+}
+
+func (r redisBackend) allActivity(activity *[]structs.Activity) error {
+	hashes := make([]map[string]string, 0, 3)
+	for _, k := range r.activityKeys() {
+		h, err := redis.Client().HGetAll(k).Result()
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, h)
+	}
+	b := make(map[string][]byte, len(hashes[0]))
+	for k := range hashes[0] {
+		b[k] = nil
+	}
+	return forEachSorted(b, func(k, _ []byte) error {
+		a := parseActivityKey(string(k))
+		a.Requests, _ = strconv.ParseInt(hashes[0][string(k)], 10, 64)
+		a.FirstSeen, _ = strconv.ParseInt(hashes[1][string(k)], 10, 64)
+		a.LastSeen, _ = strconv.ParseInt(hashes[2][string(k)], 10, 64)
+		*activity = append(*activity, a)
+		return nil
+	})
+}
+
+// the sql dbs keep the activity in a table of its own, see sqlSchema, and add it up with an upsert
+func (s sqlBackend) addActivity(activity []structs.Activity) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, a := range activity {
+		if _, err := tx.Exec(s.q(`INSERT INTO vouch_activity (site, username, requests, firstseen, lastseen) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (site, username) DO UPDATE SET requests = vouch_activity.requests + excluded.requests,
+			firstseen = CASE WHEN excluded.firstseen < vouch_activity.firstseen THEN excluded.firstseen ELSE vouch_activity.firstseen END,
+			lastseen = CASE WHEN excluded.lastseen > vouch_activity.lastseen THEN excluded.lastseen ELSE vouch_activity.lastseen END`),
+			a.Site, a.Username, a.Requests, a.FirstSeen, a.LastSeen); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s sqlBackend) allActivity(activity *[]structs.Activity) error {
+	rows, err := s.db.Query(`SELECT site, username, requests, firstseen, lastseen FROM vouch_activity ORDER BY site, username`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a := structs.Activity{}
+		if err := rows.Scan(&a.Site, &a.Username, &a.Requests, &a.FirstSeen, &a.LastSeen); err != nil {
+			return err
+		}
+		*activity = append(*activity, a)
+	}
+	return rows.Err()
+}
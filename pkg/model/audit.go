@@ -0,0 +1,336 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/vouch/vouch-proxy/pkg/redis"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// AuditQuery selects audit events, the zero value selects all of them
+type AuditQuery struct {
+	Username string
+	Type     string
+	// Since and Until are unix times, Until is exclusive
+	Since int64
+	Until int64
+	// Limit the number of events returned, the most recent ones are kept
+	Limit int
+}
+
+func (q AuditQuery) match(e structs.AuditEvent) bool {
+	return (q.Username == "" || e.Username == q.Username) &&
+		(q.Type == "" || e.Type == q.Type) &&
+		(q.Since == 0 || e.Time >= q.Since) &&
+		(q.Until == 0 || e.Time < q.Until)
+}
+
+// the keys sort in the order of the times, and of the IDs within the same second, so that the backends
+// can walk a window of time without reading the events outside of it
+func auditKey(e structs.AuditEvent) []byte {
+	return []byte(fmt.Sprintf("%s-%020d", auditTime(e.Time), e.ID))
+}
+
+// auditTime is the start of the keys of the events at unix time t, and sorts before all of them
+func auditTime(t int64) string {
+	return fmt.Sprintf("%020d", t)
+}
+
+// PutAuditEvent adds e to the audit log
+func (s kvStore) PutAuditEvent(e structs.AuditEvent) error {
+	if e.ID == 0 {
+		id, err := s.b.nextSequence(auditBucket)
+		if err != nil {
+			return err
+		}
+		e.ID = int(id)
+	}
+	return s.b.putAudit(e)
+}
+
+// AuditEvents collects the events matching q, oldest first
+func (s kvStore) AuditEvents(q AuditQuery, events *[]structs.AuditEvent) error {
+	return s.b.auditEvents(q, events)
+}
+
+// PurgeAuditEvents deletes the events which happened before the unix time before
+func (s kvStore) PurgeAuditEvents(before int64) error {
+	return s.b.purgeAudit(before)
+}
+
+// collectAudit reads the records next hands it, newest first, until there are q.Limit events matching q,
+// and appends them to events oldest first. next returns a nil key once the window of q has been read
+func collectAudit(q AuditQuery, next func() (k, v []byte, err error), events *[]structs.AuditEvent) error {
+	matched := []structs.AuditEvent{}
+	for q.Limit <= 0 || len(matched) < q.Limit {
+		k, v, err := next()
+		if err != nil {
+			return err
+		}
+		if k == nil {
+			break
+		}
+		e := structs.AuditEvent{}
+		if err := decode(v, &e); err != nil {
+			return err
+		}
+		if q.match(e) {
+			matched = append(matched, e)
+		}
+	}
+	for i := len(matched) - 1; i >= 0; i-- {
+		*events = append(*events, matched[i])
+	}
+	return nil
+}
+
+// inWindow reports whether the key k of an event is within the times of q
+func (q AuditQuery) inWindow(k []byte) bool {
+	return (q.Since == 0 || string(k) >= auditTime(q.Since)) &&
+		(q.Until == 0 || string(k) < auditTime(q.Until))
+}
+
+func (bb boltBackend) putAudit(e structs.AuditEvent) error {
+	val, err := encode(&e)
+	if err != nil {
+		return err
+	}
+	return bb.put(auditBucket, auditKey(e), val)
+}
+
+// auditEvents walks back from the end of the window with a cursor
+func (bb boltBackend) auditEvents(q AuditQuery, events *[]structs.AuditEvent) error {
+	return bb.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		var k, v []byte
+		started := false
+		return collectAudit(q, func() ([]byte, []byte, error) {
+			switch {
+			case started:
+				k, v = c.Prev()
+			case q.Until == 0:
+				k, v = c.Last()
+			default:
+				// the last key before the first one at Until
+				if k, v = c.Seek([]byte(auditTime(q.Until))); k == nil {
+					k, v = c.Last()
+				} else {
+					k, v = c.Prev()
+				}
+			}
+			started = true
+			if k != nil && !q.inWindow(k) {
+				return nil, nil, nil
+			}
+			return k, v, nil
+		}, events)
+	})
+}
+
+func (bb boltBackend) purgeAudit(before int64) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+		if b == nil {
+			return nil
+		}
+		// deleting while the cursor moves on skips records, collect the keys first
+		keys := [][]byte{}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < auditTime(before); k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *memBackend) putAudit(e structs.AuditEvent) error {
+	val, err := encode(&e)
+	if err != nil {
+		return err
+	}
+	return m.put(auditBucket, auditKey(e), val)
+}
+
+func (m *memBackend) auditEvents(q AuditQuery, events *[]structs.AuditEvent) error {
+	m.mu.RLock()
+	keys := []string{}
+	b := make(map[string][]byte)
+	for k, v := range m.buckets[string(auditBucket)] {
+		if q.inWindow([]byte(k)) {
+			keys = append(keys, k)
+			b[k] = v
+		}
+	}
+	m.mu.RUnlock()
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	return collectAudit(q, func() ([]byte, []byte, error) {
+		if len(keys) == 0 {
+			return nil, nil, nil
+		}
+		k := keys[0]
+		keys = keys[1:]
+		return []byte(k), b[k], nil
+	}, events)
+}
+
+func (m *memBackend) purgeAudit(before int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range m.buckets[string(auditBucket)] {
+		if k < auditTime(before) {
+			delete(m.buckets[string(auditBucket)], k)
+		}
+	}
+	return nil
+}
+
+// redis keeps the events in the hash of the audit bucket, and their keys in a sorted set scored by their time
+func (r redisBackend) auditTimes() string {
+	return r.key(auditBucket) + ":time"
+}
+
+// how many events redis hands back at a time
+const redisAuditPage = 100
+
+func (r redisBackend) putAudit(e structs.AuditEvent) error {
+	val, err := encode(&e)
+	if err != nil {
+		return err
+	}
+	k := string(auditKey(e))
+	_, err = redis.Client().TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.key(auditBucket), k, val)
+		pipe.ZAdd(r.auditTimes(), &redis.Z{Score: float64(e.Time), Member: k})
+		return nil
+	})
+	return err
+}
+
+func (r redisBackend) auditEvents(q AuditQuery, events *[]structs.AuditEvent) error {
+	by := redis.ZRangeBy{Min: "-inf", Max: "+inf", Count: redisAuditPage}
+	if q.Since != 0 {
+		by.Min = strconv.FormatInt(q.Since, 10)
+	}
+	if q.Until != 0 {
+		by.Max = "(" + strconv.FormatInt(q.Until, 10)
+	}
+	var page [][]byte
+	done := false
+	return collectAudit(q, func() ([]byte, []byte, error) {
+		for len(page) == 0 {
+			if done {
+				return nil, nil, nil
+			}
+			keys, err := redis.Client().ZRevRangeByScore(r.auditTimes(), &by).Result()
+			if err != nil {
+				return nil, nil, err
+			}
+			by.Offset += int64(len(keys))
+			done = len(keys) < redisAuditPage
+			if len(keys) == 0 {
+				continue
+			}
+			vals, err := redis.Client().HMGet(r.key(auditBucket), keys...).Result()
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, v := range vals {
+				// nil when it has been purged since the page was read
+				if s, ok := v.(string); ok {
+					page = append(page, []byte(s))
+				}
+			}
+		}
+		v := page[0]
+		page = page[1:]
+		// collectAudit only needs a key to tell the end apart
+		return []byte(r.key(auditBucket)), v, nil
+	}, events)
+}
+
+func (r redisBackend) purgeAudit(before int64) error {
+	max := "(" + strconv.FormatInt(before, 10)
+	keys, err := redis.Client().ZRangeByScore(r.auditTimes(), &redis.ZRangeBy{Min: "-inf", Max: max}).Result()
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	_, err = redis.Client().TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HDel(r.key(auditBucket), keys...)
+		pipe.ZRemRangeByScore(r.auditTimes(), "-inf", max)
+		return nil
+	})
+	return err
+}
+
+// the sql dbs keep the events in a table of their own, see sqlSchema, indexed for the queries of the audit log
+func (s sqlBackend) putAudit(e structs.AuditEvent) error {
+	val, err := encode(&e)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.q(`INSERT INTO audit_events (id, time, username, type, value) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET time = excluded.time, username = excluded.username, type = excluded.type, value = excluded.value`),
+		e.ID, e.Time, e.Username, e.Type, val)
+	return err
+}
+
+func (s sqlBackend) auditEvents(q AuditQuery, events *[]structs.AuditEvent) error {
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if q.Username != "" {
+		where = append(where, "username = ?")
+		args = append(args, q.Username)
+	}
+	if q.Type != "" {
+		where = append(where, "type = ?")
+		args = append(args, q.Type)
+	}
+	if q.Since != 0 {
+		where = append(where, "time >= ?")
+		args = append(args, q.Since)
+	}
+	if q.Until != 0 {
+		where = append(where, "time < ?")
+		args = append(args, q.Until)
+	}
+	query := `SELECT value FROM audit_events WHERE ` + strings.Join(where, " AND ") + ` ORDER BY time DESC, id DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+	rows, err := s.db.Query(s.q(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return collectAudit(q, func() ([]byte, []byte, error) {
+		if !rows.Next() {
+			return nil, nil, rows.Err()
+		}
+		var v []byte
+		if err := rows.Scan(&v); err != nil {
+			return nil, nil, err
+		}
+		// collectAudit only needs the key to tell the end apart
+		return []byte("row"), v, nil
+	}, events)
+}
+
+func (s sqlBackend) purgeAudit(before int64) error {
+	_, err := s.db.Exec(s.q(`DELETE FROM audit_events WHERE time < ?`), before)
+	return err
+}
@@ -0,0 +1,429 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// backend keeps the buckets of encoded records
+type backend interface {
+	// get returns ErrNotFound when there's no such key
+	get(bucket, key []byte) ([]byte, error)
+	put(bucket, key, val []byte) error
+	// putAll puts the records at once, in a single transaction where the backend has them
+	putAll(bucket []byte, records map[string][]byte) error
+	// update replaces the record at key with what fn makes of it, with nothing else writing to it in between
+	// returns ErrNotFound when there's no such key, and doesn't create one
+	update(bucket, key []byte, fn func(v []byte) ([]byte, error)) error
+	delete(bucket, key []byte) error
+	// take deletes the record at key and returns what it was, so that of two callers only one gets it
+	// returns ErrNotFound when there's no such key
+	take(bucket, key []byte) ([]byte, error)
+	// forEach calls fn for every record of the bucket in the order of the keys, returning errStop ends early
+	forEach(bucket []byte, fn func(k, v []byte) error) error
+	nextSequence(bucket []byte) (uint64, error)
+	// addActivity adds the counts to the ones kept in a single step, so that none of another flush's are lost
+	addActivity(activity []structs.Activity) error
+	allActivity(activity *[]structs.Activity) error
+	// the audit events are kept in the order of their time, so that a query only reads the window it asks for
+	putAudit(e structs.AuditEvent) error
+	auditEvents(q AuditQuery, events *[]structs.AuditEvent) error
+	purgeAudit(before int64) error
+	close() error
+}
+
+// errStop ends forEach without an error
+var errStop = errors.New("stop")
+
+// NewBoltStore opens the bolt dbfile, which only one process can have open at a time
+func NewBoltStore(dbfile string) (Store, error) {
+	log.Debugf("opening dbfile %s", dbfile)
+
+	opts := &bolt.Options{
+		Timeout: 50 * time.Millisecond,
+	}
+
+	db, err := bolt.Open(dbfile, 0644, opts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open dbfile %s, is another vouch-proxy using it? %s", dbfile, err)
+	}
+	s := kvStore{boltBackend{db}}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func getBucket(tx *bolt.Tx, key []byte) *bolt.Bucket {
+	b, err := tx.CreateBucketIfNotExists(key)
+	if err != nil {
+		log.Errorf("could not create bucket in db %s", err)
+		log.Errorf("check the dbfile permissions at %s", dbpath)
+		log.Errorf("if there's really something wrong with the data ./do.sh includes a utility to browse the dbfile")
+		return nil
+	}
+	return b
+}
+
+func (bb boltBackend) get(bucket, key []byte) ([]byte, error) {
+	var val []byte
+	err := bb.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return ErrNotFound
+		}
+		v := b.Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		// v is only valid during the transaction
+		val = append([]byte{}, v...)
+		return nil
+	})
+	return val, err
+}
+
+func (bb boltBackend) put(bucket, key, val []byte) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		b := getBucket(tx, bucket)
+		if b == nil {
+			return fmt.Errorf("no bucket for %s", bucket)
+		}
+		return b.Put(key, val)
+	})
+}
+
+func (bb boltBackend) putAll(bucket []byte, records map[string][]byte) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		b := getBucket(tx, bucket)
+		if b == nil {
+			return fmt.Errorf("no bucket for %s", bucket)
+		}
+		for k, v := range records {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bb boltBackend) update(bucket, key []byte, fn func(v []byte) ([]byte, error)) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return ErrNotFound
+		}
+		v := b.Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		val, err := fn(v)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, val)
+	})
+}
+
+func (bb boltBackend) take(bucket, key []byte) ([]byte, error) {
+	var val []byte
+	err := bb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return ErrNotFound
+		}
+		v := b.Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		val = append([]byte{}, v...)
+		return b.Delete(key)
+	})
+	return val, err
+}
+
+func (bb boltBackend) delete(bucket, key []byte) error {
+	return bb.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucket); b != nil {
+			return b.Delete(key)
+		}
+		return nil
+	})
+}
+
+func (bb boltBackend) forEach(bucket []byte, fn func(k, v []byte) error) error {
+	err := bb.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucket); b != nil {
+			return b.ForEach(fn)
+		}
+		return nil
+	})
+	if err == errStop {
+		return nil
+	}
+	return err
+}
+
+func (bb boltBackend) nextSequence(bucket []byte) (uint64, error) {
+	var id uint64
+	err := bb.db.Update(func(tx *bolt.Tx) error {
+		b := getBucket(tx, bucket)
+		if b == nil {
+			return fmt.Errorf("no bucket for %s", bucket)
+		}
+		var err error
+		id, err = b.NextSequence()
+		return err
+	})
+	return id, err
+}
+
+func (bb boltBackend) close() error {
+	return bb.db.Close()
+}
+
+// NewMemoryStore keeps everything in memory, for tests and for trying vouch-proxy out
+func NewMemoryStore() Store {
+	s := kvStore{&memBackend{
+		buckets:   make(map[string]map[string][]byte),
+		sequences: make(map[string]uint64),
+	}}
+	// nothing to migrate
+	s.setSchemaVersion(schemaVersion)
+	return s
+}
+
+type memBackend struct {
+	mu        sync.RWMutex
+	buckets   map[string]map[string][]byte
+	sequences map[string]uint64
+}
+
+func (m *memBackend) get(bucket, key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.buckets[string(bucket)][string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, v...), nil
+}
+
+func (m *memBackend) put(bucket, key, val []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.buckets[string(bucket)]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[string(bucket)] = b
+	}
+	b[string(key)] = append([]byte{}, val...)
+	return nil
+}
+
+func (m *memBackend) putAll(bucket []byte, records map[string][]byte) error {
+	for k, v := range records {
+		m.put(bucket, []byte(k), v)
+	}
+	return nil
+}
+
+func (m *memBackend) update(bucket, key []byte, fn func(v []byte) ([]byte, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.buckets[string(bucket)][string(key)]
+	if !ok {
+		return ErrNotFound
+	}
+	val, err := fn(append([]byte{}, v...))
+	if err != nil {
+		return err
+	}
+	m.buckets[string(bucket)][string(key)] = append([]byte{}, val...)
+	return nil
+}
+
+func (m *memBackend) delete(bucket, key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.buckets[string(bucket)], string(key))
+	return nil
+}
+
+func (m *memBackend) take(bucket, key []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.buckets[string(bucket)][string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(m.buckets[string(bucket)], string(key))
+	return v, nil
+}
+
+func (m *memBackend) forEach(bucket []byte, fn func(k, v []byte) error) error {
+	// a copy, fn may call back into the store
+	m.mu.RLock()
+	b := make(map[string][]byte, len(m.buckets[string(bucket)]))
+	for k, v := range m.buckets[string(bucket)] {
+		b[k] = v
+	}
+	m.mu.RUnlock()
+	return forEachSorted(b, fn)
+}
+
+func (m *memBackend) nextSequence(bucket []byte) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sequences[string(bucket)]++
+	return m.sequences[string(bucket)], nil
+}
+
+func (m *memBackend) close() error {
+	return nil
+}
+
+// forEachSorted calls fn in the order of the keys, as bolt does
+func forEachSorted(b map[string][]byte, fn func(k, v []byte) error) error {
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn([]byte(k), b[k]); err != nil {
+			if err == errStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// NewRedisStore keeps each bucket in a redis hash, see pkg/redis
+func NewRedisStore() (Store, error) {
+	s := kvStore{redisBackend{}}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type redisBackend struct{}
+
+// how often update tries again when the hash keeps changing underneath it
+const redisUpdateTries = 10
+
+func (redisBackend) key(bucket []byte) string {
+	return redis.Key("db", string(bucket))
+}
+
+func (r redisBackend) get(bucket, key []byte) ([]byte, error) {
+	val, err := redis.Client().HGet(r.key(bucket), string(key)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return val, err
+}
+
+func (r redisBackend) put(bucket, key, val []byte) error {
+	return redis.Client().HSet(r.key(bucket), string(key), val).Err()
+}
+
+func (r redisBackend) putAll(bucket []byte, records map[string][]byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+	fields := make([]interface{}, 0, 2*len(records))
+	for k, v := range records {
+		fields = append(fields, k, v)
+	}
+	return redis.Client().HSet(r.key(bucket), fields...).Err()
+}
+
+// update retries when the hash changed while fn ran
+func (r redisBackend) update(bucket, key []byte, fn func(v []byte) ([]byte, error)) error {
+	h := r.key(bucket)
+	for i := 0; i < redisUpdateTries; i++ {
+		err := redis.Client().Watch(func(tx *redis.Tx) error {
+			v, err := tx.HGet(h, string(key)).Bytes()
+			if err == redis.Nil {
+				return ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+			val, err := fn(v)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.HSet(h, string(key), val)
+				return nil
+			})
+			return err
+		}, h)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("gave up updating %s %s after %d tries", bucket, key, redisUpdateTries)
+}
+
+func (r redisBackend) delete(bucket, key []byte) error {
+	return redis.Client().HDel(r.key(bucket), string(key)).Err()
+}
+
+// take gets and deletes the field in a MULTI, which redis runs without anything in between
+func (r redisBackend) take(bucket, key []byte) ([]byte, error) {
+	h := r.key(bucket)
+	var get *redis.StringCmd
+	_, err := redis.Client().TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.HGet(h, string(key))
+		pipe.HDel(h, string(key))
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return get.Bytes()
+}
+
+func (r redisBackend) forEach(bucket []byte, fn func(k, v []byte) error) error {
+	all, err := redis.Client().HGetAll(r.key(bucket)).Result()
+	if err != nil {
+		return err
+	}
+	b := make(map[string][]byte, len(all))
+	for k, v := range all {
+		b[k] = []byte(v)
+	}
+	return forEachSorted(b, fn)
+}
+
+func (r redisBackend) nextSequence(bucket []byte) (uint64, error) {
+	id, err := redis.Client().Incr(r.key(bucket) + ":sequence").Result()
+	return uint64(id), err
+}
+
+// the connection is shared with the rest of vouch-proxy, see redis.Close
+func (redisBackend) close() error {
+	return nil
+}
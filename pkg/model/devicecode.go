@@ -0,0 +1,122 @@
+package model
+
+import (
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// PutDeviceCode - create or update a pending device authorization, keyed by its hash
+// and indexed by its user code in deviceUserCodeBucket
+// the index is written last, so an entry of it always leads to an authorization which was put
+func (s kvStore) PutDeviceCode(dc structs.DeviceCode) error {
+	if err := s.put(deviceCodeBucket, []byte(dc.Hash), &dc); err != nil {
+		return err
+	}
+	return s.b.put(deviceUserCodeBucket, []byte(dc.UserCode), []byte(dc.Hash))
+}
+
+// DeviceCode lookup a device authorization from the hash of the device_code
+func (s kvStore) DeviceCode(key []byte, dc *structs.DeviceCode) error {
+	return s.get(deviceCodeBucket, key, dc)
+}
+
+// DeviceCodeByUserCode lookup the unexpired device authorization the user was shown userCode for
+func (s kvStore) DeviceCodeByUserCode(userCode string, now int64, dc *structs.DeviceCode) error {
+	key, err := s.b.get(deviceUserCodeBucket, []byte(userCode))
+	if err != nil {
+		return err
+	}
+	d := structs.DeviceCode{}
+	if err := s.get(deviceCodeBucket, key, &d); err != nil {
+		return err
+	}
+	// the user code of an expired authorization may have been handed out again
+	if d.UserCode != userCode || d.ExpiresOn <= now {
+		return ErrNotFound
+	}
+	*dc = d
+	return nil
+}
+
+// UpdateDeviceCode sets the device authorization at key to what fn makes of it, unless it has been taken
+// returns ErrNotFound when it has, rather than putting it back
+func (s kvStore) UpdateDeviceCode(key []byte, fn func(dc *structs.DeviceCode) error) error {
+	return s.b.update(deviceCodeBucket, key, func(v []byte) ([]byte, error) {
+		dc := structs.DeviceCode{}
+		if err := decode(v, &dc); err != nil {
+			return nil, err
+		}
+		if err := fn(&dc); err != nil {
+			return nil, err
+		}
+		return encode(&dc)
+	})
+}
+
+// TakeDeviceCode deletes the device authorization at key and returns it in dc
+// of the devices polling at the same time only one takes it, the others get ErrNotFound
+func (s kvStore) TakeDeviceCode(key []byte, dc *structs.DeviceCode) error {
+	v, err := s.b.take(deviceCodeBucket, key)
+	if err != nil {
+		return err
+	}
+	if err := decode(v, dc); err != nil {
+		return err
+	}
+	return s.deleteUserCode(*dc)
+}
+
+// DeleteDeviceCode from key
+func (s kvStore) DeleteDeviceCode(dc structs.DeviceCode) error {
+	if err := s.b.delete(deviceCodeBucket, []byte(dc.Hash)); err != nil {
+		return err
+	}
+	return s.deleteUserCode(dc)
+}
+
+// deleteUserCode removes the user code of dc from the index, unless it has been handed out again since
+func (s kvStore) deleteUserCode(dc structs.DeviceCode) error {
+	key, err := s.b.get(deviceUserCodeBucket, []byte(dc.UserCode))
+	if err == ErrNotFound || (err == nil && string(key) != dc.Hash) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.b.delete(deviceUserCodeBucket, []byte(dc.UserCode))
+}
+
+// PurgeDeviceCodes deletes the device authorizations which expired before now, and the user codes
+// which no longer lead to one
+func (s kvStore) PurgeDeviceCodes(now int64) error {
+	if err := s.purge(deviceCodeBucket, func(v []byte) bool {
+		d := structs.DeviceCode{}
+		return decode(v, &d) != nil || d.ExpiresOn <= now
+	}); err != nil {
+		return err
+	}
+	// the index is read before the authorizations, and neither is read from within the other's forEach,
+	// which would nest a bolt transaction
+	index := []structs.DeviceCode{}
+	if err := s.b.forEach(deviceUserCodeBucket, func(k, v []byte) error {
+		index = append(index, structs.DeviceCode{UserCode: string(k), Hash: string(v)})
+		return nil
+	}); err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	if err := s.b.forEach(deviceCodeBucket, func(k, v []byte) error {
+		live[string(k)] = true
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, dc := range index {
+		if live[dc.Hash] {
+			continue
+		}
+		if err := s.deleteUserCode(dc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package model
+
+// records are kept as versioned json
+//
+//   {"v":1,"data":{"Username":"alice@yourdomain.com","Name":"Alice","CreatedOn":1600000000,"ID":1}}
+//
+// the fields are named after the fields of the structs, not their json tags, which leave out fields such as
+// User.ID and Session.Token. Fields which the struct doesn't have are ignored and missing fields are left at their
+// zero value, so adding a field needs no migration. Renaming or retyping one does, see migrate.go
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+type record struct {
+	V    int                        `json:"v"`
+	Data map[string]json.RawMessage `json:"data"`
+}
+
+func encode(v interface{}) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, ErrBadValue
+	}
+	rec := record{V: schemaVersion, Data: make(map[string]json.RawMessage)}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		if rt.Field(i).PkgPath != "" {
+			continue
+		}
+		b, err := json.Marshal(rv.Field(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		rec.Data[rt.Field(i).Name] = b
+	}
+	return json.Marshal(rec)
+}
+
+func decode(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return ErrBadValue
+	}
+	if !isJSON(data) {
+		return fmt.Errorf("record is not json, the db may need to be migrated")
+	}
+	rec := record{}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	if rec.V > schemaVersion {
+		return fmt.Errorf("record version %d is newer than this vouch-proxy supports (%d)", rec.V, schemaVersion)
+	}
+	rv = rv.Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		raw, ok := rec.Data[rt.Field(i).Name]
+		if !ok || rt.Field(i).PkgPath != "" {
+			continue
+		}
+		if err := json.Unmarshal(raw, rv.Field(i).Addr().Interface()); err != nil {
+			return fmt.Errorf("%s.%s: %s", rt.Name(), rt.Field(i).Name, err)
+		}
+	}
+	return nil
+}
+
+// isJSON tells versioned json records from the gob encoded records of schema version 0
+func isJSON(data []byte) bool {
+	return len(data) > 0 && data[0] == '{'
+}
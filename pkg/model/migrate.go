@@ -0,0 +1,152 @@
+package model
+
+// migrations run when the store is opened, bringing the records up to schemaVersion
+//
+// the version of the db is kept in the meta bucket. A db written by a newer vouch-proxy is refused rather than
+// read, so downgrade by restoring a backup of the db from before the upgrade
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strconv"
+
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+type migration struct {
+	description string
+	migrate     func(s kvStore) error
+}
+
+// schemaVersion of the records written by this vouch-proxy, len(migrations)
+const schemaVersion = 2
+
+// migrations[i] brings the db from version i to i+1, add new ones at the end
+var migrations = []migration{
+	{"gob encoded records to versioned json", gobToJSON},
+	{"audit events ordered by their time", auditByTime},
+}
+
+var schemaVersionKey = []byte("schemaVersion")
+
+// SchemaVersion returns the version of the db
+func SchemaVersion(s Store) (int, error) {
+	kv, ok := s.(kvStore)
+	if !ok {
+		return 0, ErrBadValue
+	}
+	return kv.schemaVersion()
+}
+
+func (s kvStore) schemaVersion() (int, error) {
+	v, err := s.b.get(metaBucket, schemaVersionKey)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(v))
+}
+
+func (s kvStore) setSchemaVersion(version int) error {
+	return s.b.put(metaBucket, schemaVersionKey, []byte(strconv.Itoa(version)))
+}
+
+// migrate runs the migrations the db hasn't had yet
+func (s kvStore) migrate() error {
+	version, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("the db has schema version %d, which is newer than this vouch-proxy supports (%d). Refusing to downgrade it", version, schemaVersion)
+	}
+	for ; version < schemaVersion; version++ {
+		m := migrations[version]
+		log.Infof("migrating the db to schema version %d: %s", version+1, m.description)
+		if err := m.migrate(s); err != nil {
+			return fmt.Errorf("migrating the db to schema version %d: %s", version+1, err)
+		}
+		if err := s.setSchemaVersion(version + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gobToJSON re-encodes the gob records of each bucket, records which already are json are left as they are,
+// so that it can be run again once a record which can't be decoded is taken care of
+func gobToJSON(s kvStore) error {
+	for bucket, newRecord := range map[string]func() interface{}{
+		string(userBucket):         func() interface{} { return &structs.User{} },
+		string(teamBucket):         func() interface{} { return &structs.Team{} },
+		string(siteBucket):         func() interface{} { return &structs.Site{} },
+		string(serviceTokenBucket): func() interface{} { return &structs.ServiceToken{} },
+		string(deviceCodeBucket):   func() interface{} { return &structs.DeviceCode{} },
+		string(sessionBucket):      func() interface{} { return &structs.Session{} },
+		string(auditBucket):        func() interface{} { return &structs.AuditEvent{} },
+		string(activityBucket):     func() interface{} { return &structs.Activity{} },
+	} {
+		// put from within forEach isn't safe, collect the records first
+		old := map[string][]byte{}
+		if err := s.b.forEach([]byte(bucket), func(k, v []byte) error {
+			if !isJSON(v) {
+				old[string(k)] = append([]byte{}, v...)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		// decode all of them before writing any, a record which can't be decoded stops the migration
+		// so that it can be looked into and the db restored from a backup rather than losing the record
+		recs := map[string]interface{}{}
+		for k, v := range old {
+			rec := newRecord()
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(rec); err != nil {
+				return fmt.Errorf("%s %s can't be decoded: %s", bucket, k, err)
+			}
+			recs[k] = rec
+		}
+		for k, rec := range recs {
+			if err := s.put([]byte(bucket), []byte(k), rec); err != nil {
+				return err
+			}
+		}
+		if len(old) > 0 {
+			log.Infof("migrated %d %s", len(old), bucket)
+		}
+	}
+	return nil
+}
+
+// auditByTime moves the audit events keyed by their ID to where putAudit keeps them
+func auditByTime(s kvStore) error {
+	old := map[string]structs.AuditEvent{}
+	if err := s.b.forEach(auditBucket, func(k, v []byte) error {
+		if bytes.IndexByte(k, '-') >= 0 {
+			return nil
+		}
+		e := structs.AuditEvent{}
+		if err := decode(v, &e); err != nil {
+			return fmt.Errorf("%s %s can't be decoded: %s", auditBucket, k, err)
+		}
+		old[string(k)] = e
+		return nil
+	}); err != nil {
+		return err
+	}
+	for k, e := range old {
+		if err := s.b.putAudit(e); err != nil {
+			return err
+		}
+		if err := s.b.delete(auditBucket, []byte(k)); err != nil {
+			return err
+		}
+	}
+	if len(old) > 0 {
+		log.Infof("migrated %d %s", len(old), auditBucket)
+	}
+	return nil
+}
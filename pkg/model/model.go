@@ -2,15 +2,15 @@ package model
 
 // modeled after
 // https://www.opsdash.com/blog/persistent-key-value-store-golang.html
+//
+// the records are kept in buckets of a key value backend: the bolt file, memory, redis or an sql table
 
 import (
 	"errors"
-	"flag"
 	"path/filepath"
-	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
 )
 
 var (
@@ -22,53 +22,125 @@ var (
 	// is nil.
 	ErrBadValue = errors.New("bad value")
 
-	//Db holds the db
-	Db *bolt.DB
-
-	// dbpath string
-
 	userBucket = []byte("users")
 	teamBucket = []byte("teams")
 	siteBucket = []byte("sites")
 	dbpath     = filepath.Join(cfg.RootDir, cfg.Cfg.DB.File)
 
+	serviceTokenBucket = []byte("servicetokens")
+	deviceCodeBucket   = []byte("devicecodes")
+	// the hash of the device code for each user code
+	deviceUserCodeBucket = []byte("deviceusercodes")
+	sessionBucket        = []byte("sessions")
+	auditBucket          = []byte("audit")
+	activityBucket       = []byte("activity")
+	metaBucket           = []byte("meta")
+
 	log = cfg.Cfg.Logger
 )
 
-// may want to use encode/gob to store the user record
-func init() {
-	// in testing we open the dbfile from _test.go explicitly
-	if flag.Lookup("test.v") != nil {
-		return
+// Store keeps the users, teams, sites, service tokens, device codes, server side sessions and audit events
+type Store interface {
+	PutUser(u structs.User) error
+	User(key []byte, u *structs.User) error
+	AllUsers(users *[]structs.User) error
+
+	PutTeam(t structs.Team) error
+	Team(key []byte, t *structs.Team) error
+	DeleteTeam(t structs.Team) error
+	AllTeams(teams *[]structs.Team) error
+
+	PutSite(s structs.Site) error
+	Site(key []byte, s *structs.Site) error
+	AllSites(sites *[]structs.Site) error
+
+	PutServiceToken(st structs.ServiceToken) error
+	ServiceToken(key []byte, st *structs.ServiceToken) error
+	TouchServiceToken(key []byte, lastUsed int64) error
+	DeleteServiceToken(st structs.ServiceToken) error
+	AllServiceTokens(tokens *[]structs.ServiceToken) error
+
+	PutDeviceCode(dc structs.DeviceCode) error
+	DeviceCode(key []byte, dc *structs.DeviceCode) error
+	DeviceCodeByUserCode(userCode string, now int64, dc *structs.DeviceCode) error
+	UpdateDeviceCode(key []byte, fn func(dc *structs.DeviceCode) error) error
+	TakeDeviceCode(key []byte, dc *structs.DeviceCode) error
+	DeleteDeviceCode(dc structs.DeviceCode) error
+	PurgeDeviceCodes(now int64) error
+
+	PutSession(s structs.Session) error
+	Session(key []byte, s *structs.Session) error
+	DeleteSession(s structs.Session) error
+	AllSessions(sessions *[]structs.Session) error
+	PurgeSessions(now int64) error
+
+	PutAuditEvent(e structs.AuditEvent) error
+	AuditEvents(q AuditQuery, events *[]structs.AuditEvent) error
+	PurgeAuditEvents(before int64) error
+
+	AddActivity(activity []structs.Activity) error
+	AllActivity(activity *[]structs.Activity) error
+
+	Close() error
+}
+
+// Open the store configured in `vouch.db.store`
+func Open() (Store, error) {
+	switch cfg.Cfg.DB.Store {
+	case "memory":
+		log.Warn("the db is kept in memory and is lost when vouch-proxy stops")
+		return NewMemoryStore(), nil
+	case "redis":
+		return NewRedisStore()
+	case "sqlite", "postgres":
+		return NewSQLStore(cfg.Cfg.DB.Store, cfg.Cfg.DB.DSN)
 	}
-	Db, _ = OpenDB(dbpath)
+	return NewBoltStore(dbpath)
 }
 
-// OpenDB the boltdb
-func OpenDB(dbfile string) (*bolt.DB, error) {
+// kvStore implements Store on top of a backend
+type kvStore struct {
+	b backend
+}
 
-	log.Debugf("opening dbfile %s", dbfile)
+func (s kvStore) Close() error {
+	return s.b.close()
+}
 
-	opts := &bolt.Options{
-		Timeout: 50 * time.Millisecond,
+// get decodes the record at key into v
+func (s kvStore) get(bucket, key []byte, v interface{}) error {
+	val, err := s.b.get(bucket, key)
+	if err != nil {
+		return err
 	}
+	return decode(val, v)
+}
 
-	db, err := bolt.Open(dbfile, 0644, opts)
+func (s kvStore) put(bucket, key []byte, v interface{}) error {
+	val, err := encode(v)
 	if err != nil {
-		log.Panicf("unable to open dbfile %s: %s", dbfile, err.Error())
-		return nil, err
+		log.Error(err)
+		return err
 	}
-	return db, nil
-
+	return s.b.put(bucket, key, val)
 }
 
-func getBucket(tx *bolt.Tx, key []byte) *bolt.Bucket {
-	b, err := tx.CreateBucketIfNotExists(key)
-	if err != nil {
-		log.Errorf("could not create bucket in db %s", err)
-		log.Errorf("check the dbfile permissions at %s", dbpath)
-		log.Errorf("if there's really something wrong with the data ./do.sh includes a utility to browse the dbfile")
+// purge deletes the records of the bucket for which expired is true
+func (s kvStore) purge(bucket []byte, expired func(v []byte) bool) error {
+	// deleting from within forEach isn't safe, collect the keys first
+	keys := [][]byte{}
+	if err := s.b.forEach(bucket, func(k, v []byte) error {
+		if expired(v) {
+			keys = append(keys, append([]byte{}, k...))
+		}
 		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := s.b.delete(bucket, k); err != nil {
+			return err
+		}
 	}
-	return b
+	return nil
 }
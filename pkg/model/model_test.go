@@ -4,120 +4,598 @@ package model
 // https://www.opsdash.com/blog/persistent-key-value-store-golang.html
 
 import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/redis"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 )
 
-var testdb = "/tmp/storage-test.db"
-
 func init() {
 	cfg.InitForTestPurposes()
-
-	Db, _ = OpenDB(testdb)
 }
 
-func TestPutUserGetUser(t *testing.T) {
-	os.Remove(testdb)
-	Db, _ = OpenDB(testdb)
-
-	u1 := structs.User{
-		Username: "test@testing.com",
-		Name:     "Test Name",
+// forEachStore runs test against a fresh store of each kind
+// set VOUCH_TEST_POSTGRES_DSN to include postgres
+func forEachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	dir, err := ioutil.TempDir("", "vouch-model")
+	if err != nil {
+		t.Fatal(err)
 	}
-	u2 := &structs.User{}
-	u3 := structs.User{
-		Username: "testagain@testing.com",
-		Name:     "Test Again",
+	defer os.RemoveAll(dir)
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer mr.Close()
+	cfg.Cfg.Redis.Addr = mr.Addr()
+	defer redis.Close()
 
-	if err := PutUser(u1); err != nil {
-		log.Error("PutUser u1: " + err.Error())
+	stores := map[string]func() (Store, error){
+		"memory": func() (Store, error) { return NewMemoryStore(), nil },
+		"bolt":   func() (Store, error) { return NewBoltStore(filepath.Join(dir, t.Name()+".db")) },
+		"sqlite": func() (Store, error) { return NewSQLStore("sqlite", filepath.Join(dir, t.Name()+".sqlite")) },
+		"redis": func() (Store, error) {
+			mr.FlushAll()
+			return NewRedisStore()
+		},
 	}
-	User([]byte(u1.Username), u2)
-	if err := PutUser(u3); err != nil {
-		log.Error("PutUser u3: " + err.Error())
+	if dsn := os.Getenv("VOUCH_TEST_POSTGRES_DSN"); dsn != "" {
+		stores["postgres"] = func() (Store, error) {
+			s, err := NewSQLStore("postgres", dsn)
+			if err == nil {
+				_, err = s.(kvStore).b.(sqlBackend).db.Exec(`DELETE FROM vouch_records; DELETE FROM vouch_sequences; DELETE FROM audit_events`)
+			}
+			return s, err
+		}
 	}
-	log.Debugf("user retrieved: %v", *u2)
-	assert.Equal(t, u1.Username, u2.Username)
 
-	if err := PutUser(u3); err != nil {
-		log.Error(err)
-	}
-	var users []structs.User
-	if err := AllUsers(&users); err != nil {
-		log.Error(err)
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			s, err := open()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer s.Close()
+			test(t, s)
+		})
 	}
-	assert.Len(t, users, 2)
 }
 
-func TestPutSiteGetSite(t *testing.T) {
-	os.Remove(testdb)
-	Db, _ = OpenDB(testdb)
+func TestPutUserGetUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		u1 := structs.User{
+			Username: "test@testing.com",
+			Name:     "Test Name",
+		}
+		u2 := &structs.User{}
+		u3 := structs.User{
+			Username: "testagain@testing.com",
+			Name:     "Test Again",
+		}
 
-	s1 := structs.Site{Domain: "test.bnf.net"}
-	s2 := &structs.Site{}
+		if err := s.PutUser(u1); err != nil {
+			log.Error("PutUser u1: " + err.Error())
+		}
+		s.User([]byte(u1.Username), u2)
+		if err := s.PutUser(u3); err != nil {
+			log.Error("PutUser u3: " + err.Error())
+		}
+		log.Debugf("user retrieved: %v", *u2)
+		assert.Equal(t, u1.Username, u2.Username)
 
-	if err := PutSite(s1); err != nil {
-		log.Error(err)
-	}
-	Site([]byte(s1.Domain), s2)
-	log.Debugf("site retrieved: %v", *s2)
-	assert.Equal(t, s1.Domain, s2.Domain)
+		if err := s.PutUser(u3); err != nil {
+			log.Error(err)
+		}
+		var users []structs.User
+		if err := s.AllUsers(&users); err != nil {
+			log.Error(err)
+		}
+		assert.Len(t, users, 2)
+	})
+}
+
+func TestPutSiteGetSite(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		s1 := structs.Site{Domain: "test.bnf.net"}
+		s2 := &structs.Site{}
+
+		if err := s.PutSite(s1); err != nil {
+			log.Error(err)
+		}
+		s.Site([]byte(s1.Domain), s2)
+		log.Debugf("site retrieved: %v", *s2)
+		assert.Equal(t, s1.Domain, s2.Domain)
+	})
 }
 
 func TestPutTeamGetTeamDeleteTeam(t *testing.T) {
-	os.Remove(testdb)
-	Db, _ = OpenDB(testdb)
-
-	t1 := structs.Team{Name: "testteam1"}
-	t2 := &structs.Team{}
-	t3 := &structs.Team{}
-	t4 := structs.Team{Name: "testteam4"}
-	t5 := structs.Team{Name: "testteam5"}
-
-	var err error
-	if err = PutTeam(t1); err != nil {
-		log.Error(err)
+	forEachStore(t, func(t *testing.T, s Store) {
+		t1 := structs.Team{Name: "testteam1"}
+		t2 := &structs.Team{}
+		t3 := &structs.Team{}
+		t4 := structs.Team{Name: "testteam4"}
+		t5 := structs.Team{Name: "testteam5"}
+
+		var err error
+		if err = s.PutTeam(t1); err != nil {
+			log.Error(err)
+		}
+		s.Team([]byte(t1.Name), t2)
+		log.Debugf("team retrieved: %v", *t2)
+		assert.Equal(t, t1.Name, t2.Name)
+
+		if err = s.DeleteTeam(t1); err != nil {
+			log.Error(err)
+		}
+		// should fail
+		err = s.Team([]byte(t1.Name), t3)
+		assert.Error(t, err)
+
+		err = s.PutTeam(t1)
+		assert.NoError(t, err)
+		err = s.PutTeam(t4)
+		assert.NoError(t, err)
+		err = s.PutTeam(t5)
+		assert.NoError(t, err)
+
+		var teams []structs.Team
+		err = s.AllTeams(&teams)
+		log.Debugf("TestPutTeamGetTeamDeleteTeam:\nteam: %+v\nteams: %+v", t1, teams)
+		// assert.NotContains(t, teams, t1)
+
+		teamNames := make([]string, len(teams))
+		for _, teamV := range teams {
+			teamNames = append(teamNames, teamV.Name)
+		}
+
+		s.Team([]byte(t1.Name), &t1)
+		assert.Contains(t, teamNames, t1.Name)
+
+		// assert.Contains(t, teams, t4)
+		// assert.Contains(t, teams, t5)
+
+		assert.NoError(t, err)
+
+	})
+}
+
+func TestPutServiceTokenGetServiceTokenDeleteServiceToken(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		st1 := structs.ServiceToken{Name: "ci-deploy", Hash: "abc123", Scopes: []string{"api.example.com"}}
+		st2 := &structs.ServiceToken{}
+
+		assert.Equal(t, ErrNotFound, s.ServiceToken([]byte(st1.Hash), st2))
+
+		assert.NoError(t, s.PutServiceToken(st1))
+		assert.NoError(t, s.ServiceToken([]byte(st1.Hash), st2))
+		assert.Equal(t, st1.Name, st2.Name)
+		assert.Equal(t, st1.Scopes, st2.Scopes)
+		assert.NotZero(t, st2.ID)
+
+		// updates keep the ID
+		st2.LastUsed = 1234
+		assert.NoError(t, s.PutServiceToken(*st2))
+		st3 := &structs.ServiceToken{}
+		assert.NoError(t, s.ServiceToken([]byte(st1.Hash), st3))
+		assert.Equal(t, st2.ID, st3.ID)
+		assert.Equal(t, int64(1234), st3.LastUsed)
+
+		assert.NoError(t, s.PutServiceToken(structs.ServiceToken{Name: "cron", Hash: "def456"}))
+		var tokens []structs.ServiceToken
+		assert.NoError(t, s.AllServiceTokens(&tokens))
+		assert.Len(t, tokens, 2)
+
+		assert.NoError(t, s.TouchServiceToken([]byte(st1.Hash), 5678))
+		assert.NoError(t, s.ServiceToken([]byte(st1.Hash), st3))
+		assert.Equal(t, int64(5678), st3.LastUsed)
+		assert.Equal(t, st1.Scopes, st3.Scopes)
+
+		assert.NoError(t, s.DeleteServiceToken(st1))
+		assert.Equal(t, ErrNotFound, s.ServiceToken([]byte(st1.Hash), st3))
+		// a deleted token isn't put back
+		assert.Equal(t, ErrNotFound, s.TouchServiceToken([]byte(st1.Hash), 9012))
+		assert.Equal(t, ErrNotFound, s.ServiceToken([]byte(st1.Hash), st3))
+	})
+}
+
+func TestDeviceCodes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		dc1 := structs.DeviceCode{Hash: "hash1", UserCode: "BCDFGHJK", ExpiresOn: 200}
+		dc2 := structs.DeviceCode{Hash: "hash2", UserCode: "LMNPQRST", ExpiresOn: 100}
+		assert.NoError(t, s.PutDeviceCode(dc1))
+		assert.NoError(t, s.PutDeviceCode(dc2))
+
+		got := structs.DeviceCode{}
+		assert.NoError(t, s.DeviceCode([]byte("hash1"), &got))
+		assert.Equal(t, dc1, got)
+
+		assert.NoError(t, s.DeviceCodeByUserCode("LMNPQRST", 50, &got))
+		assert.Equal(t, dc2, got)
+		// expired
+		assert.Equal(t, ErrNotFound, s.DeviceCodeByUserCode("LMNPQRST", 150, &got))
+
+		// an index entry left behind by an authorization which is gone
+		assert.NoError(t, s.(kvStore).b.put(deviceUserCodeBucket, []byte("VWXZBCDF"), []byte("hash3")))
+
+		assert.NoError(t, s.PurgeDeviceCodes(150))
+		assert.Equal(t, ErrNotFound, s.DeviceCode([]byte("hash2"), &got))
+		assert.NoError(t, s.DeviceCode([]byte("hash1"), &got))
+		// the user codes go with them
+		_, err := s.(kvStore).b.get(deviceUserCodeBucket, []byte("LMNPQRST"))
+		assert.Equal(t, ErrNotFound, err)
+		_, err = s.(kvStore).b.get(deviceUserCodeBucket, []byte("VWXZBCDF"))
+		assert.Equal(t, ErrNotFound, err)
+		assert.NoError(t, s.DeviceCodeByUserCode("BCDFGHJK", 150, &got))
+
+		assert.NoError(t, s.DeleteDeviceCode(dc1))
+		assert.Equal(t, ErrNotFound, s.DeviceCode([]byte("hash1"), &got))
+		assert.Equal(t, ErrNotFound, s.DeviceCodeByUserCode("BCDFGHJK", 150, &got))
+	})
+}
+
+func TestTakeDeviceCode(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		dc := structs.DeviceCode{Hash: "hash1", UserCode: "BCDFGHJK", ExpiresOn: 200}
+		assert.NoError(t, s.PutDeviceCode(dc))
+		assert.NoError(t, s.UpdateDeviceCode([]byte("hash1"), func(dc *structs.DeviceCode) error {
+			dc.Token = "the.vouch.jwt"
+			return nil
+		}))
+
+		// two devices polling at once
+		var wg sync.WaitGroup
+		taken := make(chan structs.DeviceCode, 2)
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got := structs.DeviceCode{}
+				if err := s.TakeDeviceCode([]byte("hash1"), &got); err == nil {
+					taken <- got
+				} else {
+					assert.Equal(t, ErrNotFound, err)
+				}
+			}()
+		}
+		wg.Wait()
+		close(taken)
+		if assert.Len(t, taken, 1) {
+			assert.Equal(t, "the.vouch.jwt", (<-taken).Token)
+		}
+
+		// a poll which read it before it was taken doesn't put it back
+		assert.Equal(t, ErrNotFound, s.UpdateDeviceCode([]byte("hash1"), func(dc *structs.DeviceCode) error {
+			dc.LastPoll = 100
+			return nil
+		}))
+		assert.Equal(t, ErrNotFound, s.DeviceCode([]byte("hash1"), &structs.DeviceCode{}))
+		assert.Equal(t, ErrNotFound, s.DeviceCodeByUserCode("BCDFGHJK", 150, &structs.DeviceCode{}))
+	})
+}
+
+func TestSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		s1 := structs.Session{Hash: "hash1", Username: "alice", Token: "alice.vouch.jwt", ExpiresOn: 200}
+		s2 := structs.Session{Hash: "hash2", Username: "bob", Token: "bob.vouch.jwt", ExpiresOn: 100}
+		assert.NoError(t, s.PutSession(s1))
+		assert.NoError(t, s.PutSession(s2))
+
+		got := structs.Session{}
+		assert.NoError(t, s.Session([]byte("hash1"), &got))
+		assert.Equal(t, s1, got)
+
+		all := []structs.Session{}
+		assert.NoError(t, s.AllSessions(&all))
+		assert.Len(t, all, 2)
+
+		assert.NoError(t, s.PurgeSessions(150))
+		assert.Equal(t, ErrNotFound, s.Session([]byte("hash2"), &got))
+
+		assert.NoError(t, s.DeleteSession(s1))
+		assert.Equal(t, ErrNotFound, s.Session([]byte("hash1"), &got))
+	})
+}
+
+func TestAuditEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		for i, e := range []structs.AuditEvent{
+			{Time: 100, Type: "login", Username: "alice"},
+			{Time: 200, Type: "denied", Username: "bob", Reason: "not in team"},
+			{Time: 300, Type: "login", Username: "bob"},
+			{Time: 400, Type: "logout", Username: "alice"},
+		} {
+			assert.NoError(t, s.PutAuditEvent(e), i)
+		}
+
+		all := []structs.AuditEvent{}
+		assert.NoError(t, s.AuditEvents(AuditQuery{}, &all))
+		if assert.Len(t, all, 4) {
+			// oldest first
+			assert.Equal(t, int64(100), all[0].Time)
+			assert.Equal(t, "not in team", all[1].Reason)
+			assert.NotEqual(t, all[0].ID, all[1].ID)
+		}
+
+		bob := []structs.AuditEvent{}
+		assert.NoError(t, s.AuditEvents(AuditQuery{Username: "bob", Type: "login"}, &bob))
+		if assert.Len(t, bob, 1) {
+			assert.Equal(t, int64(300), bob[0].Time)
+		}
+
+		window := []structs.AuditEvent{}
+		assert.NoError(t, s.AuditEvents(AuditQuery{Since: 200, Until: 400, Limit: 1}, &window))
+		if assert.Len(t, window, 1) {
+			assert.Equal(t, int64(300), window[0].Time)
+		}
+
+		until := []structs.AuditEvent{}
+		assert.NoError(t, s.AuditEvents(AuditQuery{Until: 300}, &until))
+		if assert.Len(t, until, 2) {
+			assert.Equal(t, int64(200), until[1].Time)
+		}
+
+		assert.NoError(t, s.PurgeAuditEvents(250))
+		all = all[:0]
+		assert.NoError(t, s.AuditEvents(AuditQuery{}, &all))
+		assert.Len(t, all, 2)
+	})
+}
+
+// the most recent events of a user who hasn't been seen for a while, among many of others
+func TestAuditEventsLimit(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		assert.NoError(t, s.PutAuditEvent(structs.AuditEvent{Time: 10, Type: "login", Username: "alice"}))
+		assert.NoError(t, s.PutAuditEvent(structs.AuditEvent{Time: 20, Type: "logout", Username: "alice"}))
+		for i := 0; i < 3*redisAuditPage; i++ {
+			// several to a second
+			assert.NoError(t, s.PutAuditEvent(structs.AuditEvent{Time: int64(100 + i/4), Type: "login", Username: "bob"}))
+		}
+
+		alice := []structs.AuditEvent{}
+		assert.NoError(t, s.AuditEvents(AuditQuery{Username: "alice", Limit: 1}, &alice))
+		if assert.Len(t, alice, 1) {
+			assert.Equal(t, "logout", alice[0].Type)
+		}
+
+		bob := []structs.AuditEvent{}
+		assert.NoError(t, s.AuditEvents(AuditQuery{Username: "bob", Since: 101, Limit: 3}, &bob))
+		if assert.Len(t, bob, 3) {
+			// oldest first, in the order they were put within the same second
+			assert.Equal(t, int64(100+(3*redisAuditPage-1)/4), bob[2].Time)
+			assert.True(t, bob[0].ID < bob[1].ID && bob[1].ID < bob[2].ID)
+		}
+
+		window := []structs.AuditEvent{}
+		assert.NoError(t, s.AuditEvents(AuditQuery{Since: 101, Until: 103}, &window))
+		assert.Len(t, window, 8)
+	})
+}
+
+func TestBoltStoreLocked(t *testing.T) {
+	f, err := ioutil.TempFile("", "vouch-model-locked")
+	if err != nil {
+		t.Fatal(err)
 	}
-	Team([]byte(t1.Name), t2)
-	log.Debugf("team retrieved: %v", *t2)
-	assert.Equal(t, t1.Name, t2.Name)
+	f.Close()
+	defer os.Remove(f.Name())
 
-	if err = DeleteTeam(t1); err != nil {
-		log.Error(err)
+	s, err := NewBoltStore(f.Name())
+	if !assert.NoError(t, err) {
+		return
 	}
-	// should fail
-	err = Team([]byte(t1.Name), t3)
+	defer s.Close()
+	// no panic, an error
+	_, err = NewBoltStore(f.Name())
 	assert.Error(t, err)
+}
 
-	err = PutTeam(t1)
-	assert.NoError(t, err)
-	err = PutTeam(t4)
+func TestSQLPlaceholders(t *testing.T) {
+	q := `SELECT value FROM vouch_records WHERE bucket = ? AND key = ?`
+	assert.Equal(t, q, sqlBackend{dialect: "sqlite"}.q(q))
+	assert.Equal(t, `SELECT value FROM vouch_records WHERE bucket = $1 AND key = $2`, sqlBackend{dialect: "postgres"}.q(q))
+}
+
+func TestEncodeDecode(t *testing.T) {
+	u := structs.User{Username: "alice", Name: "Alice", CreatedOn: 100, ID: 7}
+	data, err := encode(&u)
 	assert.NoError(t, err)
-	err = PutTeam(t5)
+	assert.Contains(t, string(data), fmt.Sprintf(`"v":%d`, schemaVersion))
+	// the fields json:"-" leaves out are kept
+	assert.Contains(t, string(data), `"ID":7`)
+
+	got := structs.User{}
+	assert.NoError(t, decode(data, &got))
+	assert.Equal(t, u, got)
+
+	s := structs.Session{Hash: "hash1", Token: "alice.vouch.jwt"}
+	data, _ = encode(s)
+	gotS := structs.Session{}
+	assert.NoError(t, decode(data, &gotS))
+	assert.Equal(t, s, gotS)
+
+	// fields which are gone are ignored, new fields are left empty
+	assert.NoError(t, decode([]byte(`{"v":1,"data":{"Username":"bob","Nickname":"bobby"}}`), &got))
+	assert.Equal(t, structs.User{Username: "bob"}, got)
+
+	assert.Error(t, decode([]byte(fmt.Sprintf(`{"v":%d,"data":{"Username":"bob"}}`, schemaVersion+1)), &got))
+	assert.Error(t, decode([]byte("\x1f\xff"), &got))
+}
+
+func gobEncode(t *testing.T, v interface{}) []byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMigrateGobToJSON(t *testing.T) {
+	f, err := ioutil.TempFile("", "vouch-model-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	// a db written before there were schema versions
+	db, err := bolt.Open(f.Name(), 0644, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	old := boltBackend{db}
+	assert.NoError(t, old.put(userBucket, []byte("alice"), gobEncode(t, &structs.User{Username: "alice", ID: 3})))
+	assert.NoError(t, old.put(teamBucket, []byte("ops"), gobEncode(t, &structs.Team{Name: "ops", Members: []string{"alice"}})))
+	db.Close()
+
+	s, err := NewBoltStore(f.Name())
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := SchemaVersion(s)
 	assert.NoError(t, err)
+	assert.Equal(t, schemaVersion, v)
+
+	u := structs.User{}
+	assert.NoError(t, s.User([]byte("alice"), &u))
+	assert.Equal(t, 3, u.ID)
+	team := structs.Team{}
+	assert.NoError(t, s.Team([]byte("ops"), &team))
+	assert.Equal(t, []string{"alice"}, team.Members)
 
-	var teams []structs.Team
-	err = AllTeams(&teams)
-	log.Debugf("TestPutTeamGetTeamDeleteTeam:\nteam: %+v\nteams: %+v", t1, teams)
-	// assert.NotContains(t, teams, t1)
+	raw, err := s.(kvStore).b.get(userBucket, []byte("alice"))
+	assert.NoError(t, err)
+	assert.True(t, isJSON(raw))
+	s.Close()
+}
 
-	teamNames := make([]string, len(teams))
-	for _, teamV := range teams {
-		teamNames = append(teamNames, teamV.Name)
+func TestMigrateGobToJSONBroken(t *testing.T) {
+	f, err := ioutil.TempFile("", "vouch-model-migrate")
+	if err != nil {
+		t.Fatal(err)
 	}
+	f.Close()
+	defer os.Remove(f.Name())
 
-	Team([]byte(t1.Name), &t1)
-	assert.Contains(t, teamNames, t1.Name)
+	db, err := bolt.Open(f.Name(), 0644, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	old := boltBackend{db}
+	assert.NoError(t, old.put(siteBucket, []byte("broken"), []byte("not gob")))
+	db.Close()
 
-	// assert.Contains(t, teams, t4)
-	// assert.Contains(t, teams, t5)
+	_, err = NewBoltStore(f.Name())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "sites broken")
+	}
 
+	// the record and the version are left as they were
+	db, err = bolt.Open(f.Name(), 0644, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	kv := kvStore{boltBackend{db}}
+	v, err := kv.schemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, v)
+	raw, err := kv.b.get(siteBucket, []byte("broken"))
 	assert.NoError(t, err)
+	assert.Equal(t, []byte("not gob"), raw)
+}
+
+func TestMigrateAuditByTime(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		kv := s.(kvStore)
+		// the events of schema version 1, keyed by their ID
+		for _, e := range []structs.AuditEvent{
+			{ID: 1, Time: 300, Type: "login", Username: "alice"},
+			{ID: 2, Time: 100, Type: "login", Username: "bob"},
+		} {
+			v, err := encode(&e)
+			assert.NoError(t, err)
+			assert.NoError(t, kv.b.put(auditBucket, []byte(fmt.Sprintf("%020d", e.ID)), v))
+		}
+		assert.NoError(t, kv.setSchemaVersion(1))
+		assert.NoError(t, kv.migrate())
+
+		all := []structs.AuditEvent{}
+		assert.NoError(t, s.AuditEvents(AuditQuery{}, &all))
+		if assert.Len(t, all, 2) {
+			assert.Equal(t, "bob", all[0].Username)
+			assert.Equal(t, "alice", all[1].Username)
+		}
+		_, err := kv.b.get(auditBucket, []byte(fmt.Sprintf("%020d", 1)))
+		assert.Equal(t, ErrNotFound, err)
+	})
+}
+
+func TestMigrateRefusesDowngrade(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		kv := s.(kvStore)
+		assert.NoError(t, kv.setSchemaVersion(schemaVersion+1))
+		assert.Error(t, kv.migrate())
+
+		assert.NoError(t, kv.setSchemaVersion(schemaVersion))
+		assert.NoError(t, kv.migrate())
+	})
+}
+
+func TestSchemaVersion(t *testing.T) {
+	assert.Len(t, migrations, schemaVersion)
+}
+
+func TestActivity(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		assert.NoError(t, s.AddActivity([]structs.Activity{
+			{Username: "alice", Site: "app.example.com", Requests: 3, FirstSeen: 100, LastSeen: 150},
+			{Username: "bob smith", Site: "app.example.com", Requests: 1, FirstSeen: 120, LastSeen: 120},
+		}))
+		assert.NoError(t, s.AddActivity([]structs.Activity{
+			{Username: "alice", Site: "app.example.com", Requests: 2, FirstSeen: 200, LastSeen: 260},
+		}))
+
+		all := []structs.Activity{}
+		assert.NoError(t, s.AllActivity(&all))
+		if assert.Len(t, all, 2) {
+			assert.Equal(t, structs.Activity{Username: "alice", Site: "app.example.com", Requests: 5, FirstSeen: 100, LastSeen: 260}, all[0])
+			assert.Equal(t, "bob smith", all[1].Username)
+		}
+	})
+}
+
+// two vouch instances flushing at the same time
+func TestActivityConcurrent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, s.AddActivity([]structs.Activity{
+					{Username: "alice", Site: "app.example.com", Requests: 1, FirstSeen: 100, LastSeen: 100},
+				}))
+			}()
+		}
+		wg.Wait()
 
+		all := []structs.Activity{}
+		assert.NoError(t, s.AllActivity(&all))
+		if assert.Len(t, all, 1) {
+			assert.Equal(t, int64(10), all[0].Requests)
+		}
+	})
 }
@@ -0,0 +1,60 @@
+package model
+
+import (
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// PutServiceToken - create or update a service token, keyed by its hash
+func (s kvStore) PutServiceToken(st structs.ServiceToken) error {
+	if st.ID == 0 {
+		id, err := s.b.nextSequence(serviceTokenBucket)
+		if err != nil {
+			return err
+		}
+		st.ID = int(id)
+	}
+	return s.put(serviceTokenBucket, []byte(st.Hash), &st)
+}
+
+// ServiceToken lookup service token from the hash of the token
+func (s kvStore) ServiceToken(key []byte, st *structs.ServiceToken) error {
+	if err := s.get(serviceTokenBucket, key, st); err != nil {
+		return err
+	}
+	log.Debugf("retrieved service token %s from db", st.Name)
+	return nil
+}
+
+// TouchServiceToken sets the LastUsed of the service token at key, unless it has been deleted
+// returns ErrNotFound when it has, rather than putting it back
+func (s kvStore) TouchServiceToken(key []byte, lastUsed int64) error {
+	return s.b.update(serviceTokenBucket, key, func(v []byte) ([]byte, error) {
+		st := structs.ServiceToken{}
+		if err := decode(v, &st); err != nil {
+			return nil, err
+		}
+		st.LastUsed = lastUsed
+		return encode(&st)
+	})
+}
+
+// DeleteServiceToken from key
+func (s kvStore) DeleteServiceToken(st structs.ServiceToken) error {
+	if err := s.b.delete(serviceTokenBucket, []byte(st.Hash)); err != nil {
+		return err
+	}
+	log.Debugf("deleted service token %s from db", st.Name)
+	return nil
+}
+
+// AllServiceTokens collect all items
+func (s kvStore) AllServiceTokens(tokens *[]structs.ServiceToken) error {
+	return s.b.forEach(serviceTokenBucket, func(k, v []byte) error {
+		st := structs.ServiceToken{}
+		if err := decode(v, &st); err != nil {
+			return err
+		}
+		*tokens = append(*tokens, st)
+		return nil
+	})
+}
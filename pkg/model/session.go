@@ -0,0 +1,48 @@
+package model
+
+import (
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// PutSession - create or update a server side session, keyed by the hash of the session id
+func (st kvStore) PutSession(s structs.Session) error {
+	return st.put(sessionBucket, []byte(s.Hash), &s)
+}
+
+// Session lookup session from the hash of the session id
+func (st kvStore) Session(key []byte, s *structs.Session) error {
+	if err := st.get(sessionBucket, key, s); err != nil {
+		return err
+	}
+	log.Debugf("retrieved session of %s from db", s.Username)
+	return nil
+}
+
+// DeleteSession from key
+func (st kvStore) DeleteSession(s structs.Session) error {
+	if err := st.b.delete(sessionBucket, []byte(s.Hash)); err != nil {
+		return err
+	}
+	log.Debugf("deleted session of %s from db", s.Username)
+	return nil
+}
+
+// AllSessions collect all items
+func (st kvStore) AllSessions(sessions *[]structs.Session) error {
+	return st.b.forEach(sessionBucket, func(k, v []byte) error {
+		s := structs.Session{}
+		if err := decode(v, &s); err != nil {
+			return err
+		}
+		*sessions = append(*sessions, s)
+		return nil
+	})
+}
+
+// PurgeSessions deletes the sessions which have expired by now
+func (st kvStore) PurgeSessions(now int64) error {
+	return st.purge(sessionBucket, func(v []byte) bool {
+		s := structs.Session{}
+		return decode(v, &s) != nil || s.ExpiresOn <= now
+	})
+}
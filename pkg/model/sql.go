@@ -0,0 +1,222 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	// the drivers for `vouch.db.store: postgres` and `vouch.db.store: sqlite`
+	// the sqlite driver needs cgo, static builds (CGO_ENABLED=0) can't open an sqlite db
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// the records are kept in a single table, a row per bucket and key, but for the activity which is added up in a table
+// of its own, and the audit events which are queried by user and time
+var sqlSchema = map[string][]string{
+	"sqlite": {
+		`CREATE TABLE IF NOT EXISTS vouch_records (bucket TEXT NOT NULL, key TEXT NOT NULL, value BLOB NOT NULL, PRIMARY KEY (bucket, key))`,
+		`CREATE TABLE IF NOT EXISTS vouch_sequences (bucket TEXT PRIMARY KEY, value INTEGER NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS vouch_activity (site TEXT NOT NULL, username TEXT NOT NULL, requests INTEGER NOT NULL, firstseen INTEGER NOT NULL, lastseen INTEGER NOT NULL, PRIMARY KEY (site, username))`,
+		`CREATE TABLE IF NOT EXISTS audit_events (id INTEGER PRIMARY KEY, time INTEGER NOT NULL, username TEXT NOT NULL, type TEXT NOT NULL, value BLOB NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS audit_events_username_time_type ON audit_events (username, time, type)`,
+		`CREATE INDEX IF NOT EXISTS audit_events_time ON audit_events (time)`,
+	},
+	"postgres": {
+		`CREATE TABLE IF NOT EXISTS vouch_records (bucket TEXT NOT NULL, key TEXT NOT NULL, value BYTEA NOT NULL, PRIMARY KEY (bucket, key))`,
+		`CREATE TABLE IF NOT EXISTS vouch_sequences (bucket TEXT PRIMARY KEY, value BIGINT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS vouch_activity (site TEXT NOT NULL, username TEXT NOT NULL, requests BIGINT NOT NULL, firstseen BIGINT NOT NULL, lastseen BIGINT NOT NULL, PRIMARY KEY (site, username))`,
+		`CREATE TABLE IF NOT EXISTS audit_events (id BIGINT PRIMARY KEY, time BIGINT NOT NULL, username TEXT NOT NULL, type TEXT NOT NULL, value BYTEA NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS audit_events_username_time_type ON audit_events (username, time, type)`,
+		`CREATE INDEX IF NOT EXISTS audit_events_time ON audit_events (time)`,
+	},
+}
+
+var sqlDrivers = map[string]string{
+	"sqlite":   "sqlite3",
+	"postgres": "postgres",
+}
+
+// NewSQLStore opens the `sqlite` or `postgres` db at dsn and creates the tables
+func NewSQLStore(dialect, dsn string) (Store, error) {
+	driver, ok := sqlDrivers[dialect]
+	if !ok {
+		return nil, fmt.Errorf("unknown sql db %s", dialect)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == "sqlite" {
+		// sqlite allows a single writer, and each connection to ":memory:" would be a db of its own
+		db.SetMaxOpenConns(1)
+	}
+	for _, stmt := range sqlSchema[dialect] {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("unable to create the %s tables: %s", dialect, err)
+		}
+	}
+	s := kvStore{sqlBackend{db: db, dialect: dialect}}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+type sqlBackend struct {
+	db      *sql.DB
+	dialect string
+}
+
+// q rewrites the ? placeholders as $1, $2.. for postgres
+func (s sqlBackend) q(query string) string {
+	if s.dialect != "postgres" {
+		return query
+	}
+	parts := strings.Split(query, "?")
+	var b strings.Builder
+	for i, p := range parts {
+		b.WriteString(p)
+		if i < len(parts)-1 {
+			fmt.Fprintf(&b, "$%d", i+1)
+		}
+	}
+	return b.String()
+}
+
+func (s sqlBackend) get(bucket, key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.QueryRow(s.q(`SELECT value FROM vouch_records WHERE bucket = ? AND key = ?`), string(bucket), string(key)).Scan(&val)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return val, err
+}
+
+func (s sqlBackend) put(bucket, key, val []byte) error {
+	_, err := s.db.Exec(s.q(`INSERT INTO vouch_records (bucket, key, value) VALUES (?, ?, ?)
+		ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value`), string(bucket), string(key), val)
+	return err
+}
+
+func (s sqlBackend) putAll(bucket []byte, records map[string][]byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for k, v := range records {
+		if _, err := tx.Exec(s.q(`INSERT INTO vouch_records (bucket, key, value) VALUES (?, ?, ?)
+		ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value`), string(bucket), k, v); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s sqlBackend) update(bucket, key []byte, fn func(v []byte) ([]byte, error)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `SELECT value FROM vouch_records WHERE bucket = ? AND key = ?`
+	if s.dialect == "postgres" {
+		// sqlite's single connection already keeps the other writers out
+		query += ` FOR UPDATE`
+	}
+	var v []byte
+	err = tx.QueryRow(s.q(query), string(bucket), string(key)).Scan(&v)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	val, err := fn(v)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.q(`UPDATE vouch_records SET value = ? WHERE bucket = ? AND key = ?`), val, string(bucket), string(key)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s sqlBackend) delete(bucket, key []byte) error {
+	_, err := s.db.Exec(s.q(`DELETE FROM vouch_records WHERE bucket = ? AND key = ?`), string(bucket), string(key))
+	return err
+}
+
+// take only returns the record when its DELETE is the one which removed it
+func (s sqlBackend) take(bucket, key []byte) ([]byte, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var val []byte
+	err = tx.QueryRow(s.q(`SELECT value FROM vouch_records WHERE bucket = ? AND key = ?`), string(bucket), string(key)).Scan(&val)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec(s.q(`DELETE FROM vouch_records WHERE bucket = ? AND key = ?`), string(bucket), string(key))
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n != 1 {
+		return nil, ErrNotFound
+	}
+	return val, tx.Commit()
+}
+
+func (s sqlBackend) forEach(bucket []byte, fn func(k, v []byte) error) error {
+	rows, err := s.db.Query(s.q(`SELECT key, value FROM vouch_records WHERE bucket = ? ORDER BY key`), string(bucket))
+	if err != nil {
+		return err
+	}
+	// read them all first, with sqlite's single connection fn couldn't query the store while rows are open
+	b := make(map[string][]byte)
+	for rows.Next() {
+		var k string
+		var v []byte
+		if err := rows.Scan(&k, &v); err != nil {
+			rows.Close()
+			return err
+		}
+		b[k] = v
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return forEachSorted(b, fn)
+}
+
+func (s sqlBackend) nextSequence(bucket []byte) (uint64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.q(`INSERT INTO vouch_sequences (bucket, value) VALUES (?, 1)
+		ON CONFLICT (bucket) DO UPDATE SET value = vouch_sequences.value + 1`), string(bucket)); err != nil {
+		return 0, err
+	}
+	var id uint64
+	if err := tx.QueryRow(s.q(`SELECT value FROM vouch_sequences WHERE bucket = ?`), string(bucket)).Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (s sqlBackend) close() error {
+	return s.db.Close()
+}
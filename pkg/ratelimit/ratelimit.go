@@ -0,0 +1,236 @@
+package ratelimit
+
+// Rate limits and lockout
+//
+// with `vouch.rateLimit.enabled`
+//   - requests to /login, /auth and the /device endpoints are limited per client address (`vouch.rateLimit.login`)
+//   - failed logins are limited per username (`vouch.rateLimit.user`), once they're used up the user is locked out
+//   - failed bearer tokens at /validate are limited per client address (`vouch.rateLimit.bearer`), so that a bot
+//     can't have vouch-proxy ask the IdP about one made up token after another
+//
+// the client address is the one of pkg/clientip, X-Forwarded-For only counts behind `vouch.rateLimit.trustedProxies`.
+// A request over the limit gets a 429 with a Retry-After header.
+// The buckets are kept in memory, each vouch-proxy replica counts for itself.
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/clientip"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/requestlog"
+)
+
+// the names of the limits, for the metrics and the audit log
+const (
+	LoginLimit  = "login"
+	UserLimit   = "user"
+	BearerLimit = "bearer"
+)
+
+var (
+	login, user, bearer *Limiter
+
+	now = time.Now
+)
+
+// Limiter keeps a token bucket for each key, such as a client address
+type Limiter struct {
+	every time.Duration
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// already told about running out
+	limited bool
+}
+
+// NewLimiter with buckets which hold up to burst tokens and gain one every so often
+func NewLimiter(every time.Duration, burst int) *Limiter {
+	return &Limiter{
+		every:   every,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// bucket of key, topped up to t
+func (l *Limiter) bucket(key string, t time.Time) *bucket {
+	l.sweep(t)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: t}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+float64(t.Sub(b.last))/float64(l.every))
+	b.last = t
+	return b
+}
+
+// sweep forgets the buckets which have filled up again, a new one starts out full anyway
+func (l *Limiter) sweep(t time.Time) {
+	full := time.Duration(l.burst) * l.every
+	if t.Sub(l.swept) < full {
+		return
+	}
+	for key, b := range l.buckets {
+		if t.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = t
+}
+
+// retryAfter is how long until b gains a token
+func (l *Limiter) retryAfter(b *bucket) time.Duration {
+	return time.Duration((1 - b.tokens) * float64(l.every))
+}
+
+// Take a token from the bucket of key
+// once they're used up Take returns how long until there's another one, and whether key has only just run out
+func (l *Limiter) Take(key string, t time.Time) (ok bool, retryAfter time.Duration, first bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(key, t)
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = false
+		return true, 0, false
+	}
+	first = !b.limited
+	b.limited = true
+	return false, l.retryAfter(b), first
+}
+
+// Allow reports whether the bucket of key has a token left without taking it, or else how long until it has one
+func (l *Limiter) Allow(key string, t time.Time) (ok bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(key, t)
+	if b.tokens >= 1 {
+		return true, 0
+	}
+	return false, l.retryAfter(b)
+}
+
+// Enabled reports whether `vouch.rateLimit.enabled` is set
+func Enabled() bool {
+	return cfg.Cfg.RateLimit.Enabled
+}
+
+// Configure the limits from `vouch.rateLimit`
+func Configure() {
+	c := cfg.Cfg.RateLimit
+	login = NewLimiter(c.Login.Every, c.Login.Burst)
+	user = NewLimiter(c.User.Every, c.User.Burst)
+	bearer = NewLimiter(c.Bearer.Every, c.Bearer.Burst)
+}
+
+func configured() bool {
+	return Enabled() && login != nil
+}
+
+// LimitLogin refuses the requests of a client address which has used up its tokens for /login, /auth and /device
+func LimitLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if configured() {
+			if ok, retryAfter, first := login.Take(clientip.Of(r), now()); !ok {
+				reject(w, r, LoginLimit, "", retryAfter, first)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LoginFailed takes a token from the bucket of username
+func LoginFailed(r *http.Request, username string) {
+	if !configured() || username == "" {
+		return
+	}
+	fail(r, user, UserLimit, username, username)
+}
+
+// UserLocked responds with a 429 when username has used up its tries, and reports whether it did
+func UserLocked(w http.ResponseWriter, r *http.Request, username string) bool {
+	if !configured() || username == "" {
+		return false
+	}
+	if ok, retryAfter := user.Allow(username, now()); !ok {
+		reject(w, r, UserLimit, username, retryAfter, false)
+		return true
+	}
+	return false
+}
+
+// BearerFailed takes a token from the bucket of the client address
+func BearerFailed(r *http.Request) {
+	if !configured() {
+		return
+	}
+	fail(r, bearer, BearerLimit, clientip.Of(r), "")
+}
+
+// fail takes a token from the bucket of key, the audit log hears about the one which was the last
+// from then on the requests are refused before they can fail again
+func fail(r *http.Request, l *Limiter, limit, key, username string) {
+	t := now()
+	if ok, _, _ := l.Take(key, t); ok {
+		if left, _ := l.Allow(key, t); !left {
+			logLimited(r, limit, username)
+		}
+	}
+}
+
+// BearerLimited responds with a 429 when the client address has used up its tries, and reports whether it did
+func BearerLimited(w http.ResponseWriter, r *http.Request) bool {
+	if !configured() {
+		return false
+	}
+	if ok, retryAfter := bearer.Allow(clientip.Of(r), now()); !ok {
+		reject(w, r, BearerLimit, "", retryAfter, false)
+		return true
+	}
+	return false
+}
+
+// BearerAllowed reports whether the client address has tries left for bearer tokens, without responding
+func BearerAllowed(r *http.Request) bool {
+	if !configured() {
+		return true
+	}
+	ok, _ := bearer.Allow(clientip.Of(r), now())
+	return ok
+}
+
+// reject the request with a 429, the audit log only hears about it when the key first runs out
+func reject(w http.ResponseWriter, r *http.Request, limit, username string, retryAfter time.Duration, first bool) {
+	metrics.RateLimited(limit)
+	if first {
+		logLimited(r, limit, username)
+	}
+	// whole seconds, rounded up
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+func logLimited(r *http.Request, limit, username string) {
+	requestlog.Logger(r).Warnf("%s rate limit reached by %s %s", limit, clientip.Of(r), username)
+	e := audit.NewEvent(r, audit.RateLimited)
+	e.Username = username
+	e.Host = r.Host
+	e.Reason = limit + " rate limit reached"
+	audit.Log(e)
+}
@@ -0,0 +1,187 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/clientip"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+var t0 = time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+// setUp the limits with the clock stopped at t0, and an audit log to look at
+func setUp(t *testing.T) (*time.Time, model.Store) {
+	clock := t0
+	now = func() time.Time { return clock }
+	cfg.Cfg.RateLimit.Enabled = true
+	cfg.Cfg.RateLimit.Login = cfg.TokenBucket{Every: time.Second, Burst: 3}
+	cfg.Cfg.RateLimit.User = cfg.TokenBucket{Every: time.Minute, Burst: 2}
+	cfg.Cfg.RateLimit.Bearer = cfg.TokenBucket{Every: time.Second, Burst: 2}
+	Configure()
+	// nginx, in front of httptest's 192.0.2.1
+	cfg.Cfg.RateLimit.TrustedProxies = []string{"192.0.2.1"}
+	clientip.Refresh()
+
+	db := model.NewMemoryStore()
+	cfg.Cfg.Audit.Enabled = true
+	audit.SetStore(db)
+	assert.NoError(t, audit.Start())
+	t.Cleanup(func() {
+		now = time.Now
+		cfg.Cfg.RateLimit.Enabled = false
+		cfg.Cfg.RateLimit.TrustedProxies = nil
+		clientip.Refresh()
+		cfg.Cfg.Audit.Enabled = false
+		audit.Stop()
+	})
+	return &clock, db
+}
+
+// auditEvents written to db, once the ones queued have been
+func auditEvents(t *testing.T, db model.Store) []structs.AuditEvent {
+	audit.Stop()
+	defer audit.Start()
+	events := []structs.AuditEvent{}
+	assert.NoError(t, db.AuditEvents(model.AuditQuery{Type: audit.RateLimited}, &events))
+	return events
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(time.Second, 2)
+	ok, _, _ := l.Take("a", t0)
+	assert.True(t, ok)
+	ok, _, _ = l.Take("a", t0)
+	assert.True(t, ok)
+
+	ok, retryAfter, first := l.Take("a", t0)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+	assert.True(t, first)
+	_, retryAfter, first = l.Take("a", t0.Add(400*time.Millisecond))
+	assert.Equal(t, 600*time.Millisecond, retryAfter)
+	assert.False(t, first)
+
+	// each key has a bucket of its own
+	ok, _ = l.Allow("b", t0)
+	assert.True(t, ok)
+
+	// topped up
+	ok, _, _ = l.Take("a", t0.Add(time.Second))
+	assert.True(t, ok)
+
+	// the buckets which filled up again are forgotten, b has
+	l.Take("c", t0.Add(2*time.Second))
+	assert.Len(t, l.buckets, 2)
+	l.Take("c", t0.Add(4*time.Second))
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestLimitLogin(t *testing.T) {
+	clock, db := setUp(t)
+	h := LimitLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	login := func(ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/login", nil)
+		r.Header.Set("X-Forwarded-For", "198.51.100.1, "+ip)
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, login("203.0.113.7").Code)
+	}
+	w := login("203.0.113.7")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	login("203.0.113.7")
+	// someone else
+	assert.Equal(t, http.StatusOK, login("203.0.113.8").Code)
+
+	// only once in the audit log
+	if events := auditEvents(t, db); assert.Len(t, events, 1) {
+		assert.Equal(t, "203.0.113.7", events[0].ClientIP)
+		assert.Equal(t, "198.51.100.1, 203.0.113.7", events[0].ForwardedFor)
+		assert.Equal(t, "login rate limit reached", events[0].Reason)
+	}
+
+	*clock = clock.Add(time.Second)
+	assert.Equal(t, http.StatusOK, login("203.0.113.7").Code)
+}
+
+func TestLimitLoginUntrusted(t *testing.T) {
+	setUp(t)
+	cfg.Cfg.RateLimit.TrustedProxies = nil
+	clientip.Refresh()
+	h := LimitLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// the X-Forwarded-For of anyone but nginx isn't believed, these all come from 192.0.2.1
+	for i, ip := range []string{"203.0.113.9", "203.0.113.10", "203.0.113.11", "203.0.113.12"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/login", nil)
+		r.Header.Set("X-Forwarded-For", ip)
+		h.ServeHTTP(w, r)
+		if i < 3 {
+			assert.Equal(t, http.StatusOK, w.Code)
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		}
+	}
+}
+
+func TestUserLockout(t *testing.T) {
+	clock, db := setUp(t)
+	r := httptest.NewRequest("POST", "/auth", nil)
+
+	LoginFailed(r, "alice")
+	assert.False(t, UserLocked(httptest.NewRecorder(), r, "alice"))
+	assert.Empty(t, auditEvents(t, db))
+
+	LoginFailed(r, "alice")
+	w := httptest.NewRecorder()
+	assert.True(t, UserLocked(w, r, "alice"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.False(t, UserLocked(httptest.NewRecorder(), r, "bob"))
+	if events := auditEvents(t, db); assert.Len(t, events, 1) {
+		assert.Equal(t, "alice", events[0].Username)
+	}
+
+	*clock = clock.Add(time.Minute)
+	assert.False(t, UserLocked(httptest.NewRecorder(), r, "alice"))
+}
+
+func TestBearer(t *testing.T) {
+	_, db := setUp(t)
+	r := httptest.NewRequest("GET", "/validate", nil)
+	r.RemoteAddr = "203.0.113.7:4567"
+
+	assert.False(t, BearerLimited(httptest.NewRecorder(), r))
+	BearerFailed(r)
+	BearerFailed(r)
+	w := httptest.NewRecorder()
+	assert.True(t, BearerLimited(w, r))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Len(t, auditEvents(t, db), 1)
+}
+
+func TestDisabled(t *testing.T) {
+	setUp(t)
+	cfg.Cfg.RateLimit.Enabled = false
+	r := httptest.NewRequest("GET", "/validate", nil)
+	for i := 0; i < 5; i++ {
+		BearerFailed(r)
+	}
+	assert.False(t, BearerLimited(httptest.NewRecorder(), r))
+}
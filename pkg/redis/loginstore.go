@@ -0,0 +1,104 @@
+package redis
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	loginIDBytes = 32
+	// how long the login state is kept when the session cookie has no MaxAge
+	loginTTL = 24 * time.Hour
+)
+
+// LoginStore is a gorilla sessions.Store which keeps the session values in redis, the cookie only holds a
+// random id. Any replica can then finish a login which another one started, without sharing `session.key`
+type LoginStore struct {
+	Options *sessions.Options
+}
+
+// NewLoginStore with a copy of opts for the cookie
+func NewLoginStore(opts *sessions.Options) *LoginStore {
+	o := *opts
+	return &LoginStore{Options: &o}
+}
+
+// MaxAge sets the MaxAge of the cookie and of the values kept in redis
+func (s *LoginStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+}
+
+// Get returns the session of the request, see sessions.Store
+func (s *LoginStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session from redis, or starts a new one, see sessions.Store
+func (s *LoginStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	data, err := Client().Get(loginKey(c.Value)).Bytes()
+	if err == Nil {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.ID = c.Value
+	session.IsNew = false
+	return session, nil
+}
+
+// Save writes the session values to redis and sets the cookie, a negative MaxAge deletes both
+func (s *LoginStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := Client().Del(loginKey(session.ID)).Err(); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		b := make([]byte, loginIDBytes)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		session.ID = base64.RawURLEncoding.EncodeToString(b)
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(session.Values); err != nil {
+		return err
+	}
+	ttl := loginTTL
+	if session.Options.MaxAge > 0 {
+		ttl = time.Duration(session.Options.MaxAge) * time.Second
+	}
+	if err := Client().Set(loginKey(session.ID), buf.Bytes(), ttl).Err(); err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+func loginKey(id string) string {
+	return Key("login", id)
+}
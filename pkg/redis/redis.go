@@ -0,0 +1,133 @@
+package redis
+
+// Redis keeps the state which several Vouch Proxy replicas behind a load balancer have to share
+//
+// - `vouch.db.store: redis` the users, teams, sites, service tokens and device codes of pkg/model
+// - `vouch.session.store: redis` the server side sessions and the login state between /login and /auth
+//
+// the connection is configured in `vouch.redis`, and every key starts with `vouch.redis.prefix`
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	goredis "github.com/go-redis/redis/v7"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// Nil is returned when a key does not exist
+const Nil = goredis.Nil
+
+// TxFailedErr is returned by Watch when a watched key changed before the transaction ran
+const TxFailedErr = goredis.TxFailedErr
+
+type (
+	// Tx is the transaction of Client().Watch
+	Tx = goredis.Tx
+	// Pipeliner queues the commands of a transaction
+	Pipeliner = goredis.Pipeliner
+	// StringCmd the reply of a queued command such as HGet
+	StringCmd = goredis.StringCmd
+	// Z a member of a sorted set and its score
+	Z = goredis.Z
+	// ZRangeBy the bounds of ZRangeByScore
+	ZRangeBy = goredis.ZRangeBy
+)
+
+var (
+	mu     sync.Mutex
+	client *goredis.Client
+
+	log = cfg.Cfg.Logger
+)
+
+// Enabled reports whether anything is kept in redis
+func Enabled() bool {
+	return cfg.Cfg.DB.Store == "redis" || cfg.Cfg.Session.Store == "redis"
+}
+
+// Connect opens the connection pool configured in `vouch.redis` and checks that the server answers
+func Connect() error {
+	mu.Lock()
+	defer mu.Unlock()
+	opts, err := options()
+	if err != nil {
+		return err
+	}
+	c := goredis.NewClient(opts)
+	if err = c.Ping().Err(); err != nil {
+		c.Close()
+		return fmt.Errorf("redis %s: %s", cfg.Cfg.Redis.Addr, err)
+	}
+	if client != nil {
+		client.Close()
+	}
+	client = c
+	log.Infof("connected to redis %s", cfg.Cfg.Redis.Addr)
+	return nil
+}
+
+// Client the shared connection pool, connecting on first use
+func Client() *goredis.Client {
+	mu.Lock()
+	defer mu.Unlock()
+	if client == nil {
+		opts, err := options()
+		if err != nil {
+			// still verified, against the system's CAs
+			log.Error(err)
+		}
+		client = goredis.NewClient(opts)
+	}
+	return client
+}
+
+// options for the client, when the caFile can't be used the TLS config falls back to the system's CAs
+func options() (*goredis.Options, error) {
+	opts := &goredis.Options{
+		Addr:     cfg.Cfg.Redis.Addr,
+		Password: cfg.Cfg.Redis.Password,
+		DB:       cfg.Cfg.Redis.DB,
+	}
+	if !cfg.Cfg.Redis.TLS {
+		return opts, nil
+	}
+	host, _, _ := net.SplitHostPort(cfg.Cfg.Redis.Addr)
+	opts.TLSConfig = &tls.Config{ServerName: host}
+	if cfg.Cfg.Redis.CAFile == "" {
+		return opts, nil
+	}
+	pem, err := ioutil.ReadFile(cfg.Cfg.Redis.CAFile)
+	if err != nil {
+		return opts, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return opts, fmt.Errorf("no certificates found in %s.redis.caFile %s", cfg.Branding.LCName, cfg.Cfg.Redis.CAFile)
+	}
+	opts.TLSConfig.RootCAs = pool
+	return opts, nil
+}
+
+// Close the connection pool, the next Client() connects again
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if client == nil {
+		return nil
+	}
+	err := client.Close()
+	client = nil
+	return err
+}
+
+// Key joins the parts behind `vouch.redis.prefix`
+func Key(parts ...string) string {
+	return cfg.Cfg.Redis.Prefix + strings.Join(parts, ":")
+}
@@ -0,0 +1,113 @@
+package redis
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func setUp(t *testing.T) *miniredis.Miniredis {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Cfg.Redis.Addr = mr.Addr()
+	return mr
+}
+
+func TestKey(t *testing.T) {
+	assert.Equal(t, cfg.Cfg.Redis.Prefix+"session:abc", Key("session", "abc"))
+}
+
+func TestConnect(t *testing.T) {
+	mr := setUp(t)
+	defer Close()
+	assert.NoError(t, Connect())
+	assert.NoError(t, Client().Set(Key("k"), "v", 0).Err())
+	v, err := mr.Get(Key("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v", v)
+
+	mr.Close()
+	assert.Error(t, Connect())
+}
+
+func TestOptionsTLS(t *testing.T) {
+	defer func(addr string) {
+		cfg.Cfg.Redis.TLS = false
+		cfg.Cfg.Redis.CAFile = ""
+		cfg.Cfg.Redis.Addr = addr
+	}(cfg.Cfg.Redis.Addr)
+
+	cfg.Cfg.Redis.Addr = "redis.example.com:6380"
+	cfg.Cfg.Redis.TLS = true
+	opts, err := options()
+	assert.NoError(t, err)
+	if assert.NotNil(t, opts.TLSConfig) {
+		assert.Equal(t, "redis.example.com", opts.TLSConfig.ServerName)
+		assert.Nil(t, opts.TLSConfig.RootCAs)
+	}
+
+	cfg.Cfg.Redis.CAFile = "/nonexistent/ca.pem"
+	_, err = options()
+	assert.Error(t, err)
+}
+
+func TestLoginStore(t *testing.T) {
+	mr := setUp(t)
+	defer mr.Close()
+	defer Close()
+
+	store := NewLoginStore(&sessions.Options{Path: "/", MaxAge: 300, HttpOnly: true})
+	name := "VouchSession"
+
+	r := httptest.NewRequest("GET", "/login", nil)
+	session, err := store.New(r, name)
+	assert.NoError(t, err)
+	assert.True(t, session.IsNew)
+	session.Values["state"] = "abc"
+	w := httptest.NewRecorder()
+	assert.NoError(t, store.Save(r, w, session))
+
+	cookies := w.Result().Cookies()
+	if !assert.Len(t, cookies, 1) {
+		return
+	}
+	// the cookie only holds the id
+	assert.Equal(t, session.ID, cookies[0].Value)
+	assert.NotContains(t, cookies[0].Value, "abc")
+	assert.Equal(t, 300, cookies[0].MaxAge)
+	assert.True(t, mr.Exists(Key("login", session.ID)))
+
+	// another replica
+	r = httptest.NewRequest("GET", "/auth", nil)
+	r.AddCookie(cookies[0])
+	other := NewLoginStore(&sessions.Options{Path: "/", MaxAge: 300})
+	got, err := other.Get(r, name)
+	assert.NoError(t, err)
+	assert.False(t, got.IsNew)
+	assert.Equal(t, "abc", got.Values["state"])
+
+	got.Options.MaxAge = -1
+	w = httptest.NewRecorder()
+	assert.NoError(t, other.Save(r, w, got))
+	assert.False(t, mr.Exists(Key("login", session.ID)))
+	assert.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+
+	// unknown ids start over
+	r = httptest.NewRequest("GET", "/auth", nil)
+	r.AddCookie(&http.Cookie{Name: name, Value: "unknown"})
+	got, err = store.New(r, name)
+	assert.NoError(t, err)
+	assert.True(t, got.IsNew)
+}
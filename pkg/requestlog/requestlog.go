@@ -0,0 +1,146 @@
+package requestlog
+
+// Request IDs and a logger per request
+//
+// Handler takes the X-Request-Id header of the request, or makes one up, and echoes it in the response so that nginx
+// can log it (`$upstream_http_x_request_id`). The request's logger carries the request ID, and the username and the
+// decision once they're known, so that each of the lines logged while handling the request can be tied to it.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// Header carries the request ID
+const Header = "X-Request-Id"
+
+// the longest request ID taken from a client, a longer one is replaced
+const maxIDLength = 128
+
+type ctxKey struct{}
+
+// entry is shared by the handlers of a request, the username and decision are set along the way
+type entry struct {
+	mu       sync.Mutex
+	id       string
+	username string
+	decision string
+	// base carries the request ID, log the username as well once it's set
+	base *zap.SugaredLogger
+	log  *zap.SugaredLogger
+}
+
+// Handler gives each request an ID and a logger
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !validID(id) {
+			id = newID()
+		}
+		w.Header().Set(Header, id)
+		log := cfg.Cfg.Logger.With("requestID", id)
+		e := &entry{id: id, base: log, log: log}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, e)))
+	})
+}
+
+// validID allows the characters which won't mess up a log line
+func validID(id string) bool {
+	if id == "" || len(id) > maxIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		cfg.Cfg.Logger.Error(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func entryOf(r *http.Request) *entry {
+	e, _ := r.Context().Value(ctxKey{}).(*entry)
+	return e
+}
+
+// ID of the request, empty when it didn't pass through Handler
+func ID(r *http.Request) string {
+	if e := entryOf(r); e != nil {
+		return e.id
+	}
+	return ""
+}
+
+// Logger of the request, the default logger when it didn't pass through Handler
+func Logger(r *http.Request) *zap.SugaredLogger {
+	e := entryOf(r)
+	if e == nil {
+		return cfg.Cfg.Logger
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.log
+}
+
+// SetUsername of the user making the request and return the request's logger, which now carries it
+func SetUsername(r *http.Request, username string) *zap.SugaredLogger {
+	e := entryOf(r)
+	if e == nil {
+		return cfg.Cfg.Logger.With("username", username)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.username != username {
+		e.username = username
+		// replaced rather than added to, a user who logs in again as someone else is logged once as the new user
+		e.log = e.base.With("username", username)
+	}
+	return e.log
+}
+
+// Username set by SetUsername
+func Username(r *http.Request) string {
+	e := entryOf(r)
+	if e == nil {
+		return ""
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.username
+}
+
+// SetDecision records how the request was decided, such as the outcome of /validate, for the access log
+func SetDecision(r *http.Request, decision string) {
+	e := entryOf(r)
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.decision = decision
+}
+
+// Decision set by SetDecision
+func Decision(r *http.Request) string {
+	e := entryOf(r)
+	if e == nil {
+		return ""
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.decision
+}
@@ -0,0 +1,111 @@
+package requestlog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+// observe the lines logged during the test
+func observe(t *testing.T) *observer.ObservedLogs {
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := cfg.Cfg.Logger
+	cfg.Cfg.Logger = zap.New(core).Sugar()
+	t.Cleanup(func() { cfg.Cfg.Logger = logger })
+	return logs
+}
+
+func TestHandler(t *testing.T) {
+	logs := observe(t)
+
+	var id string
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = ID(r)
+		Logger(r).Info("no jwt yet")
+		log := SetUsername(r, "alice")
+		log.Error("site not authorized")
+		SetDecision(r, "wrong_host")
+	}))
+
+	// one is made up
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/validate", nil))
+	assert.Len(t, id, 32)
+	assert.Equal(t, id, w.Header().Get(Header))
+
+	entries := logs.All()
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, id, entries[0].ContextMap()["requestID"])
+		assert.NotContains(t, entries[0].ContextMap(), "username")
+		assert.Equal(t, id, entries[1].ContextMap()["requestID"])
+		assert.Equal(t, "alice", entries[1].ContextMap()["username"])
+	}
+
+	// nginx's is kept
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/validate", nil)
+	r.Header.Set(Header, "2c1e4a8f0b9d4e3f")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "2c1e4a8f0b9d4e3f", id)
+	assert.Equal(t, "2c1e4a8f0b9d4e3f", w.Header().Get(Header))
+}
+
+func TestSetUsernameAgain(t *testing.T) {
+	logs := observe(t)
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetUsername(r, "alice")
+		SetUsername(r, "bob").Info("logged in again")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/auth", nil))
+
+	entries := logs.All()
+	if assert.Len(t, entries, 1) {
+		usernames := 0
+		for _, f := range entries[0].Context {
+			if f.Key == "username" {
+				usernames++
+			}
+		}
+		assert.Equal(t, 1, usernames)
+		assert.Equal(t, "bob", entries[0].ContextMap()["username"])
+	}
+}
+
+func TestDecision(t *testing.T) {
+	var r *http.Request
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r = req
+		SetUsername(req, "alice")
+		SetDecision(req, "ok")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/validate", nil))
+	assert.Equal(t, "alice", Username(r))
+	assert.Equal(t, "ok", Decision(r))
+
+	// without Handler there's nothing to keep them in
+	r = httptest.NewRequest("GET", "/validate", nil)
+	SetDecision(r, "ok")
+	assert.Equal(t, "", Decision(r))
+	assert.Equal(t, "", ID(r))
+	assert.NotNil(t, Logger(r))
+}
+
+func TestValidID(t *testing.T) {
+	assert.True(t, validID("2c1e4a8f-0b9d_4e3f.1"))
+	assert.False(t, validID(""))
+	assert.False(t, validID("id with spaces"))
+	assert.False(t, validID("id\nforged log line"))
+	assert.False(t, validID(strings.Repeat("a", maxIDLength+1)))
+}
@@ -0,0 +1,219 @@
+package saml
+
+// Vouch Proxy as a SAML 2.0 Service Provider
+//
+// - /login sends the user to the IdP with an AuthnRequest (HTTP-Redirect binding)
+// - the IdP POSTs the signed assertion back to oauth.callback_url (/auth), which acts as the Assertion Consumer Service
+// - the SP metadata for registering Vouch Proxy at the IdP is served at /saml/metadata
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	csaml "github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// MetadataPath is where the SP metadata is served
+const MetadataPath = "/saml/metadata"
+
+var (
+	// SP is the configured Service Provider
+	SP *csaml.ServiceProvider
+
+	// attribute names commonly used by IdPs (ADFS, Shibboleth, Okta, ...) for the user's email and display name
+	emailAttributes = []string{
+		"email",
+		"mail",
+		"emailAddress",
+		"urn:oid:0.9.2342.19200300.100.1.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+	}
+	nameAttributes = []string{
+		"displayName",
+		"name",
+		"cn",
+		"urn:oid:2.16.840.1.113730.3.1.241",
+		"http://schemas.microsoft.com/identity/claims/displayname",
+	}
+
+	log = cfg.Cfg.Logger
+)
+
+// Configure sets up the SP from oauth.saml_* and oauth.callback_url
+func Configure() error {
+	keyPair, err := tls.LoadX509KeyPair(cfg.GenOAuth.SAMLSPCert, cfg.GenOAuth.SAMLSPKey)
+	if err != nil {
+		return fmt.Errorf("saml: could not load oauth.saml_sp_cert and oauth.saml_sp_key: %s", err)
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return errors.New("saml: oauth.saml_sp_key must be an RSA private key")
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	idpMetadata, err := idpMetadata()
+	if err != nil {
+		return err
+	}
+
+	acsURL, err := url.Parse(cfg.GenOAuth.RedirectURL)
+	if err != nil {
+		return err
+	}
+	metadataURL := *acsURL
+	metadataURL.Path = MetadataPath
+	metadataURL.RawQuery = ""
+
+	SP = &csaml.ServiceProvider{
+		EntityID:          cfg.GenOAuth.ClientID,
+		Key:               key,
+		Certificate:       cert,
+		MetadataURL:       metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idpMetadata,
+		AuthnNameIDFormat: csaml.UnspecifiedNameIDFormat,
+	}
+	log.Infof("configured SAML Service Provider %s for IdP %s", SP.EntityID, idpMetadata.EntityID)
+	return nil
+}
+
+func idpMetadata() (*csaml.EntityDescriptor, error) {
+	if cfg.GenOAuth.SAMLIdPMetadataFile != "" {
+		data, err := ioutil.ReadFile(cfg.GenOAuth.SAMLIdPMetadataFile)
+		if err != nil {
+			return nil, err
+		}
+		return samlsp.ParseMetadata(data)
+	}
+	u, err := url.Parse(cfg.GenOAuth.SAMLIdPMetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("fetching SAML IdP metadata from %s", u)
+	return samlsp.FetchMetadata(context.TODO(), http.DefaultClient, *u)
+}
+
+// LoginURL returns the IdP url carrying the AuthnRequest, and the ID of the request which must be
+// handed back to ParseResponse
+func LoginURL(relayState string) (string, string, error) {
+	if SP == nil {
+		return "", "", errors.New("saml: service provider is not configured")
+	}
+	req, err := SP.MakeAuthenticationRequest(SP.GetSSOBindingLocation(csaml.HTTPRedirectBinding), csaml.HTTPRedirectBinding, csaml.HTTPPostBinding)
+	if err != nil {
+		return "", "", err
+	}
+	u, err := req.Redirect(relayState, SP)
+	if err != nil {
+		return "", "", err
+	}
+	log.Debugf("saml AuthnRequest %s to %s", req.ID, u)
+	return u.String(), req.ID, nil
+}
+
+// ParseResponse validates the signed SAMLResponse POSTed by the IdP and maps the assertion into the user and customClaims
+func ParseResponse(r *http.Request, requestIDs []string, user *structs.User, customClaims *structs.CustomClaims) error {
+	if SP == nil {
+		return errors.New("saml: service provider is not configured")
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	assertion, err := SP.ParseResponse(r, requestIDs)
+	if err != nil {
+		// the reason the assertion was refused is only available in PrivateErr
+		if ire, ok := err.(*csaml.InvalidResponseError); ok {
+			log.Errorf("saml: invalid response: %s", ire.PrivateErr)
+		}
+		return err
+	}
+	return mapAssertion(assertion, user, customClaims)
+}
+
+// mapAssertion the NameID becomes the Username, attributes configured in `headers.claims` become customClaims
+func mapAssertion(assertion *csaml.Assertion, user *structs.User, customClaims *structs.CustomClaims) error {
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return errors.New("saml: assertion has no NameID")
+	}
+	user.Username = assertion.Subject.NameID.Value
+
+	attributes := make(map[string][]string)
+	for _, as := range assertion.AttributeStatements {
+		for _, a := range as.Attributes {
+			values := []string{}
+			for _, v := range a.Values {
+				values = append(values, v.Value)
+			}
+			attributes[a.Name] = values
+			if a.FriendlyName != "" {
+				attributes[a.FriendlyName] = values
+			}
+		}
+	}
+	log.Debugf("saml assertion attributes: %+v", attributes)
+
+	user.Email = firstValue(attributes, emailAttributes)
+	user.Name = firstValue(attributes, nameAttributes)
+	user.PrepareUserData()
+
+	customClaims.Claims = make(map[string]interface{})
+	for _, c := range cfg.Cfg.Headers.Claims {
+		values, ok := attributes[c]
+		if !ok {
+			continue
+		}
+		if len(values) == 1 {
+			customClaims.Claims[c] = values[0]
+		} else {
+			list := make([]interface{}, len(values))
+			for i, v := range values {
+				list[i] = v
+			}
+			customClaims.Claims[c] = list
+		}
+	}
+	return nil
+}
+
+func firstValue(attributes map[string][]string, names []string) string {
+	for _, n := range names {
+		if values, ok := attributes[n]; ok && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// MetadataHandler /saml/metadata
+// serves the SP metadata to be registered at the IdP
+func MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if SP == nil {
+		http.Error(w, "saml: service provider is not configured", http.StatusNotFound)
+		return
+	}
+	buf, err := xml.MarshalIndent(SP.Metadata(), "", "  ")
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	if _, err = w.Write(buf); err != nil {
+		log.Error(err)
+	}
+}
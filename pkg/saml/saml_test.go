@@ -0,0 +1,156 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	csaml "github.com/crewjam/saml"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+var idp *csaml.IdentityProvider
+
+// spProvider hands the SP's metadata to the IdP
+type spProvider struct {
+	metadata *csaml.EntityDescriptor
+}
+
+func (p spProvider) GetServiceProvider(r *http.Request, serviceProviderID string) (*csaml.EntityDescriptor, error) {
+	return p.metadata, nil
+}
+
+func init() {
+	cfg.InitForTestPurposes()
+	cfg.Cfg.Headers.Claims = []string{"groups"}
+
+	idp = newIdP()
+	spKey, spCert := newKeyPair("vouch.example.com")
+	SP = &csaml.ServiceProvider{
+		EntityID:    "https://vouch.example.com",
+		Key:         spKey,
+		Certificate: spCert,
+		MetadataURL: mustParseURL("https://vouch.example.com" + MetadataPath),
+		AcsURL:      mustParseURL("https://vouch.example.com/auth"),
+		IDPMetadata: idp.Metadata(),
+	}
+	idp.ServiceProviderProvider = spProvider{SP.Metadata()}
+}
+
+func newKeyPair(cn string) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return key, cert
+}
+
+func newIdP() *csaml.IdentityProvider {
+	key, cert := newKeyPair("idp.example.com")
+	return &csaml.IdentityProvider{
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: mustParseURL("https://idp.example.com/metadata"),
+		SSOURL:      mustParseURL("https://idp.example.com/sso"),
+	}
+}
+
+func mustParseURL(s string) url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return *u
+}
+
+// login runs /login against the in-process IdP and returns the /auth POST the browser would make
+func login(t *testing.T, signer *csaml.IdentityProvider, relayState string) (*http.Request, string) {
+	lURL, requestID, err := LoginURL(relayState)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(lURL, "https://idp.example.com/sso?SAMLRequest="))
+
+	idpReq, err := csaml.NewIdpAuthnRequest(idp, httptest.NewRequest("GET", lURL, nil))
+	assert.NoError(t, err)
+	assert.NoError(t, idpReq.Validate())
+	idpReq.IDP = signer
+
+	session := &csaml.Session{
+		ID:             "session1",
+		CreateTime:     time.Now(),
+		ExpireTime:     time.Now().Add(time.Hour),
+		Index:          "1",
+		NameID:         "alice",
+		UserCommonName: "Alice Smith",
+		CustomAttributes: []csaml.Attribute{
+			{Name: "mail", Values: []csaml.AttributeValue{{Type: "xs:string", Value: "alice@example.com"}}},
+			{Name: "groups", Values: []csaml.AttributeValue{{Type: "xs:string", Value: "staff"}, {Type: "xs:string", Value: "admins"}}},
+		},
+	}
+	assert.NoError(t, csaml.DefaultAssertionMaker{}.MakeAssertion(idpReq, session))
+	form, err := idpReq.PostBinding()
+	assert.NoError(t, err)
+	assert.Equal(t, relayState, form.RelayState)
+
+	body := url.Values{"SAMLResponse": {form.SAMLResponse}, "RelayState": {form.RelayState}}
+	r := httptest.NewRequest("POST", form.URL, strings.NewReader(body.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r, requestID
+}
+
+func TestParseResponse(t *testing.T) {
+	r, requestID := login(t, idp, "state1")
+
+	user := structs.User{}
+	customClaims := structs.CustomClaims{}
+	assert.NoError(t, ParseResponse(r, []string{requestID}, &user, &customClaims))
+	assert.Equal(t, "alice", user.Username)
+	assert.Equal(t, "alice@example.com", user.Email)
+	assert.Equal(t, "Alice Smith", user.Name)
+	assert.Equal(t, map[string]interface{}{"groups": []interface{}{"staff", "admins"}}, customClaims.Claims)
+}
+
+func TestParseResponseWrongRequestID(t *testing.T) {
+	r, _ := login(t, idp, "state2")
+	err := ParseResponse(r, []string{"id-from-another-login"}, &structs.User{}, &structs.CustomClaims{})
+	assert.Error(t, err)
+}
+
+func TestParseResponseUntrustedSigner(t *testing.T) {
+	// same IdP urls, but the assertion is signed with a key the SP doesn't trust
+	r, requestID := login(t, newIdP(), "state3")
+	err := ParseResponse(r, []string{requestID}, &structs.User{}, &structs.CustomClaims{})
+	assert.Error(t, err)
+}
+
+func TestMetadataHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	MetadataHandler(w, httptest.NewRequest("GET", MetadataPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `entityID="https://vouch.example.com"`)
+	assert.Contains(t, w.Body.String(), `Location="https://vouch.example.com/auth"`)
+}
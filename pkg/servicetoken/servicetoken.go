@@ -0,0 +1,263 @@
+package servicetoken
+
+// Service tokens let machine clients (CI jobs, cron scripts..) through Vouch Proxy without an OAuth login
+//
+//   Authorization: Bearer vouchst_...
+//
+// tokens are created, listed and revoked from the command line
+//
+//   ./vouch-proxy -servicetoken-create ci-deploy -servicetoken-scopes api.yourdomain.com -servicetoken-expires 720h
+//   ./vouch-proxy -servicetoken-list
+//   ./vouch-proxy -servicetoken-revoke ci-deploy
+//
+// the command line can't open a bolt db which the running Vouch Proxy has open, the admins revoke a token
+// from the running one at RevokePath instead
+//
+//   curl -b VouchCookie=... -d name=ci-deploy https://vouch.yourdomain.com/servicetokens/revoke
+//
+// only the sha256 hash of each token is kept in the db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/requestlog"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+const (
+	// Prefix sets service tokens apart from Vouch Proxy JWTs
+	Prefix = "vouchst_"
+
+	tokenBytes = 32
+
+	// LastUsed is recorded at most this often to spare the db a write on every request
+	lastUsedResolution = time.Minute
+
+	// RevokePath where the admins revoke a service token while Vouch Proxy runs, see RevokeHandler
+	RevokePath = "/servicetokens/revoke"
+)
+
+var (
+	// ErrInvalid the token is unknown or has been revoked
+	ErrInvalid = errors.New("service token is not valid")
+	// ErrExpired the token is past its expiry
+	ErrExpired = errors.New("service token has expired")
+	// ErrScope the token may not reach the requested host
+	ErrScope = errors.New("service token is not scoped for this host")
+	// ErrUnknown there's no service token by the name
+	ErrUnknown = errors.New("there is no service token by that name")
+
+	// the db, see SetStore
+	db model.Store
+
+	log = cfg.Cfg.Logger
+)
+
+// SetStore sets the db the service tokens are kept in
+func SetStore(s model.Store) {
+	db = s
+}
+
+// IsServiceToken reports whether token looks like a service token rather than a JWT
+func IsServiceToken(token string) bool {
+	return strings.HasPrefix(token, Prefix)
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create stores a new service token named name which may reach the hosts in scopes.
+// The token is returned and can't be recovered later.
+func Create(name string, scopes []string, ttl time.Duration) (string, error) {
+	if name == "" {
+		return "", errors.New("service token name must not be empty")
+	}
+	if len(scopes) == 0 {
+		return "", errors.New("service token needs at least one scope")
+	}
+	if _, err := find(name); err == nil {
+		return "", fmt.Errorf("service token %s already exists", name)
+	}
+
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := Prefix + base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	st := structs.ServiceToken{
+		Name:      name,
+		Hash:      hash(token),
+		Scopes:    scopes,
+		CreatedOn: now.Unix(),
+	}
+	if ttl > 0 {
+		st.ExpiresOn = now.Add(ttl).Unix()
+	}
+	if err := db.PutServiceToken(st); err != nil {
+		return "", err
+	}
+	log.Infof("created service token %s for %v", name, scopes)
+	audit.Log(structs.AuditEvent{Type: audit.AdminChange, Username: name, Reason: fmt.Sprintf("service token created for %s", strings.Join(scopes, ","))})
+	return token, nil
+}
+
+// Validate looks up token and checks that it hasn't expired and that it may reach host
+func Validate(token, host string) (structs.ServiceToken, error) {
+	st := structs.ServiceToken{}
+	if err := db.ServiceToken([]byte(hash(token)), &st); err != nil {
+		if err != model.ErrNotFound {
+			log.Error(err)
+		}
+		return st, ErrInvalid
+	}
+	if st.ExpiresOn != 0 && time.Now().Unix() > st.ExpiresOn {
+		return st, ErrExpired
+	}
+	if !InScope(host, st.Scopes) {
+		return st, ErrScope
+	}
+	return st, nil
+}
+
+// InScope host is one of the scopes or a subdomain of one of them
+func InScope(host string, scopes []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, s := range scopes {
+		if host == s || strings.HasSuffix(host, "."+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Touch records that st has just been used
+// a token which was revoked in the meantime stays revoked
+func Touch(st structs.ServiceToken) error {
+	now := time.Now()
+	if now.Sub(time.Unix(st.LastUsed, 0)) < lastUsedResolution {
+		return nil
+	}
+	err := db.TouchServiceToken([]byte(st.Hash), now.Unix())
+	if err == model.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Revoke deletes the service token named name
+func Revoke(name string) error {
+	st, err := find(name)
+	if err != nil {
+		return err
+	}
+	log.Infof("revoking service token %s", name)
+	if err := db.DeleteServiceToken(st); err != nil {
+		return err
+	}
+	audit.Log(structs.AuditEvent{Type: audit.TokenRevoked, Username: name, Reason: "service token revoked"})
+	return nil
+}
+
+// List all of the service tokens
+func List() ([]structs.ServiceToken, error) {
+	tokens := []structs.ServiceToken{}
+	err := db.AllServiceTokens(&tokens)
+	return tokens, err
+}
+
+func find(name string) (structs.ServiceToken, error) {
+	tokens, err := List()
+	if err != nil {
+		return structs.ServiceToken{}, err
+	}
+	for _, st := range tokens {
+		if st.Name == name {
+			return st, nil
+		}
+	}
+	return structs.ServiceToken{}, ErrUnknown
+}
+
+// RevokeHandler POST RevokePath with the name of the token, for the admins of `vouch.audit.admins` whom
+// handlers.AdminHandler lets through
+func RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PostFormValue("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if err := Revoke(name); err == ErrUnknown {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		requestlog.Logger(r).Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "revoked service token %s\n", name)
+}
+
+// RunCmd carries out cfg.ServiceTokenCmd, writing the results to w
+func RunCmd(w io.Writer) error {
+	c := cfg.ServiceTokenCmd
+	switch {
+	case c.Create != "":
+		scopes := []string{}
+		for _, s := range strings.Split(c.Scopes, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				scopes = append(scopes, s)
+			}
+		}
+		token, err := Create(c.Create, scopes, c.Expires)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, token)
+		return err
+	case c.Revoke != "":
+		return Revoke(c.Revoke)
+	case c.List:
+		tokens, err := List()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSCOPES\tCREATED\tEXPIRES\tLAST USED")
+		for _, st := range tokens {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", st.Name, strings.Join(st.Scopes, ","), date(st.CreatedOn), date(st.ExpiresOn), date(st.LastUsed))
+		}
+		return tw.Flush()
+	}
+	return nil
+}
+
+func date(unix int64) string {
+	if unix == 0 {
+		return "-"
+	}
+	return time.Unix(unix, 0).Format(time.RFC3339)
+}
@@ -0,0 +1,184 @@
+package servicetoken
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func setUp() {
+	SetStore(model.NewMemoryStore())
+}
+
+func TestCreateValidate(t *testing.T) {
+	setUp()
+
+	token, err := Create("ci-deploy", []string{"api.example.com"}, 0)
+	assert.NoError(t, err)
+	assert.True(t, IsServiceToken(token))
+
+	st, err := Validate(token, "api.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci-deploy", st.Name)
+	assert.Zero(t, st.ExpiresOn)
+
+	// subdomains and ports are fine
+	_, err = Validate(token, "v2.api.example.com:8443")
+	assert.NoError(t, err)
+
+	_, err = Validate(token, "www.example.com")
+	assert.Equal(t, ErrScope, err)
+	_, err = Validate(token, "evilapi.example.com")
+	assert.Equal(t, ErrScope, err)
+
+	_, err = Validate(token+"x", "api.example.com")
+	assert.Equal(t, ErrInvalid, err)
+
+	// names are unique
+	_, err = Create("ci-deploy", []string{"api.example.com"}, 0)
+	assert.Error(t, err)
+	_, err = Create("no-scopes", []string{}, 0)
+	assert.Error(t, err)
+}
+
+func TestExpiredRevoked(t *testing.T) {
+	setUp()
+
+	token, err := Create("short-lived", []string{"example.com"}, time.Hour)
+	assert.NoError(t, err)
+	st, err := Validate(token, "example.com")
+	assert.NoError(t, err)
+
+	st.ExpiresOn = time.Now().Add(-time.Minute).Unix()
+	assert.NoError(t, db.PutServiceToken(st))
+	_, err = Validate(token, "example.com")
+	assert.Equal(t, ErrExpired, err)
+
+	assert.NoError(t, Revoke("short-lived"))
+	_, err = Validate(token, "example.com")
+	assert.Equal(t, ErrInvalid, err)
+	assert.Equal(t, ErrUnknown, Revoke("short-lived"))
+}
+
+func TestRevokeHandler(t *testing.T) {
+	setUp()
+
+	token, err := Create("ci-deploy", []string{"example.com"}, 0)
+	assert.NoError(t, err)
+
+	revoke := func(method, name string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, RevokePath, strings.NewReader(url.Values{"name": {name}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		RevokeHandler(w, r)
+		return w
+	}
+	assert.Equal(t, http.StatusMethodNotAllowed, revoke(http.MethodGet, "ci-deploy").Code)
+	assert.Equal(t, http.StatusBadRequest, revoke(http.MethodPost, "").Code)
+
+	w := revoke(http.MethodPost, "ci-deploy")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "revoked service token ci-deploy\n", w.Body.String())
+	_, err = Validate(token, "example.com")
+	assert.Equal(t, ErrInvalid, err)
+
+	assert.Equal(t, http.StatusNotFound, revoke(http.MethodPost, "ci-deploy").Code)
+}
+
+func TestTouch(t *testing.T) {
+	setUp()
+
+	token, err := Create("cron", []string{"example.com"}, 0)
+	assert.NoError(t, err)
+	st, _ := Validate(token, "example.com")
+	assert.Zero(t, st.LastUsed)
+
+	assert.NoError(t, Touch(st))
+	st, _ = Validate(token, "example.com")
+	assert.NotZero(t, st.LastUsed)
+
+	// not written again within lastUsedResolution
+	used := st.LastUsed - 1
+	st.LastUsed = used
+	assert.NoError(t, db.PutServiceToken(st))
+	assert.NoError(t, Touch(st))
+	st, _ = Validate(token, "example.com")
+	assert.Equal(t, used, st.LastUsed)
+
+	// revoked while the request was under way
+	st.LastUsed = 0
+	assert.NoError(t, Revoke("cron"))
+	assert.NoError(t, Touch(st))
+	_, err = Validate(token, "example.com")
+	assert.Equal(t, ErrInvalid, err)
+}
+
+func TestRunCmd(t *testing.T) {
+	setUp()
+	saved := cfg.ServiceTokenCmd
+	defer func() { cfg.ServiceTokenCmd = saved }()
+
+	w := &bytes.Buffer{}
+	cfg.ServiceTokenCmd.Create = "ci-deploy"
+	cfg.ServiceTokenCmd.Scopes = "api.example.com, www.example.com"
+	assert.NoError(t, RunCmd(w))
+	token := strings.TrimSpace(w.String())
+	st, err := Validate(token, "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"api.example.com", "www.example.com"}, st.Scopes)
+
+	w.Reset()
+	cfg.ServiceTokenCmd.Create = ""
+	cfg.ServiceTokenCmd.List = true
+	assert.NoError(t, RunCmd(w))
+	assert.Contains(t, w.String(), "ci-deploy")
+	assert.NotContains(t, w.String(), token)
+
+	cfg.ServiceTokenCmd.List = false
+	cfg.ServiceTokenCmd.Revoke = "ci-deploy"
+	assert.NoError(t, RunCmd(w))
+	tokens, err := List()
+	assert.NoError(t, err)
+	assert.Equal(t, []structs.ServiceToken{}, tokens)
+}
+
+// the commands run before audit.Start, their events are written to the db all the same
+func TestRunCmdAudited(t *testing.T) {
+	db := model.NewMemoryStore()
+	SetStore(db)
+	audit.SetStore(db)
+	saved, savedAudit := cfg.ServiceTokenCmd, cfg.Cfg.Audit.Enabled
+	defer func() { cfg.ServiceTokenCmd, cfg.Cfg.Audit.Enabled = saved, savedAudit }()
+	cfg.Cfg.Audit.Enabled = true
+
+	w := &bytes.Buffer{}
+	cfg.ServiceTokenCmd.Create = "ci-deploy"
+	cfg.ServiceTokenCmd.Scopes = "api.example.com"
+	assert.NoError(t, RunCmd(w))
+	cfg.ServiceTokenCmd.Create = ""
+	cfg.ServiceTokenCmd.Revoke = "ci-deploy"
+	assert.NoError(t, RunCmd(w))
+
+	events := []structs.AuditEvent{}
+	assert.NoError(t, db.AuditEvents(model.AuditQuery{Username: "ci-deploy"}, &events))
+	types := []string{}
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	assert.ElementsMatch(t, []string{audit.AdminChange, audit.TokenRevoked}, types)
+}
@@ -0,0 +1,396 @@
+package sessionstore
+
+// Server side sessions
+//
+// with `vouch.session.serverSide` the cookie only holds a random session id, the Vouch Proxy JWT with its claims,
+// provider tokens and expiry is kept in the Store (the db by default). /validate looks the session up through a
+// short lived in-memory cache, which also spares the db a read on every request
+//
+// with `vouch.session.store: redis` the sessions are kept in redis instead, shared by all of the replicas
+//
+// sessions are listed and revoked from the command line
+//
+//   ./vouch-proxy -sessions-list
+//   ./vouch-proxy -sessions-revoke alice@yourdomain.com
+//
+// the command line can't open a bolt db which the running Vouch Proxy has open, the admins revoke the sessions
+// from the running one at RevokePath instead
+//
+//   curl -b VouchCookie=... -d user=alice@yourdomain.com https://vouch.yourdomain.com/sessions/revoke
+//
+// only the sha256 hash of each session id is kept in the store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+	"github.com/vouch/vouch-proxy/pkg/requestlog"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+const (
+	// Prefix sets session ids apart from Vouch Proxy JWTs
+	Prefix = "vouchsess_"
+
+	idBytes = 32
+
+	// a revoked session may live on in another process's cache for this long
+	cacheTTL  = time.Minute
+	cacheSize = 10000
+
+	// how often the expired sessions are deleted from the store
+	purgeEvery = time.Minute
+)
+
+var (
+	// ErrNotFound the session is unknown, has been revoked or has expired
+	ErrNotFound = errors.New("session not found or expired")
+
+	store Store
+	stop  chan struct{}
+
+	mu    sync.Mutex
+	cache = make(map[string]cached)
+
+	log = cfg.Cfg.Logger
+)
+
+// Store keeps the sessions, keyed by the hash of the session id
+type Store interface {
+	PutSession(s structs.Session) error
+	Session(hash string, s *structs.Session) error
+	DeleteSession(s structs.Session) error
+	AllSessions() ([]structs.Session, error)
+	PurgeSessions(now int64) error
+}
+
+// dbStore keeps the sessions in the db of pkg/model, see `vouch.db.store`
+type dbStore struct {
+	db model.Store
+}
+
+func (d dbStore) PutSession(s structs.Session) error {
+	return d.db.PutSession(s)
+}
+
+func (d dbStore) Session(hash string, s *structs.Session) error {
+	err := d.db.Session([]byte(hash), s)
+	if err == model.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (d dbStore) DeleteSession(s structs.Session) error {
+	return d.db.DeleteSession(s)
+}
+
+func (d dbStore) AllSessions() ([]structs.Session, error) {
+	sessions := []structs.Session{}
+	err := d.db.AllSessions(&sessions)
+	return sessions, err
+}
+
+func (d dbStore) PurgeSessions(now int64) error {
+	return d.db.PurgeSessions(now)
+}
+
+// redisStore keeps each session in its own redis key, which expires along with the session
+type redisStore struct{}
+
+func (redisStore) key(hash string) string {
+	return redis.Key("session", hash)
+}
+
+func (r redisStore) PutSession(s structs.Session) error {
+	ttl := time.Until(time.Unix(s.ExpiresOn, 0))
+	if ttl <= 0 {
+		return nil
+	}
+	// structs.Session leaves the Token out of its json, gob keeps it
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(s); err != nil {
+		return err
+	}
+	return redis.Client().Set(r.key(s.Hash), buf.Bytes(), ttl).Err()
+}
+
+func (r redisStore) Session(hash string, s *structs.Session) error {
+	data, err := redis.Client().Get(r.key(hash)).Bytes()
+	if err == redis.Nil {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(s)
+}
+
+func (r redisStore) DeleteSession(s structs.Session) error {
+	return redis.Client().Del(r.key(s.Hash)).Err()
+}
+
+func (r redisStore) AllSessions() ([]structs.Session, error) {
+	sessions := []structs.Session{}
+	iter := redis.Client().Scan(0, r.key("*"), 100).Iterator()
+	for iter.Next() {
+		hash := strings.TrimPrefix(iter.Val(), r.key(""))
+		s := structs.Session{}
+		if err := r.Session(hash, &s); err != nil {
+			// expired since the scan
+			if err == ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, iter.Err()
+}
+
+// PurgeSessions redis expires the keys by itself
+func (redisStore) PurgeSessions(now int64) error {
+	return nil
+}
+
+type cached struct {
+	session structs.Session
+	until   time.Time
+}
+
+// SetStore sets the db the sessions are kept in, unless they're kept in redis, see `vouch.session.store`
+func SetStore(s model.Store) {
+	if cfg.Cfg.Session.Store == "redis" {
+		store = redisStore{}
+		return
+	}
+	store = dbStore{db: s}
+}
+
+// Start deleting the expired sessions from the store every minute
+func Start() {
+	stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(purgeEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := store.PurgeSessions(time.Now().Unix()); err != nil {
+					log.Error(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(stop)
+}
+
+// Stop purging
+func Stop() {
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+}
+
+// Enabled reports whether `vouch.session.serverSide` is set
+func Enabled() bool {
+	return cfg.Cfg.Session.ServerSide
+}
+
+// IsSessionID reports whether s looks like a session id rather than a JWT
+func IsSessionID(s string) bool {
+	return strings.HasPrefix(s, Prefix)
+}
+
+func hash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create stores token, the Vouch Proxy JWT of username, and returns the session id to put in the cookie
+func Create(username, token string) (string, error) {
+	now := time.Now()
+	b := make([]byte, idBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := Prefix + base64.RawURLEncoding.EncodeToString(b)
+	s := structs.Session{
+		Hash:      hash(id),
+		Username:  username,
+		Token:     token,
+		CreatedOn: now.Unix(),
+		ExpiresOn: now.Add(time.Duration(cfg.Cfg.JWT.MaxAge) * time.Minute).Unix(),
+	}
+	if err := store.PutSession(s); err != nil {
+		return "", err
+	}
+	log.Debugf("created session for %s", username)
+	return id, nil
+}
+
+// Token returns the Vouch Proxy JWT of the session
+func Token(id string) (string, error) {
+	h := hash(id)
+	now := time.Now()
+
+	mu.Lock()
+	c, ok := cache[h]
+	mu.Unlock()
+	if !ok || now.After(c.until) {
+		if err := store.Session(h, &c.session); err != nil {
+			mu.Lock()
+			delete(cache, h)
+			mu.Unlock()
+			return "", err
+		}
+		c.until = now.Add(cacheTTL)
+		mu.Lock()
+		if len(cache) >= cacheSize {
+			sweep(now)
+		}
+		cache[h] = c
+		mu.Unlock()
+	}
+
+	if now.Unix() >= c.session.ExpiresOn {
+		return "", ErrNotFound
+	}
+	return c.session.Token, nil
+}
+
+// sweep drops the stale entries from the cache, or all of them when none are, mu must be held
+func sweep(now time.Time) {
+	for h, c := range cache {
+		if now.After(c.until) || now.Unix() >= c.session.ExpiresOn {
+			delete(cache, h)
+		}
+	}
+	if len(cache) >= cacheSize {
+		cache = make(map[string]cached)
+	}
+}
+
+// Revoke ends the session, as on /logout
+func Revoke(id string) error {
+	return revoke(structs.Session{Hash: hash(id)})
+}
+
+func revoke(s structs.Session) error {
+	mu.Lock()
+	delete(cache, s.Hash)
+	mu.Unlock()
+	return store.DeleteSession(s)
+}
+
+// RevokeUser ends all of the sessions of username and returns how many there were
+func RevokeUser(username string) (int, error) {
+	sessions, err := store.AllSessions()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, s := range sessions {
+		if s.Username != username {
+			continue
+		}
+		if err := revoke(s); err != nil {
+			return n, err
+		}
+		n++
+	}
+	log.Infof("revoked %d sessions of %s", n, username)
+	audit.Log(structs.AuditEvent{Type: audit.TokenRevoked, Username: username, Reason: fmt.Sprintf("%d sessions revoked", n)})
+	return n, nil
+}
+
+// RevokePath where the admins revoke the sessions of a user while Vouch Proxy runs, see RevokeHandler
+const RevokePath = "/sessions/revoke"
+
+// RevokeHandler POST RevokePath with the user whose sessions are to end, for the admins of `vouch.audit.admins`
+// whom handlers.AdminHandler lets through
+func RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username := r.PostFormValue("user")
+	if username == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	n, err := RevokeUser(username)
+	if err != nil {
+		requestlog.Logger(r).Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "revoked %d sessions of %s\n", n, username)
+}
+
+// List the sessions which haven't expired, by user
+func List() ([]structs.Session, error) {
+	if err := store.PurgeSessions(time.Now().Unix()); err != nil {
+		return nil, err
+	}
+	sessions, err := store.AllSessions()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Username != sessions[j].Username {
+			return sessions[i].Username < sessions[j].Username
+		}
+		return sessions[i].CreatedOn < sessions[j].CreatedOn
+	})
+	return sessions, nil
+}
+
+// RunCmd runs the -sessions-* command given on the command line
+func RunCmd(w io.Writer) error {
+	c := cfg.SessionCmd
+	switch {
+	case c.Revoke != "":
+		n, err := RevokeUser(c.Revoke)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "revoked %d sessions of %s\n", n, c.Revoke)
+		return err
+	case c.List:
+		sessions, err := List()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "USER\tCREATED\tEXPIRES")
+		for _, s := range sessions {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Username, date(s.CreatedOn), date(s.ExpiresOn))
+		}
+		return tw.Flush()
+	}
+	return nil
+}
+
+func date(unix int64) string {
+	return time.Unix(unix, 0).Format(time.RFC3339)
+}
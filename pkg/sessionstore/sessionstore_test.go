@@ -0,0 +1,163 @@
+package sessionstore
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+var db = model.NewMemoryStore()
+
+func init() {
+	cfg.InitForTestPurposes()
+	SetStore(db)
+}
+
+func TestCreateToken(t *testing.T) {
+	id, err := Create("alice", "alice.vouch.jwt")
+	assert.NoError(t, err)
+	assert.True(t, IsSessionID(id))
+	assert.False(t, IsSessionID("alice.vouch.jwt"))
+
+	token, err := Token(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice.vouch.jwt", token)
+
+	// only the hash of the id is stored
+	s := structs.Session{}
+	assert.Equal(t, model.ErrNotFound, db.Session([]byte(id), &s))
+	assert.NoError(t, db.Session([]byte(hash(id)), &s))
+
+	_, err = Token(Prefix + "unknown")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestRevoke(t *testing.T) {
+	id, _ := Create("alice", "alice.vouch.jwt")
+	_, err := Token(id)
+	assert.NoError(t, err)
+
+	// the cached session is dropped too
+	assert.NoError(t, Revoke(id))
+	_, err = Token(id)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestExpired(t *testing.T) {
+	id, _ := Create("alice", "alice.vouch.jwt")
+	s := structs.Session{}
+	assert.NoError(t, db.Session([]byte(hash(id)), &s))
+	s.ExpiresOn = s.CreatedOn - 1
+	assert.NoError(t, db.PutSession(s))
+
+	_, err := Token(id)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestRevokeUserAndList(t *testing.T) {
+	db = model.NewMemoryStore()
+	SetStore(db)
+
+	bob1, _ := Create("bob", "bob.vouch.jwt")
+	bob2, _ := Create("bob", "bob.other.vouch.jwt")
+	carol, _ := Create("carol", "carol.vouch.jwt")
+	Token(bob1)
+
+	sessions, err := List()
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 3) {
+		assert.Equal(t, "bob", sessions[0].Username)
+		assert.Equal(t, "carol", sessions[2].Username)
+	}
+
+	defer func() { cfg.SessionCmd.Revoke = "" }()
+	cfg.SessionCmd.Revoke = "bob"
+	out := &bytes.Buffer{}
+	assert.NoError(t, RunCmd(out))
+	assert.Equal(t, "revoked 2 sessions of bob\n", out.String())
+
+	for _, id := range []string{bob1, bob2} {
+		_, err = Token(id)
+		assert.Equal(t, ErrNotFound, err)
+	}
+	_, err = Token(carol)
+	assert.NoError(t, err)
+}
+
+func TestRevokeHandler(t *testing.T) {
+	db = model.NewMemoryStore()
+	SetStore(db)
+
+	bob, _ := Create("bob", "bob.vouch.jwt")
+	carol, _ := Create("carol", "carol.vouch.jwt")
+
+	r := httptest.NewRequest(http.MethodPost, RevokePath, strings.NewReader(url.Values{"user": {"bob"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	RevokeHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "revoked 1 sessions of bob\n", w.Body.String())
+
+	_, err := Token(bob)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = Token(carol)
+	assert.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	RevokeHandler(w, httptest.NewRequest(http.MethodGet, RevokePath+"?user=carol", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestRedisStore(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+	cfg.Cfg.Redis.Addr = mr.Addr()
+	defer redis.Close()
+
+	store = redisStore{}
+	defer SetStore(db)
+
+	id, err := Create("dave", "dave.vouch.jwt")
+	assert.NoError(t, err)
+	token, err := Token(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "dave.vouch.jwt", token)
+
+	// the key expires with the session
+	key := redis.Key("session", hash(id))
+	assert.True(t, mr.Exists(key))
+	assert.InDelta(t, time.Duration(cfg.Cfg.JWT.MaxAge)*time.Minute, mr.TTL(key), float64(time.Second))
+
+	erin, _ := Create("erin", "erin.vouch.jwt")
+	sessions, err := List()
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 2) {
+		assert.Equal(t, "dave", sessions[0].Username)
+		assert.Equal(t, "erin.vouch.jwt", sessions[1].Token)
+	}
+
+	assert.NoError(t, Revoke(id))
+	assert.False(t, mr.Exists(key))
+	_, err = Token(id)
+	assert.Equal(t, ErrNotFound, err)
+
+	mr.FastForward(time.Duration(cfg.Cfg.JWT.MaxAge+1) * time.Minute)
+	mu.Lock()
+	cache = make(map[string]cached)
+	mu.Unlock()
+	_, err = Token(erin)
+	assert.Equal(t, ErrNotFound, err)
+}
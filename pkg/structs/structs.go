@@ -1,5 +1,7 @@
 package structs
 
+import "strings"
+
 // CustomClaims Temporary struct storing custom claims until JWT creation.
 type CustomClaims struct {
 	Claims map[string]interface{}
@@ -71,6 +73,30 @@ func (u *ADFSUser) PrepareUserData() {
 	u.Username = u.UPN
 }
 
+// AzureUser Azure AD / Entra ID user record from the id_token
+type AzureUser struct {
+	User
+	PreferredUsername string `json:"preferred_username"`
+	UPN               string `json:"upn"`
+	OID               string `json:"oid"`
+}
+
+// PrepareUserData implement PersonalData interface
+func (u *AzureUser) PrepareUserData() {
+	// v2.0 tokens carry preferred_username, v1.0 tokens carry upn
+	u.Username = u.PreferredUsername
+	if u.Username == "" {
+		u.Username = u.UPN
+	}
+	if u.Username == "" {
+		u.Username = u.Email
+	}
+	// the email claim is optional in Azure AD, the UPN is usually the user's email address
+	if u.Email == "" && strings.Contains(u.Username, "@") {
+		u.Email = u.Username
+	}
+}
+
 // GitHubUser is a retrieved and authentiacted user from GitHub.
 type GitHubUser struct {
 	User
@@ -145,3 +171,66 @@ type PTokens struct {
 	PAccessToken string
 	PIdToken     string
 }
+
+// ServiceToken is a named credential for machine clients (CI jobs, cron scripts..)
+// only the hash of the token is stored
+type ServiceToken struct {
+	Name      string   `json:"name" mapstructure:"name"`
+	Hash      string   `json:"hash" mapstructure:"hash"`
+	Scopes    []string `json:"scopes" mapstructure:"scopes"` // the hosts the token may reach
+	CreatedOn int64    `json:"createdon" mapstructure:"createdon"`
+	ExpiresOn int64    `json:"expireson" mapstructure:"expireson"` // 0 never expires
+	LastUsed  int64    `json:"lastused" mapstructure:"lastused"`
+	ID        int      `json:"id" mapstructure:"id"`
+}
+
+// Session is a server side session, the cookie only holds the session id (see pkg/sessionstore)
+// keyed by the hash of the session id
+type Session struct {
+	Hash      string `json:"hash"`
+	Username  string `json:"username"`
+	Token     string `json:"-"` // the Vouch Proxy JWT with the claims and provider tokens
+	CreatedOn int64  `json:"createdon"`
+	ExpiresOn int64  `json:"expireson"`
+}
+
+// AuditEvent is a record of the audit log, such as a login or a logout
+// keyed by the ID, in the order the events happened
+type AuditEvent struct {
+	ID         int    `json:"id"`
+	Time       int64  `json:"time"`
+	Type       string `json:"type"`
+	Username   string `json:"username,omitempty"`
+	Provider   string `json:"provider,omitempty"`
+	// the client, see pkg/clientip
+	ClientIP string `json:"clientip,omitempty"`
+	// the other end of the connection, and the X-Forwarded-For header it sent
+	RemoteAddr   string `json:"remoteaddr,omitempty"`
+	ForwardedFor string `json:"forwardedfor,omitempty"`
+	Host       string `json:"host,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// Activity counts the requests of a user to a site, see pkg/activity
+// keyed by the site and the username
+type Activity struct {
+	Username  string `json:"username"`
+	Site      string `json:"site"`
+	Requests  int64  `json:"requests"`
+	FirstSeen int64  `json:"firstseen"`
+	LastSeen  int64  `json:"lastseen"`
+}
+
+// DeviceCode is a pending device authorization (RFC 8628) for a CLI or other input constrained client
+// keyed by the hash of the device_code
+type DeviceCode struct {
+	Hash      string `json:"hash"`
+	UserCode  string `json:"usercode"`
+	Interval  int64  `json:"interval"` // seconds the device must wait between polls
+	LastPoll  int64  `json:"lastpoll"`
+	ExpiresOn int64  `json:"expireson"`
+	Username  string `json:"username"` // set once the user approves
+	Token     string `json:"-"`        // the Vouch Proxy JWT handed to the device once approved
+	Denied    bool   `json:"denied"`
+	CreatedOn int64  `json:"createdon"`
+}
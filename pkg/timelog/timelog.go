@@ -1,22 +1,48 @@
 package timelog
 
 import (
-	"context"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/gorilla/mux"
+
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/requestlog"
 	"github.com/vouch/vouch-proxy/pkg/response"
+	"github.com/vouch/vouch-proxy/pkg/tracing"
 )
 
 var (
+	// the handlers run concurrently
+	mu         sync.Mutex
 	req        = int64(0)
 	avgLatency = int64(0)
 
 	log = cfg.Cfg.Logger
 )
 
+// count the request and return the number of requests and the average latency so far
+func count(latency time.Duration) (int64, time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	req++
+	avgLatency = avgLatency + ((int64(latency) - avgLatency) / req)
+	return req, time.Duration(avgLatency)
+}
+
+// routeOf is the path template the request was routed by, rather than the path, which is up to the client
+func routeOf(r *http.Request) string {
+	if rt := mux.CurrentRoute(r); rt != nil {
+		if tpl, err := rt.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return r.URL.Path
+}
+
 // TimeLog records how long it takes to process the http request and produce the response (latency)
 func TimeLog(nextHandler http.Handler) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -25,16 +51,18 @@ func TimeLog(nextHandler http.Handler) func(http.ResponseWriter, *http.Request)
 
 		// make the call
 		v := response.CaptureWriter{ResponseWriter: w, StatusCode: 0}
-		ctx := context.Background()
+		route := routeOf(r)
+		ctx, span := tracing.StartRequest(r, route)
 		nextHandler.ServeHTTP(&v, r.WithContext(ctx))
 
 		// Stop timer
 		end := time.Now()
 		latency := end.Sub(start)
-		req++
-		avgLatency = avgLatency + ((int64(latency) - avgLatency) / req)
+		n, avg := count(latency)
 		log.Debugf("Request handled successfully: %v", v.GetStatusCode())
 		var statusCode = v.GetStatusCode()
+		metrics.Request(route, statusCode, latency)
+		tracing.EndRequest(span, statusCode)
 
 		path := r.URL.Path
 		host := r.Host
@@ -42,11 +70,13 @@ func TimeLog(nextHandler http.Handler) func(http.ResponseWriter, *http.Request)
 		clientIP := r.RemoteAddr
 		method := r.Method
 
-		log.Infow(fmt.Sprintf("|%d| %10v %s", statusCode, time.Duration(latency), path),
+		// the request's logger carries the request ID and the username, see pkg/requestlog
+		requestlog.Logger(r).Infow(fmt.Sprintf("|%d| %10v %s", statusCode, time.Duration(latency), path),
 			"statusCode", statusCode,
-			"request", req,
+			"decision", requestlog.Decision(r),
+			"request", n,
 			"latency", time.Duration(latency),
-			"avgLatency", time.Duration(avgLatency),
+			"avgLatency", avg,
 			"ipPort", clientIP,
 			"method", method,
 			"host", host,
@@ -0,0 +1,50 @@
+package timelog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func TestTimeLog(t *testing.T) {
+	var route string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	muxR := mux.NewRouter()
+	muxR.HandleFunc("/sites/{site}", func(w http.ResponseWriter, r *http.Request) {
+		route = routeOf(r)
+		TimeLog(h)(w, r)
+	})
+
+	before, _ := count(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			TimeLog(h)(httptest.NewRecorder(), httptest.NewRequest("GET", "/validate", nil))
+		}()
+	}
+	wg.Wait()
+	n, avg := count(time.Millisecond)
+	assert.Equal(t, before+21, n)
+	assert.True(t, avg > 0)
+
+	w := httptest.NewRecorder()
+	muxR.ServeHTTP(w, httptest.NewRequest("GET", "/sites/app.example.com", nil))
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	// the template, so that each site isn't counted on its own
+	assert.Equal(t, "/sites/{site}", route)
+}
@@ -0,0 +1,136 @@
+package tracing
+
+// OpenTelemetry tracing
+//
+// with `vouch.tracing.enabled` each request gets a span, as do the calls to the IdP and the writes to the db made
+// while logging in. The spans are exported over OTLP to `vouch.tracing.endpoint`.
+// A W3C traceparent header, such as the one nginx sends along with the subrequest to /validate, is honored.
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+const instrumentation = "github.com/vouch/vouch-proxy"
+
+var (
+	provider *sdktrace.TracerProvider
+
+	// traceparent and tracestate, along with baggage
+	propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+	log = cfg.Cfg.Logger
+)
+
+// Enabled reports whether `vouch.tracing.enabled` is set
+func Enabled() bool {
+	return cfg.Cfg.Tracing.Enabled
+}
+
+// Start exporting the spans to the OTLP collector at `vouch.tracing.endpoint`
+func Start() error {
+	exporter, err := newExporter(context.Background())
+	if err != nil {
+		return err
+	}
+	log.Infof("exporting traces to %s over OTLP/%s", cfg.Cfg.Tracing.Endpoint, cfg.Cfg.Tracing.Protocol)
+	use(sdktrace.NewBatchSpanProcessor(exporter))
+	return nil
+}
+
+func newExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	c := cfg.Cfg.Tracing
+	if c.Protocol == "http" {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.Endpoint)}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(c.Endpoint)}
+	if c.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+// use sp for the spans from now on, tests use an in memory exporter
+func use(sp sdktrace.SpanProcessor) {
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(sp),
+		// a trace started by nginx is sampled or not as nginx decided
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Cfg.Tracing.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.Branding.LCName+"-proxy"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+}
+
+// Stop sends the spans which haven't been exported yet
+func Stop() {
+	if provider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		log.Error(err)
+	}
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// StartRequest starts the span of a request to route, within the trace of the traceparent header if there is one
+func StartRequest(r *http.Request, route string) (context.Context, trace.Span) {
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer().Start(ctx, route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.host", r.Host),
+			attribute.String("http.target", r.URL.Path),
+			attribute.String("http.route", route),
+		))
+}
+
+// EndRequest ends the span of the request with the status code of the response
+func EndRequest(span trace.Span, code int) {
+	// nothing was written, net/http responds 200
+	if code == 0 {
+		code = http.StatusOK
+	}
+	span.SetAttributes(attribute.Int("http.status_code", code))
+	if code >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(code))
+	}
+	span.End()
+}
+
+// StartSpan starts a span named name within the span of ctx
+func StartSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name)
+}
+
+// End the span, recording err if there was one
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func setUp() *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	use(sdktrace.NewSimpleSpanProcessor(exporter))
+	return exporter
+}
+
+func TestTraceparent(t *testing.T) {
+	exporter := setUp()
+
+	r := httptest.NewRequest("GET", "/validate", nil)
+	// as sent by nginx
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, span := StartRequest(r, "/validate")
+	_, child := StartSpan(ctx, "model.PutUser")
+	End(child, nil)
+	EndRequest(span, http.StatusUnauthorized)
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	req := spans[1]
+	assert.Equal(t, "/validate", req.Name)
+	assert.Equal(t, trace.SpanKindServer, req.SpanKind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", req.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", req.Parent.SpanID().String())
+	assert.True(t, req.Parent.IsRemote())
+	// a 401 is an answer, not an error
+	assert.Equal(t, codes.Unset, req.Status.Code)
+
+	assert.Equal(t, "model.PutUser", spans[0].Name)
+	assert.Equal(t, req.SpanContext.SpanID(), spans[0].Parent.SpanID())
+}
+
+func TestNotSampledByNginx(t *testing.T) {
+	exporter := setUp()
+
+	r := httptest.NewRequest("GET", "/validate", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, span := StartRequest(r, "/validate")
+	EndRequest(span, http.StatusOK)
+	assert.Empty(t, exporter.GetSpans())
+}
+
+func TestEnd(t *testing.T) {
+	exporter := setUp()
+
+	r := httptest.NewRequest("GET", "/auth", nil)
+	ctx, span := StartRequest(r, "/auth")
+	_, exchange := StartSpan(ctx, "oauth2.Exchange")
+	End(exchange, errors.New("invalid_grant"))
+	EndRequest(span, 0)
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+	assert.Equal(t, "invalid_grant", spans[0].Status.Description)
+	assert.Len(t, spans[0].Events, 1)
+	// a new trace
+	assert.False(t, spans[1].Parent.IsValid())
+	assert.Contains(t, spans[1].Attributes, attribute.Int("http.status_code", http.StatusOK))
+}
@@ -21,6 +21,9 @@ import (
 var allConns map[*websocket.Conn]bool
 var log = cfg.Cfg.Logger
 
+// the db, see ExplicitInit
+var db model.Store
+
 const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
@@ -117,7 +120,7 @@ func (c *Client) updateTeam(data interface{}) {
 	// 	log.Error(err)
 	// 	return
 	// }
-	model.PutTeam(t)
+	db.PutTeam(t)
 	c.shipTeams()
 }
 
@@ -126,9 +129,9 @@ func (c *Client) deleteTeam(data interface{}) {
 	t := structs.Team{}
 	mapstructure.Decode(data, &t)
 	log.Debugf("deleting team %v", t)
-	model.DeleteTeam(t)
+	db.DeleteTeam(t)
 	testT := structs.Team{}
-	if err := model.Team([]byte(t.Name), &testT); err != nil {
+	if err := db.Team([]byte(t.Name), &testT); err != nil {
 		log.Error(err)
 	}
 	log.Debugf("if deleted should be null: %s", testT.Name)
@@ -184,21 +187,21 @@ func (c *Client) writePump() {
 
 func (c *Client) shipUsers() {
 	var users []structs.User
-	model.AllUsers(&users)
+	db.AllUsers(&users)
 	log.Debugf("shipping users %v", users)
 	c.shipping("users", users)
 }
 
 func (c *Client) shipSites() {
 	var sites []structs.Site
-	model.AllSites(&sites)
+	db.AllSites(&sites)
 	log.Debugf("shipping sites %v", sites)
 	c.shipping("sites", sites)
 }
 
 func (c *Client) shipTeams() {
 	var teams []structs.Team
-	model.AllTeams(&teams)
+	db.AllTeams(&teams)
 	log.Debugf("shipping teams %v", teams)
 	c.shipping("teams", teams)
 }
@@ -2,6 +2,8 @@ package transciever
 
 import (
 	"net/http"
+
+	"github.com/vouch/vouch-proxy/pkg/model"
 )
 
 // WSHandler implements the Handler Interface
@@ -19,7 +21,9 @@ var hh = &HubHolder{
 }
 
 // ExplicitInit only run init() if we're configured for such
-func ExplicitInit() {
+// the teams, users and sites are read from and kept in s
+func ExplicitInit(s model.Store) {
+	db = s
 	log.Debugf("hub %v", hh.Hub)
 	go hh.Hub.run()
 }